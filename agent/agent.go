@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/plakar/appcontext"
 	"github.com/PlakarKorp/plakar/subcommands"
 	"github.com/PlakarKorp/plakar/utils"
@@ -24,6 +25,15 @@ type Packet struct {
 	ExitCode int
 	Eof      bool
 	Err      string
+
+	// set on exit when the command created a snapshot
+	SnapshotID objects.MAC
+}
+
+// Result is the outcome of a command executed by the agent.
+type Result struct {
+	ExitCode   int
+	SnapshotID objects.MAC
 }
 
 type Client struct {
@@ -37,9 +47,18 @@ var (
 )
 
 func ExecuteRPC(ctx *appcontext.AppContext, name []string, cmd subcommands.Subcommand, storeConfig map[string]string) (int, error) {
+	if res, err := ExecuteRPCWithResult(ctx, name, cmd, storeConfig); err != nil {
+		return res.ExitCode, err
+	}
+	return 0, nil
+}
+
+// ExecuteRPCWithResult is like ExecuteRPC but also returns the identifier
+// of the snapshot created by the command, if any.
+func ExecuteRPCWithResult(ctx *appcontext.AppContext, name []string, cmd subcommands.Subcommand, storeConfig map[string]string) (Result, error) {
 	client, err := NewClient(filepath.Join(ctx.CacheDir, "agent.sock"), cmd.GetFlags()&subcommands.IgnoreVersion != 0)
 	if err != nil {
-		return 1, err
+		return Result{ExitCode: 1}, err
 	}
 	defer client.Close()
 
@@ -48,10 +67,7 @@ func ExecuteRPC(ctx *appcontext.AppContext, name []string, cmd subcommands.Subco
 		client.Close()
 	}()
 
-	if status, err := client.SendCommand(ctx, name, cmd, storeConfig); err != nil {
-		return status, err
-	}
-	return 0, nil
+	return client.sendCommand(ctx, name, cmd, storeConfig)
 }
 
 func NewClient(socketPath string, ignoreVersion bool) (*Client, error) {
@@ -156,15 +172,22 @@ func (c *Client) handshake(ignoreVersion bool) error {
 }
 
 func (c *Client) SendCommand(ctx *appcontext.AppContext, name []string, cmd subcommands.Subcommand, storeConfig map[string]string) (int, error) {
+	res, err := c.sendCommand(ctx, name, cmd, storeConfig)
+	return res.ExitCode, err
+}
+
+func (c *Client) sendCommand(ctx *appcontext.AppContext, name []string, cmd subcommands.Subcommand, storeConfig map[string]string) (Result, error) {
 	if cmd.GetFlags()&subcommands.AgentSupport == 0 {
-		return 1, fmt.Errorf("command %v doesn't support execution through agent", strings.Join(name, " "))
+		return Result{ExitCode: 1}, fmt.Errorf("command %v doesn't support execution through agent", strings.Join(name, " "))
 	}
 
 	cmd.SetLogInfo(ctx.GetLogger().EnabledInfo)
 	cmd.SetLogTraces(ctx.GetLogger().EnabledTracing)
+	cmd.SetUsername(ctx.Username)
+	cmd.SetProcessID(ctx.ProcessID)
 
 	if err := subcommands.EncodeRPC(c.enc, name, cmd, storeConfig); err != nil {
-		return 1, err
+		return Result{ExitCode: 1}, err
 	}
 
 	var response Packet
@@ -174,9 +197,9 @@ func (c *Client) SendCommand(ctx *appcontext.AppContext, name []string, cmd subc
 				break
 			}
 			if err := ctx.Err(); err != nil {
-				return 1, err
+				return Result{ExitCode: 1}, err
 			}
-			return 1, fmt.Errorf("failed to decode response: %w", err)
+			return Result{ExitCode: 1}, fmt.Errorf("failed to decode response: %w", err)
 		}
 		switch response.Type {
 		case "stdin":
@@ -192,7 +215,18 @@ func (c *Client) SendCommand(ctx *appcontext.AppContext, name []string, cmd subc
 			}
 			err = c.enc.Encode(pkt)
 			if err != nil {
-				return 1, fmt.Errorf("failed to send stdin: %w", err)
+				return Result{ExitCode: 1}, fmt.Errorf("failed to send stdin: %w", err)
+			}
+		case "passphrase":
+			pkt := &Packet{Type: "passphrase"}
+			passphrase, err := utils.GetPassphrase(string(response.Data))
+			if err != nil {
+				pkt.Err = err.Error()
+			} else {
+				pkt.Data = passphrase
+			}
+			if err := c.enc.Encode(pkt); err != nil {
+				return Result{ExitCode: 1}, fmt.Errorf("failed to send passphrase: %w", err)
 			}
 		case "stdout":
 			fmt.Printf("%s", string(response.Data))
@@ -203,10 +237,10 @@ func (c *Client) SendCommand(ctx *appcontext.AppContext, name []string, cmd subc
 			if response.Err != "" {
 				err = fmt.Errorf("%s", response.Err)
 			}
-			return response.ExitCode, err
+			return Result{ExitCode: response.ExitCode, SnapshotID: response.SnapshotID}, err
 		}
 	}
-	return 0, nil
+	return Result{}, nil
 }
 
 func (c *Client) Close() error {
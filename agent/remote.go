@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const REMOTE_DIAL_TIMEOUT = 30 * time.Second
+
+// Remote describes an agent listening on TCP, which requires the clients
+// to authenticate with a certificate.
+type Remote struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the TLS configuration of an agent listening on
+// TCP: its certificate and key, and the CA the certificates of the clients
+// must be signed by.
+func ServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client CA: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// TLSConfig returns the TLS configuration to connect to the remote agent.
+func (r *Remote) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	pool, err := loadCertPool(r.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA: %w", err)
+	}
+
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// NewRemoteClient connects to the remote agent.
+func NewRemoteClient(remote *Remote, ignoreVersion bool) (*Client, error) {
+	config, err := remote.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: REMOTE_DIAL_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", remote.Addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the agent at %s: %w", remote.Addr, err)
+	}
+
+	c := &Client{
+		conn: conn,
+		enc:  msgpack.NewEncoder(conn),
+		dec:  msgpack.NewDecoder(conn),
+	}
+
+	if err := c.handshake(ignoreVersion); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ExecuteRemoteRPC runs the command on the remote agent and returns its
+// exit code.
+func ExecuteRemoteRPC(ctx *appcontext.AppContext, remote *Remote, name []string, cmd subcommands.Subcommand, storeConfig map[string]string) (int, error) {
+	client, err := NewRemoteClient(remote, cmd.GetFlags()&subcommands.IgnoreVersion != 0)
+	if err != nil {
+		return 1, err
+	}
+	defer client.Close()
+
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	res, err := client.sendCommand(ctx, name, cmd, storeConfig)
+	return res.ExitCode, err
+}
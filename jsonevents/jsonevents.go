@@ -0,0 +1,246 @@
+package jsonevents
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/events"
+	"github.com/PlakarKorp/plakar/appcontext"
+)
+
+// Event is the JSON form of an event, written as one line.  Status is
+// one of "ok", "error", "missing" or "corrupted" for the events reporting
+// the outcome of an entry, it is empty for those reporting that the entry
+// is being processed.
+type Event struct {
+	Type       string    `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	SnapshotID string    `json:"snapshot_id,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	MAC        string    `json:"mac,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Error      string    `json:"error,omitempty"`
+
+	// set on the "importer" event ending the scan of the source
+	Files       uint64 `json:"files,omitempty"`
+	Directories uint64 `json:"directories,omitempty"`
+}
+
+// Summary is the last line written, with the outcome of the command.
+type Summary struct {
+	Type        string   `json:"type"`
+	Status      string   `json:"status"`
+	Error       string   `json:"error,omitempty"`
+	Warning     string   `json:"warning,omitempty"`
+	Snapshots   []string `json:"snapshots"`
+	Files       uint64   `json:"files"`
+	Directories uint64   `json:"directories"`
+	Size        int64    `json:"size"`
+	Errors      uint64   `json:"errors"`
+	Missing     uint64   `json:"missing"`
+	Corrupted   uint64   `json:"corrupted"`
+	Duration    float64  `json:"duration"`
+}
+
+// flush is sent through the events once the command is done: the events
+// are delivered in order, so all the events of the command have been
+// written when it is received.
+type flush struct {
+	processor *Processor
+}
+
+// Processor writes the events of a command as JSON lines on its standard
+// output.
+type Processor struct {
+	enc     *json.Encoder
+	start   time.Time
+	summary Summary
+	seen    map[[32]byte]struct{}
+
+	events  *events.Receiver
+	flushed chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Start listens to the events of ctx until Close is called.
+func Start(ctx *appcontext.AppContext) *Processor {
+	return start(ctx.Stdout, ctx.Events())
+}
+
+func start(w io.Writer, receiver *events.Receiver) *Processor {
+	p := &Processor{
+		enc:     json.NewEncoder(w),
+		start:   time.Now(),
+		summary: Summary{Type: "summary", Snapshots: []string{}},
+		seen:    make(map[[32]byte]struct{}),
+		events:  receiver,
+		flushed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	listener := receiver.Listen()
+	go func() {
+		defer close(p.done)
+		// the listener must be drained until the events are closed, even
+		// once flushed, not to block the senders
+		flushed := false
+		for event := range listener {
+			if flushed {
+				continue
+			}
+			if f, ok := event.(flush); ok {
+				if f.processor == p {
+					flushed = true
+					close(p.flushed)
+				}
+				continue
+			}
+			if ev, ok := p.convert(event); ok {
+				p.enc.Encode(ev)
+			}
+		}
+	}()
+	return p
+}
+
+// Close writes the summary of the command, which failed if err is set.
+func (p *Processor) Close(err error) {
+	p.CloseWithWarning(err, nil)
+}
+
+// CloseWithWarning writes the summary of the command, which failed if err
+// is set or otherwise completed with a warning if warning is set.
+func (p *Processor) CloseWithWarning(err error, warning error) {
+	p.once.Do(func() {
+		p.events.Send(flush{processor: p})
+		select {
+		case <-p.flushed:
+		case <-p.done:
+		}
+
+		switch {
+		case err != nil:
+			p.summary.Status = "error"
+			p.summary.Error = err.Error()
+		case warning != nil:
+			p.summary.Status = "warning"
+			p.summary.Warning = warning.Error()
+		default:
+			p.summary.Status = "ok"
+		}
+		p.summary.Duration = time.Since(p.start).Seconds()
+		p.enc.Encode(p.summary)
+	})
+}
+
+func (p *Processor) snapshot(id [32]byte) string {
+	if id == ([32]byte{}) {
+		return ""
+	}
+	s := hex.EncodeToString(id[:])
+	if _, ok := p.seen[id]; !ok {
+		p.seen[id] = struct{}{}
+		p.summary.Snapshots = append(p.summary.Snapshots, s)
+	}
+	return s
+}
+
+func (p *Processor) convert(event interface{}) (*Event, bool) {
+	var ev *Event
+	entry := func(typ string, ts time.Time, snapshotID [32]byte, path, status string) *Event {
+		return &Event{Type: typ, Timestamp: ts, SnapshotID: p.snapshot(snapshotID), Path: path, Status: status}
+	}
+	object := func(typ string, ts time.Time, snapshotID [32]byte, mac [32]byte, status string) *Event {
+		return &Event{Type: typ, Timestamp: ts, SnapshotID: p.snapshot(snapshotID), MAC: hex.EncodeToString(mac[:]), Status: status}
+	}
+
+	switch e := event.(type) {
+	case events.Start:
+		ev = &Event{Type: "start", Timestamp: e.Timestamp}
+	case events.Done:
+		ev = &Event{Type: "done", Timestamp: e.Timestamp}
+	case events.Warning:
+		ev = &Event{Type: "warning", Timestamp: e.Timestamp, SnapshotID: p.snapshot(e.SnapshotID), Error: e.Message}
+	case events.Error:
+		p.summary.Errors++
+		ev = &Event{Type: "error", Timestamp: e.Timestamp, SnapshotID: p.snapshot(e.SnapshotID), Error: e.Message}
+
+	case events.StartImporter:
+		ev = &Event{Type: "importer", Timestamp: e.Timestamp, SnapshotID: p.snapshot(e.SnapshotID)}
+	case events.DoneImporter:
+		ev = &Event{Type: "importer", Timestamp: e.Timestamp, SnapshotID: p.snapshot(e.SnapshotID), Status: "ok",
+			Files: e.NumFiles, Directories: e.NumDirectories, Size: int64(e.Size)}
+
+	case events.Path:
+		ev = entry("path", e.Timestamp, e.SnapshotID, e.Pathname, "")
+	case events.PathError:
+		p.summary.Errors++
+		ev = entry("path", e.Timestamp, e.SnapshotID, e.Pathname, "error")
+		ev.Error = e.Message
+
+	case events.Directory:
+		ev = entry("directory", e.Timestamp, e.SnapshotID, e.Pathname, "")
+	case events.DirectoryOK:
+		p.summary.Directories++
+		ev = entry("directory", e.Timestamp, e.SnapshotID, e.Pathname, "ok")
+	case events.DirectoryError:
+		p.summary.Errors++
+		ev = entry("directory", e.Timestamp, e.SnapshotID, e.Pathname, "error")
+		ev.Error = e.Message
+	case events.DirectoryMissing:
+		p.summary.Missing++
+		ev = entry("directory", e.Timestamp, e.SnapshotID, e.Pathname, "missing")
+	case events.DirectoryCorrupted:
+		p.summary.Corrupted++
+		ev = entry("directory", e.Timestamp, e.SnapshotID, e.Pathname, "corrupted")
+
+	case events.File:
+		ev = entry("file", e.Timestamp, e.SnapshotID, e.Pathname, "")
+	case events.FileOK:
+		p.summary.Files++
+		p.summary.Size += e.Size
+		ev = entry("file", e.Timestamp, e.SnapshotID, e.Pathname, "ok")
+		ev.Size = e.Size
+	case events.FileError:
+		p.summary.Errors++
+		ev = entry("file", e.Timestamp, e.SnapshotID, e.Pathname, "error")
+		ev.Error = e.Message
+	case events.FileMissing:
+		p.summary.Missing++
+		ev = entry("file", e.Timestamp, e.SnapshotID, e.Pathname, "missing")
+	case events.FileCorrupted:
+		p.summary.Corrupted++
+		ev = entry("file", e.Timestamp, e.SnapshotID, e.Pathname, "corrupted")
+
+	case events.Object:
+		ev = object("object", e.Timestamp, e.SnapshotID, e.MAC, "")
+	case events.ObjectOK:
+		ev = object("object", e.Timestamp, e.SnapshotID, e.MAC, "ok")
+	case events.ObjectMissing:
+		p.summary.Missing++
+		ev = object("object", e.Timestamp, e.SnapshotID, e.MAC, "missing")
+	case events.ObjectCorrupted:
+		p.summary.Corrupted++
+		ev = object("object", e.Timestamp, e.SnapshotID, e.MAC, "corrupted")
+
+	case events.Chunk:
+		ev = object("chunk", e.Timestamp, e.SnapshotID, e.MAC, "")
+	case events.ChunkOK:
+		ev = object("chunk", e.Timestamp, e.SnapshotID, e.MAC, "ok")
+	case events.ChunkMissing:
+		p.summary.Missing++
+		ev = object("chunk", e.Timestamp, e.SnapshotID, e.MAC, "missing")
+	case events.ChunkCorrupted:
+		p.summary.Corrupted++
+		ev = object("chunk", e.Timestamp, e.SnapshotID, e.MAC, "corrupted")
+
+	default:
+		return nil, false
+	}
+	return ev, true
+}
@@ -0,0 +1,118 @@
+package jsonevents
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/events"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, buf *bytes.Buffer) ([]Event, Summary) {
+	t.Helper()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+	require.NoError(t, scanner.Err())
+	require.NotEmpty(t, lines)
+
+	var evs []Event
+	for _, line := range lines[:len(lines)-1] {
+		var ev Event
+		require.NoError(t, json.Unmarshal(line, &ev))
+		evs = append(evs, ev)
+	}
+	var summary Summary
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &summary))
+	return evs, summary
+}
+
+func TestProcessor(t *testing.T) {
+	receiver := events.New()
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	p := start(buf, receiver)
+
+	snapshotID := [32]byte{1, 2, 3}
+	receiver.Send(events.StartEvent())
+	receiver.Send(events.FileEvent(snapshotID, "/a"))
+	receiver.Send(events.FileOKEvent(snapshotID, "/a", 42))
+	receiver.Send(events.FileErrorEvent(snapshotID, "/b", "permission denied"))
+	receiver.Send(events.DirectoryOKEvent(snapshotID, "/"))
+	receiver.Send(events.ObjectMissingEvent(snapshotID, [32]byte{4}))
+	receiver.Send(events.ChunkCorruptedEvent(snapshotID, [32]byte{5}))
+	receiver.Send("not an event")
+	receiver.Send(events.DoneEvent())
+	p.Close(nil)
+
+	// events sent once closed are not written
+	receiver.Send(events.FileOKEvent(snapshotID, "/c", 1))
+	p.Close(errors.New("ignored"))
+
+	evs, summary := decode(t, buf)
+	require.Len(t, evs, 8)
+
+	require.Equal(t, "start", evs[0].Type)
+	require.Equal(t, "file", evs[1].Type)
+	require.Equal(t, "", evs[1].Status)
+	require.Equal(t, "/a", evs[2].Path)
+	require.Equal(t, "ok", evs[2].Status)
+	require.Equal(t, int64(42), evs[2].Size)
+	require.Equal(t, hex.EncodeToString(snapshotID[:]), evs[2].SnapshotID)
+	require.Equal(t, "error", evs[3].Status)
+	require.Equal(t, "permission denied", evs[3].Error)
+	require.Equal(t, "directory", evs[4].Type)
+	require.Equal(t, "object", evs[5].Type)
+	require.Equal(t, "missing", evs[5].Status)
+	require.Equal(t, "chunk", evs[6].Type)
+	require.Equal(t, "corrupted", evs[6].Status)
+	require.Equal(t, "done", evs[7].Type)
+
+	require.Equal(t, "summary", summary.Type)
+	require.Equal(t, "ok", summary.Status)
+	require.Empty(t, summary.Error)
+	require.Equal(t, []string{hex.EncodeToString(snapshotID[:])}, summary.Snapshots)
+	require.Equal(t, uint64(1), summary.Files)
+	require.Equal(t, uint64(1), summary.Directories)
+	require.Equal(t, int64(42), summary.Size)
+	require.Equal(t, uint64(1), summary.Errors)
+	require.Equal(t, uint64(1), summary.Missing)
+	require.Equal(t, uint64(1), summary.Corrupted)
+}
+
+func TestProcessorError(t *testing.T) {
+	receiver := events.New()
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	p := start(buf, receiver)
+	p.Close(errors.New("failed to open the source"))
+
+	evs, summary := decode(t, buf)
+	require.Empty(t, evs)
+	require.Equal(t, "error", summary.Status)
+	require.Equal(t, "failed to open the source", summary.Error)
+	require.Equal(t, []string{}, summary.Snapshots)
+}
+
+func TestProcessorWarning(t *testing.T) {
+	receiver := events.New()
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	p := start(buf, receiver)
+	p.CloseWithWarning(nil, errors.New("2 errors during backup"))
+
+	_, summary := decode(t, buf)
+	require.Equal(t, "warning", summary.Status)
+	require.Equal(t, "2 errors during backup", summary.Warning)
+	require.Empty(t, summary.Error)
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/PlakarKorp/plakar/plugins"
 	"github.com/PlakarKorp/plakar/subcommands"
 	"github.com/PlakarKorp/plakar/task"
+	"github.com/PlakarKorp/plakar/throttle"
 	"github.com/PlakarKorp/plakar/utils"
 	"github.com/denisbrodbeck/machineid"
 	"github.com/google/uuid"
@@ -53,6 +54,7 @@ import (
 	_ "github.com/PlakarKorp/plakar/subcommands/pkg"
 	_ "github.com/PlakarKorp/plakar/subcommands/prune"
 	_ "github.com/PlakarKorp/plakar/subcommands/ptar"
+	_ "github.com/PlakarKorp/plakar/subcommands/reports"
 	_ "github.com/PlakarKorp/plakar/subcommands/restore"
 	_ "github.com/PlakarKorp/plakar/subcommands/rm"
 	_ "github.com/PlakarKorp/plakar/subcommands/scheduler"
@@ -117,6 +119,11 @@ func entryPoint() int {
 	var opt_quiet bool
 	var opt_keyfile string
 	var opt_agentless bool
+	var opt_detach bool
+	var opt_remote string
+	var opt_remoteCert string
+	var opt_remoteKey string
+	var opt_remoteCA string
 	var opt_enableSecurityCheck bool
 	var opt_disableSecurityCheck bool
 
@@ -129,6 +136,11 @@ func entryPoint() int {
 	flag.BoolVar(&opt_quiet, "quiet", false, "no output except errors")
 	flag.StringVar(&opt_keyfile, "keyfile", "", "use passphrase from key file when prompted")
 	flag.BoolVar(&opt_agentless, "no-agent", false, "run without agent")
+	flag.BoolVar(&opt_detach, "detach", false, "leave the command running in the agent and print its job ID")
+	flag.StringVar(&opt_remote, "remote", "", "run the command on the agent listening on this address")
+	flag.StringVar(&opt_remoteCert, "remote-cert", "", "certificate to authenticate to the remote agent")
+	flag.StringVar(&opt_remoteKey, "remote-key", "", "key of the certificate for -remote")
+	flag.StringVar(&opt_remoteCA, "remote-ca", "", "CA the certificate of the remote agent is signed by")
 	flag.BoolVar(&opt_enableSecurityCheck, "enable-security-check", false, "enable update check")
 	flag.BoolVar(&opt_disableSecurityCheck, "disable-security-check", false, "disable update check")
 
@@ -305,10 +317,14 @@ func entryPoint() int {
 		args = flag.Args()
 	}
 
-	storeConfig, err := ctx.Config.GetRepository(repositoryPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
-		return 1
+	// a remote agent resolves the repository from its own configuration
+	storeConfig := map[string]string{"location": repositoryPath}
+	if opt_remote == "" {
+		storeConfig, err = ctx.Config.GetRepository(repositoryPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
+			return 1
+		}
 	}
 
 	cmd, name, args := subcommands.Lookup(args)
@@ -328,10 +344,38 @@ func entryPoint() int {
 		ctx.KeyFromFile = passphrase
 	}
 
+	var remote *agent.Remote
+	if opt_remote != "" {
+		if opt_agentless {
+			fmt.Fprintf(os.Stderr, "%s: -remote cannot be used with -no-agent\n", flag.CommandLine.Name())
+			return 1
+		}
+		if opt_remoteCert == "" || opt_remoteKey == "" || opt_remoteCA == "" {
+			fmt.Fprintf(os.Stderr, "%s: -remote requires -remote-cert, -remote-key and -remote-ca\n", flag.CommandLine.Name())
+			return 1
+		}
+		if cmd.GetFlags()&subcommands.AgentSupport == 0 {
+			fmt.Fprintf(os.Stderr, "%s: %s cannot run on a remote agent\n", flag.CommandLine.Name(), strings.Join(name, " "))
+			return 1
+		}
+		remote = &agent.Remote{
+			Addr:     opt_remote,
+			CertFile: opt_remoteCert,
+			KeyFile:  opt_remoteKey,
+			CAFile:   opt_remoteCA,
+		}
+	}
+
 	var store storage.Store
 	var repo *repository.Repository
 
-	if cmd.GetFlags()&subcommands.BeforeRepositoryOpen != 0 {
+	if remote != nil {
+		// the repository is opened by the remote agent, which asks for
+		// the passphrase if it doesn't have the key.
+		if passphrase != "" {
+			storeConfig["passphrase"] = passphrase
+		}
+	} else if cmd.GetFlags()&subcommands.BeforeRepositoryOpen != 0 {
 		if at {
 			log.Fatalf("%s: %s command cannot be used with 'at' parameter.",
 				flag.CommandLine.Name(), strings.Join(name, " "))
@@ -345,7 +389,7 @@ func entryPoint() int {
 		}
 	} else {
 		var serializedConfig []byte
-		store, serializedConfig, err = storage.Open(ctx.GetInner(), storeConfig)
+		store, serializedConfig, err = throttle.Open(ctx.GetInner(), storeConfig)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: failed to open the repository at %s: %s\n", flag.CommandLine.Name(), storeConfig["location"], err)
 			fmt.Fprintln(os.Stderr, "To specify an alternative repository, please use \"plakar at <location> <command>\".")
@@ -364,22 +408,28 @@ func entryPoint() int {
 			return 1
 		}
 
-		if err := setupEncryption(ctx, repoConfig); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
-			return 1
-		}
-
-		if opt_agentless {
-			repo, err = repository.New(ctx.GetInner(), ctx.GetSecret(), store, serializedConfig)
-			if err != nil {
+		// through the agent, the key of an encrypted repository may be
+		// held by the agent already, which asks for the passphrase
+		// otherwise.
+		viaAgent := !opt_agentless && cmd.GetFlags()&subcommands.AgentSupport != 0
+		if !viaAgent || repoConfig.Encryption == nil || ctx.KeyFromFile != "" {
+			if err := setupEncryption(ctx, repoConfig); err != nil {
 				fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
 				return 1
 			}
-		} else {
-			repo, err = repository.NewNoRebuild(ctx.GetInner(), ctx.GetSecret(), store, serializedConfig)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
-				return 1
+
+			if opt_agentless {
+				repo, err = repository.New(ctx.GetInner(), ctx.GetSecret(), store, serializedConfig)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
+					return 1
+				}
+			} else {
+				repo, err = repository.NewNoRebuild(ctx.GetInner(), ctx.GetSecret(), store, serializedConfig)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", flag.CommandLine.Name(), err)
+					return 1
+				}
 			}
 		}
 	}
@@ -403,8 +453,17 @@ func entryPoint() int {
 
 	var status int
 
-	runWithoutAgent := opt_agentless || cmd.GetFlags()&subcommands.AgentSupport == 0
-	if runWithoutAgent {
+	runWithoutAgent := remote == nil && (opt_agentless || cmd.GetFlags()&subcommands.AgentSupport == 0)
+	if opt_detach {
+		if runWithoutAgent {
+			fmt.Fprintf(os.Stderr, "%s: -detach requires the command to run through the agent\n", flag.CommandLine.Name())
+			return 1
+		}
+		cmd.SetDetach(true)
+	}
+	if remote != nil {
+		status, err = agent.ExecuteRemoteRPC(ctx, remote, name, cmd, storeConfig)
+	} else if runWithoutAgent {
 		status, err = task.RunCommand(ctx, cmd, repo, "@agentless")
 	} else {
 		status, err = agent.ExecuteRPC(ctx, name, cmd, storeConfig)
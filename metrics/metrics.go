@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/reporting"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics exposes the outcome of the tasks recorded in the reports of the
+// cache directory, whichever process ran them.  The reports are read when
+// the metrics are scraped.
+type Metrics struct {
+	mtx      sync.Mutex
+	follower *reporting.Follower
+	registry *prometheus.Registry
+
+	tasks         *prometheus.CounterVec
+	lastRun       *prometheus.GaugeVec
+	lastSuccess   *prometheus.GaugeVec
+	duration      *prometheus.HistogramVec
+	backupBytes   *prometheus.GaugeVec
+	backupFiles   *prometheus.GaugeVec
+	repoSize      *prometheus.GaugeVec
+	repoSnapshots *prometheus.GaugeVec
+}
+
+func NewMetrics(cacheDir string) *Metrics {
+	m := &Metrics{
+		follower: reporting.NewFollower(reporting.ReportsDir(cacheDir)),
+		registry: prometheus.NewRegistry(),
+
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "plakar_tasks_total",
+			Help: "Number of tasks run, by kind, name and status.",
+		}, []string{"kind", "name", "status"}),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_task_last_run_timestamp_seconds",
+			Help: "Time at which the task last ended.",
+		}, []string{"kind", "name"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_task_last_success_timestamp_seconds",
+			Help: "Time at which the task last ended successfully.",
+		}, []string{"kind", "name"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "plakar_task_duration_seconds",
+			Help:    "Duration of the tasks, by kind and status.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"kind", "status"}),
+		backupBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_backup_bytes",
+			Help: "Size of the data in the last snapshot of the backup task.",
+		}, []string{"name"}),
+		backupFiles: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_backup_files",
+			Help: "Number of files in the last snapshot of the backup task.",
+		}, []string{"name"}),
+		repoSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_repository_size_bytes",
+			Help: "Size of the repository at the end of the last task on it.",
+		}, []string{"repository"}),
+		repoSnapshots: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "plakar_repository_snapshots",
+			Help: "Number of snapshots in the repository at the end of the last task on it.",
+		}, []string{"repository"}),
+	}
+
+	m.registry.MustRegister(m.tasks, m.lastRun, m.lastSuccess, m.duration,
+		m.backupBytes, m.backupFiles, m.repoSize, m.repoSnapshots)
+	return m
+}
+
+// Observe accounts for a task report.
+func (m *Metrics) Observe(report *reporting.Report) {
+	task := report.Task
+	if task == nil || task.Type == "" {
+		return
+	}
+
+	end := task.StartTime.Add(task.Duration)
+	m.tasks.WithLabelValues(task.Type, task.Name, string(task.Status)).Inc()
+	m.lastRun.WithLabelValues(task.Type, task.Name).Set(float64(end.Unix()))
+	if task.Status == reporting.StatusOK {
+		m.lastSuccess.WithLabelValues(task.Type, task.Name).Set(float64(end.Unix()))
+	}
+	m.duration.WithLabelValues(task.Type, string(task.Status)).Observe(task.Duration.Seconds())
+
+	if task.Type == "backup" && report.Snapshot != nil {
+		var size, files uint64
+		for _, source := range report.Snapshot.Sources {
+			size += source.Summary.Directory.Size + source.Summary.Below.Size
+			files += source.Summary.Directory.Files + source.Summary.Below.Files
+		}
+		m.backupBytes.WithLabelValues(task.Name).Set(float64(size))
+		m.backupFiles.WithLabelValues(task.Name).Set(float64(files))
+	}
+
+	if report.Repository != nil && report.Repository.Stats != nil {
+		stats := report.Repository.Stats
+		m.repoSize.WithLabelValues(report.Repository.Name).Set(float64(stats.Size))
+		m.repoSnapshots.WithLabelValues(report.Repository.Name).Set(float64(stats.Snapshots))
+	}
+}
+
+// Update accounts for the reports recorded since the previous update.
+func (m *Metrics) Update() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.follower.Next(func(id string, report *reporting.Report) error {
+		m.Observe(report)
+		return nil
+	})
+}
+
+func (m *Metrics) Handler() http.Handler {
+	handler := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Update(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Serve exposes the metrics over HTTP on addr, under /metrics, until ctx is
+// done.  It fails if the reports are not recorded in the cache directory,
+// since the metrics would remain empty.
+func Serve(ctx *appcontext.AppContext, addr string) error {
+	cfg, err := reporting.LoadConfig(ctx.ConfigDir)
+	if err != nil {
+		return err
+	}
+	if cfg.File.Disabled {
+		return fmt.Errorf("metrics need the reports recorded in the cache directory, which %s disables",
+			reporting.ConfigPath(ctx.ConfigDir))
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	m := NewMetrics(ctx.CacheDir)
+	if err := m.Update(); err != nil {
+		ctx.GetLogger().Warn("failed to read the reports: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ctx.GetLogger().Error("metrics server: %s", err)
+		}
+	}()
+
+	ctx.GetLogger().Info("serving metrics on %s", listener.Addr())
+	return nil
+}
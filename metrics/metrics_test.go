@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/kloset/snapshot/header"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/reporting"
+	"github.com/PlakarKorp/plakar/subcommands/rm"
+	"github.com/PlakarKorp/plakar/task"
+	ptesting "github.com/PlakarKorp/plakar/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	cacheDir := t.TempDir()
+	emitter := reporting.NewFileEmitter(reporting.ReportsDir(cacheDir), reporting.FileConfig{})
+	start := time.Unix(1760000000, 0)
+
+	emit := func(report *reporting.Report) {
+		require.NoError(t, emitter.Emit(context.Background(), report))
+	}
+
+	source := header.NewSource()
+	source.Summary.Directory.Files = 2
+	source.Summary.Directory.Size = 100
+	source.Summary.Below.Files = 40
+	source.Summary.Below.Size = 4000
+	emit(&reporting.Report{
+		Task: &reporting.ReportTask{
+			Type:      "backup",
+			Name:      "home",
+			StartTime: start,
+			Duration:  90 * time.Second,
+			Status:    reporting.StatusOK,
+		},
+		Repository: &reporting.ReportRepository{
+			Name:  "fs:///backups",
+			Stats: &reporting.ReportRepositoryStats{Size: 123456, Snapshots: 7},
+		},
+		Snapshot: &reporting.ReportSnapshot{
+			Header: header.Header{Sources: []header.Source{source}},
+		},
+	})
+
+	m := NewMetrics(cacheDir)
+	body := scrape(t, m)
+	require.Contains(t, body, `plakar_tasks_total{kind="backup",name="home",status="OK"} 1`)
+	require.Contains(t, body, `plakar_task_last_success_timestamp_seconds{kind="backup",name="home"} 1.76000009e+09`)
+	require.Contains(t, body, `plakar_backup_bytes{name="home"} 4100`)
+	require.Contains(t, body, `plakar_backup_files{name="home"} 42`)
+	require.Contains(t, body, `plakar_repository_size_bytes{repository="fs:///backups"} 123456`)
+	require.Contains(t, body, `plakar_repository_snapshots{repository="fs:///backups"} 7`)
+	require.Contains(t, body, `plakar_task_duration_seconds_count{kind="backup",status="OK"} 1`)
+
+	// reports recorded afterwards are accounted for on the next scrape,
+	// and a failure doesn't move the last success
+	emit(&reporting.Report{
+		Task: &reporting.ReportTask{
+			Type:      "backup",
+			Name:      "home",
+			StartTime: start.Add(time.Hour),
+			Duration:  time.Second,
+			Status:    reporting.StatusFailed,
+		},
+	})
+	body = scrape(t, m)
+	require.Contains(t, body, `plakar_tasks_total{kind="backup",name="home",status="FAILURE"} 1`)
+	require.Contains(t, body, `plakar_task_last_success_timestamp_seconds{kind="backup",name="home"} 1.76000009e+09`)
+	require.Contains(t, body, `plakar_task_last_run_timestamp_seconds{kind="backup",name="home"} 1.760003601e+09`)
+}
+
+func TestMetricsTaskName(t *testing.T) {
+	repo, ctx := ptesting.GenerateRepository(t, nil, nil, nil)
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+	ctx.ConfigDir = t.TempDir()
+
+	// the tasks run by the scheduler are reported under their name, the
+	// others under the name given by the caller
+	for _, name := range []string{"nightly", "weekly", ""} {
+		cmd := &rm.Rm{LocateOptions: locate.NewDefaultLocateOptions(locate.WithJob(name))}
+		cmd.SetTaskName(name)
+		status, _, err := task.RunTask(ctx, cmd, repo, "@agent")
+		require.NoError(t, err)
+		require.Equal(t, 0, status)
+	}
+
+	body := scrape(t, NewMetrics(ctx.CacheDir))
+	require.Contains(t, body, `plakar_tasks_total{kind="rm",name="nightly",status="OK"} 1`)
+	require.Contains(t, body, `plakar_tasks_total{kind="rm",name="weekly",status="OK"} 1`)
+	require.Contains(t, body, `plakar_tasks_total{kind="rm",name="@agent",status="OK"} 1`)
+}
+
+func TestServeReportsDisabled(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+	ctx.ConfigDir = t.TempDir()
+	defer ctx.Cancel()
+
+	config := "version: v1.0.0\nfile:\n  disabled: true\n"
+	require.NoError(t, os.WriteFile(reporting.ConfigPath(ctx.ConfigDir), []byte(config), 0600))
+	require.Error(t, Serve(ctx, "127.0.0.1:0"))
+
+	require.NoError(t, os.Remove(reporting.ConfigPath(ctx.ConfigDir)))
+	require.NoError(t, Serve(ctx, "127.0.0.1:0"))
+}
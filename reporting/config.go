@@ -0,0 +1,107 @@
+package reporting
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const CONFIG_VERSION = "v1.0.0"
+
+// Config is the reporting configuration, read from reporting.yml in the
+// configuration directory.  Reports are recorded in the cache directory
+// as configured by File, sent to the plakar.io alerting service if the
+// user is logged in and enabled it, unless Hosted is false, to each of the
+// Webhooks, and mailed through the SMTP relay.
+type Config struct {
+	Version  string                    `yaml:"version"`
+	File     FileConfig                `yaml:"file,omitempty"`
+	Hosted   *bool                     `yaml:"hosted,omitempty"`
+	Webhooks map[string]*WebhookConfig `yaml:"webhooks,omitempty"`
+	SMTP     *SMTPConfig               `yaml:"smtp,omitempty"`
+}
+
+// WebhookConfig describes an endpoint the reports are POSTed to.  The body
+// is the report encoded as JSON, or the result of Template executed on the
+// report.  If Secret is set, the body is signed with HMAC-SHA256 and the
+// signature sent in the X-Plakar-Signature header.
+type WebhookConfig struct {
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Secret   string            `yaml:"secret,omitempty"`
+	Template string            `yaml:"template,omitempty"`
+}
+
+func ConfigPath(configDir string) string {
+	return filepath.Join(configDir, "reporting.yml")
+}
+
+// LoadConfig reads the reporting configuration of configDir, which is
+// empty if there is none.
+func LoadConfig(configDir string) (*Config, error) {
+	cfg := &Config{
+		Version: CONFIG_VERSION,
+	}
+
+	path := ConfigPath(configDir)
+	rd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer rd.Close()
+
+	dec := yaml.NewDecoder(rd)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if cfg.Version != CONFIG_VERSION {
+		return nil, fmt.Errorf("unsupported reporting configuration version %q", cfg.Version)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// HostedEnabled returns whether the reports may be sent to plakar.io.
+func (cfg *Config) HostedEnabled() bool {
+	return cfg.Hosted == nil || *cfg.Hosted
+}
+
+func (cfg *Config) Validate() error {
+	for name, webhook := range cfg.Webhooks {
+		if webhook == nil || webhook.URL == "" {
+			return fmt.Errorf("webhook %s: missing url", name)
+		}
+		u, err := url.Parse(webhook.URL)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %w", name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook %s: unsupported url scheme %q", name, u.Scheme)
+		}
+		if webhook.Template != "" {
+			if _, err := parseTemplate(name, webhook.Template); err != nil {
+				return fmt.Errorf("webhook %s: %w", name, err)
+			}
+		}
+	}
+	if cfg.SMTP != nil {
+		if err := cfg.SMTP.Validate(); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
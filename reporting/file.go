@@ -0,0 +1,270 @@
+package reporting
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// size after which the reports file is rotated
+	DEFAULT_FILE_MAX_SIZE = 10 * 1024 * 1024
+
+	// number of rotated reports files kept
+	DEFAULT_FILE_KEEP = 5
+)
+
+// FileConfig controls the local record of the reports, kept in the cache
+// directory.  The reports file is rotated once larger than MaxSize bytes
+// and Keep rotated files are kept.
+type FileConfig struct {
+	Disabled bool  `yaml:"disabled,omitempty"`
+	MaxSize  int64 `yaml:"max_size,omitempty"`
+	Keep     int   `yaml:"keep,omitempty"`
+}
+
+func ReportsDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "reports")
+}
+
+// fileMutex serialises the writes and rotations of the reporters of the
+// process.
+var fileMutex sync.Mutex
+
+// FileEmitter appends the reports as JSON lines to reports.jsonl.
+type FileEmitter struct {
+	dir     string
+	maxSize int64
+	keep    int
+}
+
+func NewFileEmitter(dir string, cfg FileConfig) *FileEmitter {
+	emitter := &FileEmitter{
+		dir:     dir,
+		maxSize: cfg.MaxSize,
+		keep:    cfg.Keep,
+	}
+	if emitter.maxSize <= 0 {
+		emitter.maxSize = DEFAULT_FILE_MAX_SIZE
+	}
+	if emitter.keep <= 0 {
+		emitter.keep = DEFAULT_FILE_KEEP
+	}
+	return emitter
+}
+
+func reportsFile(dir string, n int) string {
+	path := filepath.Join(dir, "reports.jsonl")
+	if n > 0 {
+		path = fmt.Sprintf("%s.%d", path, n)
+	}
+	return path
+}
+
+func (emitter *FileEmitter) rotate() error {
+	info, err := os.Stat(reportsFile(emitter.dir, 0))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() < emitter.maxSize {
+		return nil
+	}
+
+	os.Remove(reportsFile(emitter.dir, emitter.keep))
+	for n := emitter.keep - 1; n >= 0; n-- {
+		err := os.Rename(reportsFile(emitter.dir, n), reportsFile(emitter.dir, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (emitter *FileEmitter) Emit(ctx context.Context, report *Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %s", err)
+	}
+	data = append(data, '\n')
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if err := os.MkdirAll(emitter.dir, 0700); err != nil {
+		return err
+	}
+	if err := emitter.rotate(); err != nil {
+		return fmt.Errorf("failed to rotate reports: %w", err)
+	}
+
+	fp, err := os.OpenFile(reportsFile(emitter.dir, 0), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// a single write so that the lines of concurrent processes don't
+	// interleave
+	_, err = fp.Write(data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReportID identifies a recorded report by the digest of its record.
+func ReportID(record []byte) string {
+	sum := sha256.Sum256(record)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ReadReports calls fn on each report recorded in dir, from the oldest to
+// the most recent one, along with its identifier.  Records that can't be
+// decoded, such as a line truncated by a crash, are skipped.
+func ReadReports(dir string, fn func(id string, report *Report) error) error {
+	var files []string
+	for n := 0; ; n++ {
+		path := reportsFile(dir, n)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+		files = append(files, path)
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := readReportsFile(files[i], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readReportsFile(path string, fn func(id string, report *Report) error) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var report Report
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			continue
+		}
+		if err := fn(ReportID(scanner.Bytes()), &report); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Follower reads the reports recorded in a directory as they are
+// appended, possibly by other processes.
+type Follower struct {
+	dir    string
+	info   os.FileInfo
+	offset int64
+}
+
+func NewFollower(dir string) *Follower {
+	return &Follower{dir: dir}
+}
+
+// Next calls fn on each report recorded since the previous call, or on all
+// the recorded reports on the first one.
+func (follower *Follower) Next(fn func(id string, report *Report) error) error {
+	if follower.info == nil {
+		var files []string
+		for n := 1; ; n++ {
+			path := reportsFile(follower.dir, n)
+			if _, err := os.Stat(path); err != nil {
+				break
+			}
+			files = append(files, path)
+		}
+		for i := len(files) - 1; i >= 0; i-- {
+			if _, err := readReportsFrom(files[i], 0, fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	path := reportsFile(follower.dir, 0)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if follower.info != nil && !os.SameFile(follower.info, info) {
+		// rotated: finish the previous file first
+		rotated := reportsFile(follower.dir, 1)
+		if prev, err := os.Stat(rotated); err == nil && os.SameFile(follower.info, prev) {
+			if _, err := readReportsFrom(rotated, follower.offset, fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		follower.offset = 0
+	} else if info.Size() < follower.offset {
+		follower.offset = 0
+	}
+
+	offset, err := readReportsFrom(path, follower.offset, fn)
+	if err != nil {
+		return err
+	}
+	follower.info = info
+	follower.offset = offset
+	return nil
+}
+
+// readReportsFrom calls fn on each report recorded in path after offset
+// and returns the offset following the last complete record.
+func readReportsFrom(path string, offset int64, fn func(id string, report *Report) error) (int64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return offset, err
+	}
+	defer fp.Close()
+
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	rd := bufio.NewReader(fp)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			// a partial line is being written, read it next time
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		line = line[:len(line)-1]
+		var report Report
+		if err := json.Unmarshal(line, &report); err != nil {
+			continue
+		}
+		if err := fn(ReportID(line), &report); err != nil {
+			return offset, err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileEmitter(t *testing.T) {
+	dir := t.TempDir()
+	emitter := NewFileEmitter(dir, FileConfig{MaxSize: 512, Keep: 2})
+
+	for i := range 20 {
+		report := &Report{
+			Timestamp: time.Now(),
+			Task: &ReportTask{
+				Type:   "backup",
+				Name:   fmt.Sprintf("task-%d", i),
+				Status: StatusOK,
+			},
+		}
+		require.NoError(t, emitter.Emit(context.Background(), report))
+	}
+
+	_, err := os.Stat(reportsFile(dir, 2))
+	require.NoError(t, err)
+	_, err = os.Stat(reportsFile(dir, 3))
+	require.True(t, os.IsNotExist(err))
+
+	// a truncated record is skipped
+	fp, err := os.OpenFile(reportsFile(dir, 0), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = fp.WriteString(`{"timestamp": "20`)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	var names []string
+	ids := make(map[string]bool)
+	err = ReadReports(dir, func(id string, report *Report) error {
+		names = append(names, report.Task.Name)
+		ids[id] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Less(t, len(names), 20)
+	require.Len(t, ids, len(names))
+	// the oldest reports were rotated away, the others are in order
+	require.Equal(t, "task-19", names[len(names)-1])
+	for i := 1; i < len(names); i++ {
+		var prev, cur int
+		fmt.Sscanf(names[i-1], "task-%d", &prev)
+		fmt.Sscanf(names[i], "task-%d", &cur)
+		require.Equal(t, prev+1, cur)
+	}
+
+	require.NoError(t, ReadReports(t.TempDir(), func(string, *Report) error {
+		t.Fatal("no report expected")
+		return nil
+	}))
+}
+
+func TestFollower(t *testing.T) {
+	dir := t.TempDir()
+	emitter := NewFileEmitter(dir, FileConfig{MaxSize: 512, Keep: 5})
+
+	n := 0
+	emit := func(count int) {
+		for range count {
+			report := &Report{
+				Timestamp: time.Now(),
+				Task:      &ReportTask{Type: "backup", Name: fmt.Sprintf("task-%d", n)},
+			}
+			require.NoError(t, emitter.Emit(context.Background(), report))
+			n++
+		}
+	}
+
+	var names []string
+	follower := NewFollower(dir)
+	next := func() {
+		require.NoError(t, follower.Next(func(id string, report *Report) error {
+			names = append(names, report.Task.Name)
+			return nil
+		}))
+	}
+
+	// nothing recorded yet
+	next()
+	require.Empty(t, names)
+
+	// the whole history first, then the new reports, across rotations
+	emit(10)
+	next()
+	require.Len(t, names, 10)
+	for _, count := range []int{1, 3, 0, 2} {
+		emit(count)
+		next()
+	}
+
+	// a partial record is read once complete
+	fp, err := os.OpenFile(reportsFile(dir, 0), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = fp.WriteString(`{"report_task": {"type": "backup", `)
+	require.NoError(t, err)
+	next()
+	_, err = fp.WriteString(`"name": "partial"}}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	next()
+
+	require.Len(t, names, n+1)
+	for i := range n {
+		require.Equal(t, fmt.Sprintf("task-%d", i), names[i])
+	}
+	require.Equal(t, "partial", names[n])
+}
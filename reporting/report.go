@@ -1,9 +1,12 @@
 package reporting
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/kloset/repository"
 	"github.com/PlakarKorp/kloset/snapshot/header"
 	"github.com/PlakarKorp/kloset/storage"
@@ -20,11 +23,46 @@ const (
 
 type ReportSnapshot struct {
 	header.Header
+	Stats *ReportSnapshotStats `json:"stats,omitempty"`
+}
+
+// ReportSnapshotStats details the work done by a backup.  BytesRead is the
+// size of the data backed up and BytesWritten what was actually written to
+// the repository after deduplication and compression.
+type ReportSnapshotStats struct {
+	Files        uint64               `json:"files"`
+	Directories  uint64               `json:"directories"`
+	BytesRead    uint64               `json:"bytes_read"`
+	BytesWritten int64                `json:"bytes_written"`
+	Errors       uint64               `json:"errors"`
+	ErrorPaths   []ReportPathError    `json:"error_paths,omitempty"`
+	Delta        *ReportSnapshotDelta `json:"delta,omitempty"`
+}
+
+type ReportPathError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// ReportSnapshotDelta is the difference with the previous snapshot of the
+// same job.
+type ReportSnapshotDelta struct {
+	Previous    objects.MAC `json:"previous"`
+	Files       int64       `json:"files"`
+	Directories int64       `json:"directories"`
+	Bytes       int64       `json:"bytes"`
 }
 
 type ReportRepository struct {
-	Name    string                `json:"name"`
-	Storage storage.Configuration `json:"storage"`
+	Name    string                 `json:"name"`
+	Storage storage.Configuration  `json:"storage"`
+	Stats   *ReportRepositoryStats `json:"stats,omitempty"`
+}
+
+// ReportRepositoryStats describes the repository at the end of the task.
+type ReportRepositoryStats struct {
+	Size      int64 `json:"size"`
+	Snapshots int   `json:"snapshots"`
 }
 
 type ReportTask struct {
@@ -35,6 +73,13 @@ type ReportTask struct {
 	Status       TaskStatus    `json:"status"`
 	ErrorCode    TaskErrorCode `json:"error_code"`
 	ErrorMessage string        `json:"error_message"`
+	Attempt      int           `json:"attempt,omitempty"`
+	Phases       []ReportPhase `json:"phases,omitempty"`
+}
+
+type ReportPhase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
 }
 
 type Report struct {
@@ -45,6 +90,31 @@ type Report struct {
 
 	repo     *repository.Repository `json:"-"`
 	logger   *logging.Logger        `json:"-"`
-	reporter chan *Report           `json:"-"`
+	reporter *Reporter              `json:"-"`
 	ignore   bool                   `json:"-"`
 }
+
+// Summary describes the outcome of the task of the report on one line.
+func (report *Report) Summary() string {
+	task := report.Task
+	if task == nil {
+		return "no task"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(task.Type)
+	if task.Name != "" {
+		fmt.Fprintf(&sb, " %s", task.Name)
+	}
+	if report.Repository != nil && report.Repository.Name != "" {
+		fmt.Fprintf(&sb, " on %s", report.Repository.Name)
+	}
+	fmt.Fprintf(&sb, ": %s (%s)", task.Status, task.Duration.Round(time.Second))
+	if task.Attempt > 1 {
+		fmt.Fprintf(&sb, " attempt %d", task.Attempt)
+	}
+	if task.ErrorMessage != "" {
+		fmt.Fprintf(&sb, ": %s", task.ErrorMessage)
+	}
+	return sb.String()
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/PlakarKorp/kloset/objects"
@@ -20,98 +20,338 @@ type Emitter interface {
 	Emit(ctx context.Context, report *Report) error
 }
 
+// flusher is implemented by the emitters holding reports back, such as
+// the SMTP digest, which are sent on their own schedule.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Reporter hands the published reports over to a spool in the cache
+// directory, from which they are delivered to the configured emitters in
+// the background, so that a slow or unreachable emitter never holds back
+// a task.  The long-lived processes deliver the spool as it fills, the
+// other ones before they exit.
 type Reporter struct {
 	ctx             *appcontext.AppContext
-	reportCount     atomic.Int32
-	reports         chan *Report
 	stop            chan any
-	done            chan any
-	emitter         Emitter
+	retrying        chan any
+	spool           *Spool
+	pending         sync.WaitGroup
+	emittersMtx     sync.Mutex
+	emitters        []namedEmitter
 	emitter_timeout time.Time
+
+	// emitters failing to receive reports are left alone for a while
+	backoffMtx sync.Mutex
+	backoff    map[string]*emitterBackoff
+}
+
+// namedEmitter identifies an emitter in the spool.
+type namedEmitter struct {
+	name string
+	Emitter
+}
+
+type emitterBackoff struct {
+	failures int
+	until    time.Time
 }
 
+// the retry loops of the process by spool directory, woken up as soon as
+// a report is spooled
+var (
+	retryLoopsMtx sync.Mutex
+	retryLoops    = make(map[string]chan struct{})
+)
+
 func NewReporter(ctx *appcontext.AppContext) *Reporter {
 	r := &Reporter{
 		ctx:     ctx,
-		reports: make(chan *Report, 100),
 		stop:    make(chan any),
-		done:    make(chan any),
+		backoff: make(map[string]*emitterBackoff),
+	}
+	if ctx.CacheDir != "" {
+		r.spool = NewSpool(SpoolDir(ctx.CacheDir))
+	}
+	return r
+}
+
+// enqueue spools the report for all the emitters.  Without a cache
+// directory to spool it to, the report is delivered once in the
+// background.
+func (reporter *Reporter) enqueue(report *Report) {
+	if report.ignore {
+		return
+	}
+
+	if reporter.spool == nil {
+		reporter.pending.Add(1)
+		go func() {
+			defer reporter.pending.Done()
+			for _, emitter := range reporter.getEmitters() {
+				if err := emitter.Emit(reporter.ctx, report); err != nil {
+					reporter.ctx.GetLogger().Warn("failed to emit report to %s: %s", emitter.name, err)
+				}
+			}
+		}()
+		return
 	}
 
+	if err := reporter.spool.Add("", report, 0); err != nil {
+		reporter.ctx.GetLogger().Error("failed to spool report: %s", err)
+		return
+	}
+
+	retryLoopsMtx.Lock()
+	wake, ok := retryLoops[reporter.spool.dir]
+	retryLoopsMtx.Unlock()
+	if ok {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver sends the reports of the spool that are due, and the reports
+// the emitters hold back once they are due too.
+func (reporter *Reporter) deliver(ctx context.Context) {
+	if err := reporter.spool.Retry(ctx, reporter.retry(ctx)); err != nil {
+		reporter.ctx.GetLogger().Warn("failed to deliver spooled reports: %s", err)
+	}
+
+	for _, emitter := range reporter.getEmitters() {
+		f, ok := emitter.Emitter.(flusher)
+		if !ok || reporter.backingOff(emitter.name) {
+			continue
+		}
+		err := f.Flush(ctx)
+		reporter.emitted(emitter.name, err)
+		if err != nil {
+			reporter.ctx.GetLogger().Warn("failed to flush reports of %s: %s", emitter.name, err)
+		}
+	}
+}
+
+// RetrySpooled delivers in the background the reports of the spool, as
+// they are published and retrying those that failed to be delivered,
+// until the reporter is stopped.  It is meant for long-lived processes,
+// such as the agent and the scheduler.
+func (reporter *Reporter) RetrySpooled() {
+	if reporter.spool == nil || reporter.retrying != nil {
+		return
+	}
+	reporter.retrying = make(chan any)
+
+	wake := make(chan struct{}, 1)
+	retryLoopsMtx.Lock()
+	retryLoops[reporter.spool.dir] = wake
+	retryLoopsMtx.Unlock()
+
+	ctx, cancel := context.WithCancel(reporter.ctx)
 	go func() {
-		var rp *Report
+		select {
+		case <-reporter.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	go func() {
+		defer close(reporter.retrying)
+		defer func() {
+			retryLoopsMtx.Lock()
+			if retryLoops[reporter.spool.dir] == wake {
+				delete(retryLoops, reporter.spool.dir)
+			}
+			retryLoopsMtx.Unlock()
+		}()
+
+		ticker := time.NewTicker(SPOOL_RETRY_INTERVAL)
+		defer ticker.Stop()
 		for {
+			reporter.deliver(ctx)
 			select {
 			case <-ctx.Done():
-				goto done
-			case <-r.stop:
-				goto done
-			case rp = <-r.reports:
-				r.Process(rp)
-				r.reportCount.Add(-1)
+				return
+			case <-ticker.C:
+			case <-wake:
 			}
 		}
-	done:
-		// drain remaining reports
-		for r.reportCount.Load() != 0 {
-			rp = <-r.reports
-			r.Process(rp)
-			r.reportCount.Add(-1)
-		}
-		close(r.reports)
-		close(r.done)
 	}()
+}
 
-	return r
+func (reporter *Reporter) backingOff(name string) bool {
+	reporter.backoffMtx.Lock()
+	defer reporter.backoffMtx.Unlock()
+	b, ok := reporter.backoff[name]
+	return ok && time.Now().Before(b.until)
 }
 
-func (reporter *Reporter) Process(report *Report) {
-	if report.ignore {
+// emitted records the outcome of a delivery to an emitter: each failure
+// in a row doubles the time it is left alone for.
+func (reporter *Reporter) emitted(name string, err error) {
+	reporter.backoffMtx.Lock()
+	defer reporter.backoffMtx.Unlock()
+	if err == nil {
+		delete(reporter.backoff, name)
 		return
 	}
+	b, ok := reporter.backoff[name]
+	if !ok {
+		b = &emitterBackoff{}
+		reporter.backoff[name] = b
+	}
+	b.failures++
+	b.until = time.Now().Add(spoolBackoff(b.failures))
+}
+
+func (reporter *Reporter) retry(ctx context.Context) func(*SpoolEntry) error {
+	return func(entry *SpoolEntry) error {
+		if entry.Emitter == "" {
+			return reporter.fanOut(ctx, entry.Report)
+		}
 
-	attempts := 3
-	backoffUnit := time.Minute
-	for i := range attempts {
-		err := reporter.getEmitter().Emit(reporter.ctx, report)
+		var emitter Emitter
+		for _, e := range reporter.getEmitters() {
+			if e.name == entry.Emitter {
+				emitter = e.Emitter
+				break
+			}
+		}
+		if emitter == nil {
+			reporter.ctx.GetLogger().Warn("dropping report for %s, which is no longer configured", entry.Emitter)
+			return nil
+		}
+		if reporter.backingOff(entry.Emitter) {
+			return errSpoolSkip
+		}
+
+		err := emitter.Emit(ctx, entry.Report)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reporter.emitted(entry.Emitter, err)
 		if err == nil {
-			return
+			return nil
+		}
+		if time.Since(entry.Report.Timestamp) >= SPOOL_EXPIRY {
+			reporter.ctx.GetLogger().Error("failed to emit report to %s after %d attempts, dropping it: %s",
+				entry.Emitter, entry.Attempts+1, err)
+			return nil
+		}
+		reporter.ctx.GetLogger().Warn("failed to emit report to %s: %s", entry.Emitter, err)
+		return err
+	}
+}
+
+// fanOut delivers a newly published report to each emitter, and spools it
+// again for those that failed or are left alone for now.
+func (reporter *Reporter) fanOut(ctx context.Context, report *Report) error {
+	for _, emitter := range reporter.getEmitters() {
+		attempts := 0
+		if ctx.Err() == nil && !reporter.backingOff(emitter.name) {
+			err := emitter.Emit(ctx, report)
+			if err == nil {
+				reporter.emitted(emitter.name, nil)
+				continue
+			}
+			if ctx.Err() == nil {
+				reporter.emitted(emitter.name, err)
+				reporter.ctx.GetLogger().Warn("failed to emit report to %s: %s", emitter.name, err)
+				attempts = 1
+			}
+		}
+		if err := reporter.spool.Add(emitter.name, report, attempts); err != nil {
+			reporter.ctx.GetLogger().Error("failed to spool report: %s", err)
 		}
-		reporter.ctx.GetLogger().Warn("failed to emit report: %s", err)
-		time.Sleep(backoffUnit << i)
 	}
-	reporter.ctx.GetLogger().Error("failed to emit report after %d attempts", attempts)
+	return nil
 }
 
+// StopAndWait stops the reporter.  Unless a retry loop of the process
+// delivers the spool, the reports due are delivered first.
 func (reporter *Reporter) StopAndWait() {
 	close(reporter.stop)
-	<-reporter.done
+	if reporter.retrying != nil {
+		<-reporter.retrying
+		return
+	}
+	reporter.pending.Wait()
+
+	if reporter.spool != nil {
+		retryLoopsMtx.Lock()
+		_, ok := retryLoops[reporter.spool.dir]
+		retryLoopsMtx.Unlock()
+		if !ok {
+			reporter.deliver(reporter.ctx)
+		}
+	}
 }
 
-func (reporter *Reporter) getEmitter() Emitter {
-	// Check if emitter should be reloaded
-	if reporter.emitter != nil && reporter.emitter_timeout.After(time.Now()) {
-		return reporter.emitter
+func (reporter *Reporter) getEmitters() []namedEmitter {
+	reporter.emittersMtx.Lock()
+	defer reporter.emittersMtx.Unlock()
+
+	// Check if emitters should be reloaded
+	if reporter.emitters != nil && reporter.emitter_timeout.After(time.Now()) {
+		return reporter.emitters
 	}
 
 	// By default do nothing
-	reporter.emitter = &NullEmitter{}
+	reporter.emitters = []namedEmitter{}
 	reporter.emitter_timeout = time.Now().Add(time.Minute)
 
+	cfg, err := LoadConfig(reporter.ctx.ConfigDir)
+	if err != nil {
+		reporter.ctx.GetLogger().Warn("failed to load reporting configuration: %v", err)
+		cfg = &Config{}
+	}
+
+	if !cfg.File.Disabled && reporter.ctx.CacheDir != "" {
+		reporter.emitters = append(reporter.emitters, namedEmitter{"file",
+			NewFileEmitter(ReportsDir(reporter.ctx.CacheDir), cfg.File)})
+	}
+
+	for name, webhook := range cfg.Webhooks {
+		emitter, err := NewWebhookEmitter(name, webhook)
+		if err != nil {
+			reporter.ctx.GetLogger().Warn("%v", err)
+			continue
+		}
+		reporter.emitters = append(reporter.emitters, namedEmitter{"webhook:" + name, emitter})
+	}
+
+	if cfg.SMTP != nil && reporter.ctx.CacheDir != "" {
+		reporter.emitters = append(reporter.emitters, namedEmitter{"smtp",
+			NewSMTPEmitter(cfg.SMTP, reporter.ctx.CacheDir)})
+	}
+
+	if emitter := reporter.getHostedEmitter(cfg); emitter != nil {
+		reporter.emitters = append(reporter.emitters, namedEmitter{"hosted", emitter})
+	}
+	return reporter.emitters
+}
+
+func (reporter *Reporter) getHostedEmitter(cfg *Config) Emitter {
+	if !cfg.HostedEnabled() {
+		return nil
+	}
+
 	// Check if user is logged
 	token, _ := reporter.ctx.GetCookies().GetAuthToken()
 	if token == "" {
-		return reporter.emitter
+		return nil
 	}
 
 	sc := services.NewServiceConnector(reporter.ctx, token)
 	enabled, err := sc.GetServiceStatus("alerting")
 	if err != nil {
 		reporter.ctx.GetLogger().Warn("failed to check alerting service: %v", err)
-		return reporter.emitter
+		return nil
 	}
 	if !enabled {
-		return reporter.emitter
+		return nil
 	}
 
 	// User is logged and alerting service is enabled
@@ -120,18 +360,16 @@ func (reporter *Reporter) getEmitter() Emitter {
 		url = PLAKAR_API_URL
 	}
 
-	reporter.emitter = &HttpEmitter{
+	return &HttpEmitter{
 		url:   url,
 		token: token,
 	}
-	return reporter.emitter
 }
 
 func (reporter *Reporter) NewReport() *Report {
-	reporter.reportCount.Add(1)
 	return &Report{
 		logger:   reporter.ctx.GetLogger(),
-		reporter: reporter.reports,
+		reporter: reporter,
 	}
 }
 
@@ -150,6 +388,13 @@ func (report *Report) TaskStart(kind string, name string) {
 	}
 }
 
+// WithAttempt records that the task is a retry of a failed run.
+func (report *Report) WithAttempt(attempt int) {
+	if attempt > 1 {
+		report.Task.Attempt = attempt
+	}
+}
+
 func (report *Report) WithRepositoryName(name string) {
 	if report.Repository != nil {
 		report.logger.Warn("already has a repository")
@@ -182,6 +427,34 @@ func (report *Report) WithSnapshot(snapshot *snapshot.Snapshot) {
 	report.Snapshot = &ReportSnapshot{
 		Header: *snapshot.Header,
 	}
+	if report.repo != nil {
+		var cacheDir string
+		if report.reporter != nil {
+			cacheDir = report.reporter.ctx.CacheDir
+		}
+		report.Snapshot.Stats = snapshotStats(report.repo, snapshot, cacheDir, report.logger)
+	}
+}
+
+// WithPhases records how long each phase of the task took.
+func (report *Report) WithPhases(phases []ReportPhase) {
+	report.Task.Phases = phases
+}
+
+func (report *Report) withRepositoryStats() {
+	size, err := report.repo.StorageSize()
+	if err != nil {
+		report.logger.Warn("failed to get repository size: %s", err)
+		return
+	}
+	snapshots := 0
+	for range report.repo.ListSnapshots() {
+		snapshots++
+	}
+	report.Repository.Stats = &ReportRepositoryStats{
+		Size:      size,
+		Snapshots: snapshots,
+	}
 }
 
 func (report *Report) TaskDone() {
@@ -205,10 +478,14 @@ func (report *Report) taskEnd(status TaskStatus, errorCode TaskErrorCode, errorM
 		report.Task.ErrorMessage = fmt.Sprintf(errorMessage, args...)
 	}
 	report.Task.Duration = time.Since(report.Task.StartTime)
+	if report.repo != nil {
+		report.withRepositoryStats()
+	}
 	report.Publish()
 }
 
+// Publish hands the report over for delivery in the background.
 func (report *Report) Publish() {
 	report.Timestamp = time.Now()
-	report.reporter <- report
+	report.reporter.enqueue(report)
 }
@@ -0,0 +1,427 @@
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTP_TIMEOUT = 30 * time.Second
+
+	// period covered by a digest of the successful runs
+	SMTP_DIGEST_PERIOD = 24 * time.Hour
+)
+
+// SMTPConfig describes the relay the reports of failed runs and runs with
+// warnings are mailed through, by default to To.  A report is instead
+// mailed to the recipients of the Routes matching its repository or task.
+// With Digest, the reports of successful runs are batched into a daily
+// summary.
+type SMTPConfig struct {
+	Host     string      `yaml:"host"`
+	Port     int         `yaml:"port,omitempty"`
+	TLS      string      `yaml:"tls,omitempty"`
+	Username string      `yaml:"username,omitempty"`
+	Password string      `yaml:"password,omitempty"`
+	From     string      `yaml:"from"`
+	To       []string    `yaml:"to,omitempty"`
+	Routes   []SMTPRoute `yaml:"routes,omitempty"`
+	Digest   bool        `yaml:"digest,omitempty"`
+}
+
+// SMTPRoute matches the reports of a repository, of a task, or of a task
+// on a repository.
+type SMTPRoute struct {
+	Repository string   `yaml:"repository,omitempty"`
+	Task       string   `yaml:"task,omitempty"`
+	To         []string `yaml:"to"`
+}
+
+func (route *SMTPRoute) match(report *Report) bool {
+	if route.Repository != "" && (report.Repository == nil || report.Repository.Name != route.Repository) {
+		return false
+	}
+	if route.Task != "" && (report.Task == nil || report.Task.Name != route.Task) {
+		return false
+	}
+	return true
+}
+
+func validAddresses(addresses []string) error {
+	for _, address := range addresses {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid address %q: %w", address, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *SMTPConfig) Validate() error {
+	if cfg.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	switch cfg.TLS {
+	case "", "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("invalid tls mode %q, expected starttls, tls or none", cfg.TLS)
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	if cfg.From == "" {
+		return fmt.Errorf("missing from")
+	}
+	if err := validAddresses([]string{cfg.From}); err != nil {
+		return err
+	}
+	if err := validAddresses(cfg.To); err != nil {
+		return err
+	}
+	if len(cfg.To) == 0 && len(cfg.Routes) == 0 {
+		return fmt.Errorf("no recipient")
+	}
+	for i, route := range cfg.Routes {
+		if route.Repository == "" && route.Task == "" {
+			return fmt.Errorf("route %d: missing repository or task", i)
+		}
+		if len(route.To) == 0 {
+			return fmt.Errorf("route %d: no recipient", i)
+		}
+		if err := validAddresses(route.To); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+type SMTPEmitter struct {
+	cfg        SMTPConfig
+	digestPath string
+	now        func() time.Time
+}
+
+func NewSMTPEmitter(cfg *SMTPConfig, cacheDir string) *SMTPEmitter {
+	return &SMTPEmitter{
+		cfg:        *cfg,
+		digestPath: filepath.Join(ReportsDir(cacheDir), "smtp-digest.jsonl"),
+		now:        time.Now,
+	}
+}
+
+// recipients returns who the report is mailed to.
+func (emitter *SMTPEmitter) recipients(report *Report) []string {
+	var to []string
+	for _, route := range emitter.cfg.Routes {
+		if route.match(report) {
+			for _, address := range route.To {
+				if !slices.Contains(to, address) {
+					to = append(to, address)
+				}
+			}
+		}
+	}
+	if len(to) == 0 {
+		to = emitter.cfg.To
+	}
+	return to
+}
+
+// Emit mails the report of a failed run or a run with warnings right away,
+// and holds the report of a successful run for the digest.
+func (emitter *SMTPEmitter) Emit(ctx context.Context, report *Report) error {
+	if report.Task == nil {
+		return nil
+	}
+
+	switch report.Task.Status {
+	case StatusFailed, StatusWarning:
+		to := emitter.recipients(report)
+		if len(to) == 0 {
+			return nil
+		}
+		subject := fmt.Sprintf("[plakar] %s", report.Summary())
+		if err := emitter.send(to, subject, reportBody(report)); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+	case StatusOK:
+		if emitter.cfg.Digest {
+			if err := emitter.appendDigest(report); err != nil {
+				return fmt.Errorf("smtp: failed to record report in digest: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func reportBody(report *Report) string {
+	var sb strings.Builder
+	task := report.Task
+	fmt.Fprintf(&sb, "Task: %s\n", task.Type)
+	if task.Name != "" {
+		fmt.Fprintf(&sb, "Name: %s\n", task.Name)
+	}
+	if report.Repository != nil {
+		fmt.Fprintf(&sb, "Repository: %s\n", report.Repository.Name)
+	}
+	fmt.Fprintf(&sb, "Start: %s\n", task.StartTime.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Duration: %s\n", task.Duration.Round(time.Second))
+	fmt.Fprintf(&sb, "Status: %s\n", task.Status)
+	if task.Attempt > 1 {
+		fmt.Fprintf(&sb, "Attempt: %d\n", task.Attempt)
+	}
+	if task.ErrorMessage != "" {
+		fmt.Fprintf(&sb, "Error: %s\n", task.ErrorMessage)
+	}
+	if report.Snapshot != nil {
+		fmt.Fprintf(&sb, "Snapshot: %x\n", report.Snapshot.Identifier)
+	}
+	return sb.String()
+}
+
+func (emitter *SMTPEmitter) appendDigest(report *Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(emitter.digestPath), 0700); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(emitter.digestPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeDigest replaces the reports pending for the digest.
+func (emitter *SMTPEmitter) writeDigest(reports []*Report) error {
+	if len(reports) == 0 {
+		return os.Remove(emitter.digestPath)
+	}
+
+	var buf bytes.Buffer
+	for _, report := range reports {
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	// written aside first so that the digest is never truncated
+	tmp, err := os.CreateTemp(filepath.Dir(emitter.digestPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), emitter.digestPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Flush sends the digest once due.  It is called periodically by the
+// reporter, whether runs are reported in the meantime or not.
+func (emitter *SMTPEmitter) Flush(ctx context.Context) error {
+	if !emitter.cfg.Digest {
+		return nil
+	}
+	if err := emitter.flushDigest(); err != nil {
+		return fmt.Errorf("smtp: failed to send digest: %w", err)
+	}
+	return nil
+}
+
+// flushDigest mails the summary of the successful runs once the oldest
+// one is older than the digest period.  The reports are removed from the
+// digest as the summaries including them are delivered, so that a failure
+// to reach some recipients doesn't mail the others twice.
+func (emitter *SMTPEmitter) flushDigest() error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	var reports []*Report
+	err := readReportsFile(emitter.digestPath, func(id string, report *Report) error {
+		reports = append(reports, report)
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(reports) == 0 {
+		return os.Remove(emitter.digestPath)
+	}
+
+	since := reports[0].Timestamp
+	if emitter.now().Sub(since) < SMTP_DIGEST_PERIOD {
+		return nil
+	}
+
+	// one digest for each set of recipients
+	var groups [][]string
+	pending := make(map[string][]*Report)
+	for _, report := range reports {
+		to := emitter.recipients(report)
+		if len(to) == 0 {
+			continue
+		}
+		key := strings.Join(to, ",")
+		if _, ok := pending[key]; !ok {
+			groups = append(groups, to)
+		}
+		pending[key] = append(pending[key], report)
+	}
+
+	var errs []error
+	for _, to := range groups {
+		key := strings.Join(to, ",")
+		var body strings.Builder
+		for _, report := range pending[key] {
+			fmt.Fprintf(&body, "%s %s\n", report.Timestamp.Format(time.RFC3339), report.Summary())
+		}
+		subject := fmt.Sprintf("[plakar] %d successful runs since %s", len(pending[key]), since.Format(time.RFC1123Z))
+		if err := emitter.send(to, subject, body.String()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		delete(pending, key)
+	}
+
+	var remaining []*Report
+	for _, report := range reports {
+		if _, ok := pending[strings.Join(emitter.recipients(report), ",")]; ok {
+			remaining = append(remaining, report)
+		}
+	}
+	if err := emitter.writeDigest(remaining); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (emitter *SMTPEmitter) message(to []string, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", emitter.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", emitter.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+func (emitter *SMTPEmitter) send(to []string, subject, body string) error {
+	cfg := &emitter.cfg
+	port := cfg.Port
+	if port == 0 {
+		switch cfg.TLS {
+		case "tls":
+			port = 465
+		case "none":
+			port = 25
+		default:
+			port = 587
+		}
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	dialer := &net.Dialer{Timeout: SMTP_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.TLS == "" || cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(cfg.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, address := range to {
+		rcpt, err := mail.ParseAddress(address)
+		if err != nil {
+			return err
+		}
+		if err := c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(emitter.message(to, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,269 @@
+package reporting
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer is a minimal SMTP server accepting any mail, but those to
+// bounce@ addresses.
+func smtpServer(t *testing.T) (int, chan smtpMail) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	mails := make(chan smtpMail, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, mails
+}
+
+func serveSMTP(conn net.Conn, mails chan smtpMail) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	var m smtpMail
+	reply("220 localhost ESMTP")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m = smtpMail{from: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to := strings.Trim(line[len("RCPT TO:"):], "<>")
+			if strings.HasPrefix(to, "bounce@") {
+				reply("550 no such user")
+				continue
+			}
+			m.to = append(m.to, to)
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			m.data = data.String()
+			mails <- m
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPEmitter(t *testing.T) {
+	port, mails := smtpServer(t)
+	cacheDir := t.TempDir()
+
+	cfg := &SMTPConfig{
+		Host: "127.0.0.1",
+		Port: port,
+		TLS:  "none",
+		From: "plakar <plakar@example.com>",
+		To:   []string{"ops@example.com"},
+		Routes: []SMTPRoute{
+			{Repository: "prod", To: []string{"prod@example.com"}},
+			{Task: "db", To: []string{"dba@example.com", "prod@example.com"}},
+		},
+		Digest: true,
+	}
+	require.NoError(t, cfg.Validate())
+
+	emitter := NewSMTPEmitter(cfg, cacheDir)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	emitter.now = func() time.Time { return now }
+
+	newReport := func(name, repo string, status TaskStatus) *Report {
+		report := &Report{
+			Timestamp: now,
+			Task: &ReportTask{
+				Type:         "backup",
+				Name:         name,
+				Status:       status,
+				ErrorMessage: "something went wrong",
+			},
+		}
+		if repo != "" {
+			report.Repository = &ReportRepository{Name: repo}
+		}
+		return report
+	}
+
+	ctx := context.Background()
+
+	// failures are mailed right away, to the default recipients...
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "", StatusFailed)))
+	m := <-mails
+	require.Equal(t, "plakar@example.com", m.from)
+	require.Equal(t, []string{"ops@example.com"}, m.to)
+	require.Contains(t, m.data, "Subject: [plakar] backup home: FAILURE")
+	require.Contains(t, m.data, "Error: something went wrong")
+
+	// ... or to those of the matching routes
+	require.NoError(t, emitter.Emit(ctx, newReport("db", "prod", StatusWarning)))
+	m = <-mails
+	require.Equal(t, []string{"prod@example.com", "dba@example.com"}, m.to)
+
+	// successful runs are held for the digest
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "", StatusOK)))
+	require.NoError(t, emitter.Emit(ctx, newReport("web", "prod", StatusOK)))
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "", StatusOK)))
+	select {
+	case m := <-mails:
+		t.Fatalf("unexpected mail to %v", m.to)
+	default:
+	}
+	_, err := os.Stat(filepath.Join(ReportsDir(cacheDir), "smtp-digest.jsonl"))
+	require.NoError(t, err)
+
+	// which is sent once a day, one per set of recipients
+	require.NoError(t, emitter.Flush(ctx))
+	now = now.Add(SMTP_DIGEST_PERIOD)
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "", StatusOK)))
+	select {
+	case m := <-mails:
+		t.Fatalf("unexpected mail to %v", m.to)
+	default:
+	}
+	require.NoError(t, emitter.Flush(ctx))
+
+	m = <-mails
+	require.Equal(t, []string{"ops@example.com"}, m.to)
+	require.Contains(t, m.data, "Subject: [plakar] 3 successful runs since")
+	m = <-mails
+	require.Equal(t, []string{"prod@example.com"}, m.to)
+	require.Contains(t, m.data, "Subject: [plakar] 1 successful runs since")
+	require.Contains(t, m.data, "backup web on prod: OK")
+
+	// and removed once delivered
+	_, err = os.Stat(filepath.Join(ReportsDir(cacheDir), "smtp-digest.jsonl"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSMTPEmitterDigestFailure(t *testing.T) {
+	port, mails := smtpServer(t)
+	cacheDir := t.TempDir()
+
+	cfg := &SMTPConfig{
+		Host:   "127.0.0.1",
+		Port:   port,
+		TLS:    "none",
+		From:   "plakar@example.com",
+		To:     []string{"ops@example.com"},
+		Routes: []SMTPRoute{{Repository: "lab", To: []string{"bounce@example.com"}}},
+		Digest: true,
+	}
+	emitter := NewSMTPEmitter(cfg, cacheDir)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	emitter.now = func() time.Time { return now }
+
+	newReport := func(name, repo string, status TaskStatus) *Report {
+		return &Report{
+			Timestamp:  now,
+			Task:       &ReportTask{Type: "backup", Name: name, Status: status},
+			Repository: &ReportRepository{Name: repo},
+		}
+	}
+	pending := func() int {
+		n := 0
+		err := readReportsFile(filepath.Join(ReportsDir(cacheDir), "smtp-digest.jsonl"), func(id string, report *Report) error {
+			n++
+			return nil
+		})
+		require.NoError(t, err)
+		return n
+	}
+
+	ctx := context.Background()
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "prod", StatusOK)))
+	require.NoError(t, emitter.Emit(ctx, newReport("scratch", "lab", StatusOK)))
+
+	// the part of a digest that was delivered isn't sent again
+	now = now.Add(SMTP_DIGEST_PERIOD)
+	require.Error(t, emitter.Flush(ctx))
+	m := <-mails
+	require.Equal(t, []string{"ops@example.com"}, m.to)
+	require.Contains(t, m.data, "Subject: [plakar] 1 successful runs since")
+	require.Equal(t, 1, pending())
+
+	// and the digest doesn't hold back the failures
+	require.NoError(t, emitter.Emit(ctx, newReport("home", "prod", StatusFailed)))
+	m = <-mails
+	require.Contains(t, m.data, "Subject: [plakar] backup home on prod: FAILURE")
+
+	now = now.Add(SMTP_DIGEST_PERIOD)
+	require.Error(t, emitter.Flush(ctx))
+	select {
+	case m := <-mails:
+		t.Fatalf("unexpected mail to %v", m.to)
+	default:
+	}
+	require.Equal(t, 1, pending())
+}
+
+func TestSMTPConfigValidate(t *testing.T) {
+	valid := SMTPConfig{
+		Host: "smtp.example.com",
+		From: "plakar@example.com",
+		To:   []string{"ops@example.com"},
+	}
+	require.NoError(t, valid.Validate())
+
+	for name, mutate := range map[string]func(cfg *SMTPConfig){
+		"no host":       func(cfg *SMTPConfig) { cfg.Host = "" },
+		"no from":       func(cfg *SMTPConfig) { cfg.From = "" },
+		"bad tls":       func(cfg *SMTPConfig) { cfg.TLS = "ssl" },
+		"bad port":      func(cfg *SMTPConfig) { cfg.Port = 70000 },
+		"bad address":   func(cfg *SMTPConfig) { cfg.To = []string{"not an address"} },
+		"no recipient":  func(cfg *SMTPConfig) { cfg.To = nil },
+		"empty route":   func(cfg *SMTPConfig) { cfg.Routes = []SMTPRoute{{To: []string{"a@example.com"}}} },
+		"no route dest": func(cfg *SMTPConfig) { cfg.Routes = []SMTPRoute{{Task: "db"}} },
+	} {
+		cfg := valid
+		mutate(&cfg)
+		require.Error(t, cfg.Validate(), name)
+	}
+}
@@ -0,0 +1,196 @@
+package reporting
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// delay before the first retry of a report, doubled on each attempt
+	SPOOL_BACKOFF     = time.Minute
+	SPOOL_MAX_BACKOFF = time.Hour
+
+	// age after which an undelivered report is given up on
+	SPOOL_EXPIRY = 24 * time.Hour
+
+	// interval at which the spool is checked for reports to retry
+	SPOOL_RETRY_INTERVAL = 30 * time.Second
+
+	// a claim older than this was left by a process that died while
+	// delivering the report
+	spoolClaimTimeout = 10 * time.Minute
+)
+
+func SpoolDir(cacheDir string) string {
+	return filepath.Join(ReportsDir(cacheDir), "spool")
+}
+
+// SpoolEntry is a report to deliver to an emitter, or to all of them if
+// Emitter is empty, after the given number of failed attempts.
+type SpoolEntry struct {
+	Emitter  string    `json:"emitter"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+	Report   *Report   `json:"report"`
+}
+
+// Spool keeps the undelivered reports on disk, one file per report and
+// emitter, so that they survive restarts.  The spool may be shared by
+// several processes: an entry is claimed by renaming its file before it
+// is retried.
+type Spool struct {
+	dir string
+	now func() time.Time
+}
+
+func NewSpool(dir string) *Spool {
+	return &Spool{
+		dir: dir,
+		now: time.Now,
+	}
+}
+
+// errSpoolSkip leaves an entry as is in the spool.
+var errSpoolSkip = errors.New("skipped")
+
+func spoolBackoff(attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+	backoff := SPOOL_BACKOFF
+	for i := 1; i < attempts && backoff < SPOOL_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	return min(backoff, SPOOL_MAX_BACKOFF)
+}
+
+// Add records report for delivery to emitter, all of them if empty,
+// after the given number of failed attempts.
+func (spool *Spool) Add(emitter string, report *Report, attempts int) error {
+	entry := &SpoolEntry{
+		Emitter:  emitter,
+		Attempts: attempts,
+		NextTry:  spool.now().Add(spoolBackoff(attempts)),
+		Report:   report,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %s", err)
+	}
+
+	if err := os.MkdirAll(spool.dir, 0700); err != nil {
+		return err
+	}
+
+	var rnd [4]byte
+	rand.Read(rnd[:])
+	name := fmt.Sprintf("%d-%s.json", spool.now().UnixNano(), hex.EncodeToString(rnd[:]))
+
+	// written aside first so that a partial entry is never picked up
+	tmp, err := os.CreateTemp(spool.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(spool.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Retry calls fn on each entry due for a retry, oldest first.  The entry
+// is removed if fn succeeds, left as is if fn returns errSpoolSkip, and
+// rescheduled otherwise.  Retry stops early, leaving the remaining entries
+// in place, when ctx is done.
+func (spool *Spool) Retry(ctx context.Context, fn func(entry *SpoolEntry) error) error {
+	dirents, err := os.ReadDir(spool.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var names []string
+	for _, dirent := range dirents {
+		name := dirent.Name()
+		switch {
+		case strings.HasSuffix(name, ".json"):
+			names = append(names, name)
+		case strings.HasSuffix(name, ".claimed"):
+			spool.recover(name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		path := filepath.Join(spool.dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// claimed by another process in the meantime
+			continue
+		}
+		var entry SpoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Report == nil {
+			os.Remove(path)
+			continue
+		}
+		if entry.NextTry.After(spool.now()) {
+			continue
+		}
+
+		claimed := path + ".claimed"
+		if err := os.Rename(path, claimed); err != nil {
+			continue
+		}
+		now := spool.now()
+		os.Chtimes(claimed, now, now)
+
+		if err := fn(&entry); err != nil {
+			if errors.Is(err, errSpoolSkip) {
+				os.Rename(claimed, path)
+				continue
+			}
+			if ctx.Err() != nil {
+				// interrupted rather than failed, try again later
+				os.Rename(claimed, path)
+				return nil
+			}
+			if err := spool.Add(entry.Emitter, entry.Report, entry.Attempts+1); err != nil {
+				os.Rename(claimed, path)
+				return err
+			}
+		}
+		os.Remove(claimed)
+	}
+	return nil
+}
+
+// recover puts back the entries claimed by a process that is gone.
+func (spool *Spool) recover(name string) {
+	path := filepath.Join(spool.dir, name)
+	info, err := os.Stat(path)
+	if err != nil || spool.now().Sub(info.ModTime()) < spoolClaimTimeout {
+		return
+	}
+	os.Rename(path, strings.TrimSuffix(path, ".claimed"))
+}
@@ -0,0 +1,257 @@
+package reporting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolEntries(t *testing.T, spool *Spool) []*SpoolEntry {
+	paths, err := filepath.Glob(filepath.Join(spool.dir, "*.json"))
+	require.NoError(t, err)
+
+	var entries []*SpoolEntry
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var entry SpoolEntry
+		require.NoError(t, json.Unmarshal(data, &entry))
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+func TestSpoolRetry(t *testing.T) {
+	spool := NewSpool(t.TempDir())
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	spool.now = func() time.Time { return now }
+
+	report := &Report{Timestamp: now, Task: &ReportTask{Type: "backup", Name: "nightly"}}
+	require.NoError(t, spool.Add("webhook:ops", report, 1))
+
+	// not due yet
+	calls := 0
+	retry := func(entry *SpoolEntry) error {
+		calls++
+		require.Equal(t, "webhook:ops", entry.Emitter)
+		require.Equal(t, "nightly", entry.Report.Task.Name)
+		return fmt.Errorf("unreachable")
+	}
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.Equal(t, 0, calls)
+
+	// due, and failing again: rescheduled with a longer backoff
+	now = now.Add(SPOOL_BACKOFF)
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.Equal(t, 1, calls)
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.Equal(t, 1, calls)
+
+	entries := spoolEntries(t, spool)
+	require.Len(t, entries, 1)
+	require.Equal(t, 2, entries[0].Attempts)
+	require.Equal(t, now.Add(2*SPOOL_BACKOFF), entries[0].NextTry.UTC())
+
+	// delivered: removed from the spool
+	now = now.Add(2 * SPOOL_BACKOFF)
+	require.NoError(t, spool.Retry(context.Background(), func(entry *SpoolEntry) error {
+		calls++
+		return nil
+	}))
+	require.Equal(t, 2, calls)
+	require.Empty(t, spoolEntries(t, spool))
+}
+
+func TestSpoolClaims(t *testing.T) {
+	dir := t.TempDir()
+	spool := NewSpool(dir)
+	now := time.Now()
+	spool.now = func() time.Time { return now }
+
+	require.NoError(t, spool.Add("smtp", &Report{Timestamp: now}, 1))
+	now = now.Add(SPOOL_BACKOFF)
+
+	// an entry claimed by another process is left alone...
+	dirents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, dirents, 1)
+	path := filepath.Join(dir, dirents[0].Name())
+	require.NoError(t, os.Rename(path, path+".claimed"))
+	require.NoError(t, os.Chtimes(path+".claimed", now, now))
+
+	calls := 0
+	retry := func(entry *SpoolEntry) error {
+		calls++
+		return nil
+	}
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.Equal(t, 0, calls)
+
+	// ... unless it was abandoned
+	now = now.Add(spoolClaimTimeout)
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.NoError(t, spool.Retry(context.Background(), retry))
+	require.Equal(t, 1, calls)
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	require.Equal(t, SPOOL_BACKOFF, spoolBackoff(1))
+	require.Equal(t, 4*SPOOL_BACKOFF, spoolBackoff(3))
+	require.Equal(t, SPOOL_MAX_BACKOFF, spoolBackoff(100))
+}
+
+func TestReporterSpool(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer server.Close()
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+	ctx.ConfigDir = t.TempDir()
+	config := fmt.Sprintf("version: v1.0.0\nhosted: false\nwebhooks:\n  ops:\n    url: %s\n", server.URL)
+	require.NoError(t, os.WriteFile(ConfigPath(ctx.ConfigDir), []byte(config), 0600))
+
+	// a failed delivery doesn't hold the reporter back
+	reporter := NewReporter(ctx)
+	report := reporter.NewReport()
+	report.TaskStart("backup", "nightly")
+	start := time.Now()
+	report.TaskFailed(0, "boom")
+	reporter.StopAndWait()
+	require.Less(t, time.Since(start), SPOOL_BACKOFF)
+
+	spool := NewSpool(SpoolDir(ctx.CacheDir))
+	entries := spoolEntries(t, spool)
+	require.Len(t, entries, 1)
+	require.Equal(t, "webhook:ops", entries[0].Emitter)
+	require.Equal(t, StatusFailed, entries[0].Report.Task.Status)
+
+	// and it is delivered later on by a reporter retrying the spool
+	fail.Store(false)
+	reporter = NewReporter(ctx)
+	reporter.spool.now = func() time.Time { return time.Now().Add(SPOOL_MAX_BACKOFF) }
+	reporter.RetrySpooled()
+	require.Eventually(t, func() bool { return delivered.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	reporter.StopAndWait()
+	require.Empty(t, spoolEntries(t, spool))
+}
+
+// fakeEmitter counts the reports it receives, failing while fail is set
+// and holding each delivery until hold is closed.
+type fakeEmitter struct {
+	fail     atomic.Bool
+	hold     chan struct{}
+	attempts atomic.Int32
+	flushes  atomic.Int32
+}
+
+func (e *fakeEmitter) Emit(ctx context.Context, report *Report) error {
+	if e.hold != nil {
+		<-e.hold
+	}
+	e.attempts.Add(1)
+	if e.fail.Load() {
+		return fmt.Errorf("unreachable")
+	}
+	return nil
+}
+
+func (e *fakeEmitter) Flush(ctx context.Context) error {
+	e.flushes.Add(1)
+	return nil
+}
+
+func fakeReporter(t *testing.T, ctx *appcontext.AppContext, emitter *fakeEmitter) *Reporter {
+	reporter := NewReporter(ctx)
+	reporter.emitters = []namedEmitter{{"fake", emitter}}
+	reporter.emitter_timeout = time.Now().Add(time.Hour)
+	return reporter
+}
+
+func TestReporterPublish(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+
+	// publishing only spools the report, however slow the emitter
+	emitter := &fakeEmitter{hold: make(chan struct{})}
+	reporter := fakeReporter(t, ctx, emitter)
+	report := reporter.NewReport()
+	report.TaskStart("backup", "nightly")
+	report.TaskDone()
+
+	spool := NewSpool(SpoolDir(ctx.CacheDir))
+	entries := spoolEntries(t, spool)
+	require.Len(t, entries, 1)
+	require.Equal(t, "", entries[0].Emitter)
+	require.Equal(t, int32(0), emitter.attempts.Load())
+
+	// and a one-shot process delivers it before leaving
+	close(emitter.hold)
+	reporter.StopAndWait()
+	require.Equal(t, int32(1), emitter.attempts.Load())
+	require.Equal(t, int32(1), emitter.flushes.Load())
+	require.Empty(t, spoolEntries(t, spool))
+}
+
+func TestReporterBackoff(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+
+	emitter := &fakeEmitter{}
+	emitter.fail.Store(true)
+	reporter := fakeReporter(t, ctx, emitter)
+	for range 3 {
+		report := reporter.NewReport()
+		report.TaskStart("backup", "nightly")
+		report.TaskDone()
+	}
+
+	// a failing emitter is only tried once, the reports are spooled
+	// for later on
+	reporter.StopAndWait()
+	require.Equal(t, int32(1), emitter.attempts.Load())
+	require.Equal(t, int32(0), emitter.flushes.Load())
+	entries := spoolEntries(t, NewSpool(SpoolDir(ctx.CacheDir)))
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		require.Equal(t, "fake", entry.Emitter)
+	}
+
+	// the retry loop delivers them once the emitter is back
+	emitter.fail.Store(false)
+	reporter = fakeReporter(t, ctx, emitter)
+	reporter.spool.now = func() time.Time { return time.Now().Add(SPOOL_MAX_BACKOFF) }
+	reporter.RetrySpooled()
+	require.Eventually(t, func() bool { return emitter.attempts.Load() == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	// and those published in the meantime right away
+	report := reporter.NewReport()
+	report.TaskStart("backup", "nightly")
+	report.TaskDone()
+	require.Eventually(t, func() bool { return emitter.attempts.Load() == 5 }, 5*time.Second, 10*time.Millisecond)
+	reporter.StopAndWait()
+	require.Empty(t, spoolEntries(t, reporter.spool))
+}
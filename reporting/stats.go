@@ -0,0 +1,160 @@
+package reporting
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/kloset/snapshot"
+	"github.com/PlakarKorp/kloset/snapshot/header"
+)
+
+// number of failing paths listed in the report of a backup
+const REPORT_MAX_ERROR_PATHS = 10
+
+type summaryTotals struct {
+	files       uint64
+	directories uint64
+	bytes       uint64
+	errors      uint64
+}
+
+func headerTotals(hdr *header.Header) summaryTotals {
+	var totals summaryTotals
+	for _, source := range hdr.Sources {
+		summary := &source.Summary
+		totals.files += summary.Directory.Files + summary.Below.Files
+		totals.directories += summary.Directory.Directories + summary.Below.Directories
+		totals.bytes += summary.Directory.Size + summary.Below.Size
+		totals.errors += summary.Directory.Errors + summary.Below.Errors
+	}
+	return totals
+}
+
+func snapshotStats(repo *repository.Repository, snap *snapshot.Snapshot, cacheDir string, logger *logging.Logger) *ReportSnapshotStats {
+	totals := headerTotals(snap.Header)
+	stats := &ReportSnapshotStats{
+		Files:        totals.files,
+		Directories:  totals.directories,
+		BytesRead:    totals.bytes,
+		BytesWritten: repo.WBytes(),
+		Errors:       totals.errors,
+	}
+
+	if stats.Errors != 0 {
+		if fs, err := snap.Filesystem(); err != nil {
+			logger.Warn("failed to list the backup errors: %s", err)
+		} else if errs, err := fs.Errors("/"); err != nil {
+			logger.Warn("failed to list the backup errors: %s", err)
+		} else {
+			for item, err := range errs {
+				if err != nil {
+					logger.Warn("failed to list the backup errors: %s", err)
+					break
+				}
+				if len(stats.ErrorPaths) == REPORT_MAX_ERROR_PATHS {
+					break
+				}
+				stats.ErrorPaths = append(stats.ErrorPaths, ReportPathError{
+					Path:  item.Name,
+					Error: item.Error,
+				})
+			}
+		}
+	}
+
+	if prev := previousSnapshot(repo, snap, cacheDir); prev != nil {
+		prevTotals := headerTotals(prev)
+		stats.Delta = &ReportSnapshotDelta{
+			Previous:    prev.Identifier,
+			Files:       int64(totals.files) - int64(prevTotals.files),
+			Directories: int64(totals.directories) - int64(prevTotals.directories),
+			Bytes:       int64(totals.bytes) - int64(prevTotals.bytes),
+		}
+	}
+	return stats
+}
+
+// lastSnapshotsPath is the file recording, for each job and repository,
+// the last snapshot reported on the host, so that the previous snapshot of
+// a backup is found without loading the header of every snapshot of the
+// repository.
+func lastSnapshotsPath(cacheDir string) string {
+	return filepath.Join(ReportsDir(cacheDir), "last-snapshots.json")
+}
+
+// previousSnapshot returns the most recent snapshot of the same job that
+// precedes snap, if any.  Snapshots without a job are matched by name.
+// The snapshots of the repository are only scanned when no snapshot of
+// the job was recorded in cacheDir, or when it no longer exists.
+func previousSnapshot(repo *repository.Repository, snap *snapshot.Snapshot, cacheDir string) *header.Header {
+	if cacheDir == "" {
+		return scanPreviousSnapshot(repo, snap)
+	}
+
+	key := repo.Configuration().RepositoryID.String() + ":"
+	if snap.Header.Job != "" && snap.Header.Job != "default" {
+		key += "job:" + snap.Header.Job
+	} else {
+		key += "name:" + snap.Header.Name
+	}
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	path := lastSnapshotsPath(cacheDir)
+	recorded := make(map[string]string)
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &recorded)
+	}
+
+	var prev *header.Header
+	if id, err := hex.DecodeString(recorded[key]); err == nil && len(id) == len(objects.MAC{}) {
+		hdr, _, err := snapshot.GetSnapshot(repo, objects.MAC(id))
+		if err == nil && hdr.Timestamp.Before(snap.Header.Timestamp) {
+			prev = hdr
+		}
+	}
+	if prev == nil {
+		prev = scanPreviousSnapshot(repo, snap)
+	}
+
+	recorded[key] = hex.EncodeToString(snap.Header.Identifier[:])
+	if data, err := json.Marshal(recorded); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			os.WriteFile(path, data, 0600)
+		}
+	}
+	return prev
+}
+
+func scanPreviousSnapshot(repo *repository.Repository, snap *snapshot.Snapshot) *header.Header {
+	sameJob := func(hdr *header.Header) bool {
+		if snap.Header.Job != "" && snap.Header.Job != "default" {
+			return hdr.Job == snap.Header.Job
+		}
+		return hdr.Name == snap.Header.Name
+	}
+
+	var prev *header.Header
+	for id := range repo.ListSnapshots() {
+		if id == snap.Header.Identifier {
+			continue
+		}
+		hdr, _, err := snapshot.GetSnapshot(repo, id)
+		if err != nil {
+			continue
+		}
+		if !sameJob(hdr) || !hdr.Timestamp.Before(snap.Header.Timestamp) {
+			continue
+		}
+		if prev == nil || hdr.Timestamp.After(prev.Timestamp) {
+			prev = hdr
+		}
+	}
+	return prev
+}
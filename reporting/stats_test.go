@@ -0,0 +1,105 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/snapshot"
+	ptesting "github.com/PlakarKorp/plakar/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotStats(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+	repo, ctx := ptesting.GenerateRepository(t, bufOut, bufErr, nil)
+
+	first := ptesting.GenerateSnapshot(t, repo, []ptesting.MockFile{
+		ptesting.NewMockDir("subdir"),
+		ptesting.NewMockFile("subdir/foo.txt", 0644, "hello foo"),
+	}, ptesting.WithName("home"))
+	first.Close()
+
+	// an unrelated backup in between
+	other := ptesting.GenerateSnapshot(t, repo, []ptesting.MockFile{
+		ptesting.NewMockFile("bar.txt", 0644, "hello bar"),
+	}, ptesting.WithName("other"))
+	other.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	second := ptesting.GenerateSnapshot(t, repo, []ptesting.MockFile{
+		ptesting.NewMockDir("subdir"),
+		ptesting.NewMockDir("another_subdir"),
+		ptesting.NewMockFile("subdir/foo.txt", 0644, "hello foo"),
+		ptesting.NewMockFile("subdir/new.txt", 0644, "hello new"),
+		ptesting.NewMockFile("subdir/secret.txt", 0000, "hidden"),
+	}, ptesting.WithName("home"))
+	defer second.Close()
+
+	report := &Report{logger: ctx.GetLogger()}
+	report.WithRepositoryName("test")
+	report.WithRepository(repo)
+	report.WithSnapshot(second)
+
+	stats := report.Snapshot.Stats
+	require.NotNil(t, stats)
+	require.Equal(t, headerTotals(second.Header).files, stats.Files)
+	require.NotZero(t, stats.BytesRead)
+	require.NotZero(t, stats.BytesWritten)
+	require.Equal(t, uint64(1), stats.Errors)
+	require.Len(t, stats.ErrorPaths, 1)
+	require.Equal(t, "/subdir/secret.txt", stats.ErrorPaths[0].Path)
+
+	require.NotNil(t, stats.Delta)
+	require.Equal(t, first.Header.Identifier, stats.Delta.Previous)
+	require.Equal(t, int64(1), stats.Delta.Directories)
+	require.Equal(t, int64(len("hello new")), stats.Delta.Bytes)
+}
+
+func TestPreviousSnapshotRecorded(t *testing.T) {
+	repo, _ := ptesting.GenerateRepository(t, nil, nil, nil)
+	cacheDir := t.TempDir()
+
+	generate := func(name string) *snapshot.Snapshot {
+		time.Sleep(10 * time.Millisecond)
+		snap := ptesting.GenerateSnapshot(t, repo, []ptesting.MockFile{
+			ptesting.NewMockFile("foo.txt", 0644, "hello foo"),
+		}, ptesting.WithName(name))
+		t.Cleanup(func() { snap.Close() })
+		return snap
+	}
+	first := generate("home")
+	other := generate("other")
+	second := generate("home")
+	third := generate("home")
+
+	require.Nil(t, previousSnapshot(repo, first, cacheDir))
+
+	// the snapshot recorded for the job is used without scanning the
+	// repository, as shown by a record pointing to another job
+	key := repo.Configuration().RepositoryID.String() + ":name:home"
+	record := func(id objects.MAC) {
+		data, err := json.Marshal(map[string]string{key: hex.EncodeToString(id[:])})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(lastSnapshotsPath(cacheDir), data, 0600))
+	}
+	record(other.Header.Identifier)
+	prev := previousSnapshot(repo, second, cacheDir)
+	require.NotNil(t, prev)
+	require.Equal(t, other.Header.Identifier, prev.Identifier)
+
+	prev = previousSnapshot(repo, third, cacheDir)
+	require.NotNil(t, prev)
+	require.Equal(t, second.Header.Identifier, prev.Identifier)
+
+	// the repository is scanned when the recorded snapshot is gone
+	record(objects.MAC{1, 2, 3})
+	prev = previousSnapshot(repo, third, cacheDir)
+	require.NotNil(t, prev)
+	require.Equal(t, second.Header.Identifier, prev.Identifier)
+}
@@ -0,0 +1,106 @@
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"text/template"
+	"time"
+
+	"github.com/PlakarKorp/plakar/utils"
+)
+
+const WEBHOOK_TIMEOUT = 30 * time.Second
+
+var templateFuncs = template.FuncMap{
+	// json encodes a value, so that strings are properly escaped in
+	// JSON templates.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+type WebhookEmitter struct {
+	name     string
+	url      string
+	headers  map[string]string
+	secret   []byte
+	template *template.Template
+	client   http.Client
+}
+
+func NewWebhookEmitter(name string, cfg *WebhookConfig) (*WebhookEmitter, error) {
+	emitter := &WebhookEmitter{
+		name:    name,
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  http.Client{Timeout: WEBHOOK_TIMEOUT},
+	}
+	if cfg.Secret != "" {
+		emitter.secret = []byte(cfg.Secret)
+	}
+	if cfg.Template != "" {
+		tmpl, err := parseTemplate(name, cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", name, err)
+		}
+		emitter.template = tmpl
+	}
+	return emitter, nil
+}
+
+func (emitter *WebhookEmitter) body(report *Report) ([]byte, error) {
+	if emitter.template == nil {
+		return json.Marshal(report)
+	}
+	var buf bytes.Buffer
+	if err := emitter.template.Execute(&buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Signature returns the value of the X-Plakar-Signature header for a body
+// signed with secret.
+func Signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (emitter *WebhookEmitter) Emit(ctx context.Context, report *Report) error {
+	data, err := emitter.body(report)
+	if err != nil {
+		return fmt.Errorf("webhook %s: failed to encode report: %w", emitter.name, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", emitter.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", emitter.name, err)
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("plakar/%s (%s/%s)", utils.VERSION, runtime.GOOS, runtime.GOARCH))
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range emitter.headers {
+		req.Header.Set(key, value)
+	}
+	if emitter.secret != nil {
+		req.Header.Set("X-Plakar-Signature", Signature(emitter.secret, data))
+	}
+
+	res, err := emitter.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", emitter.name, err)
+	}
+	res.Body.Close()
+	if 200 <= res.StatusCode && res.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("webhook %s: request failed with status %s", emitter.name, res.Status)
+}
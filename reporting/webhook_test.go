@@ -0,0 +1,102 @@
+package reporting
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookEmitter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, "secret-token", r.Header.Get("X-Token"))
+		require.Equal(t, Signature([]byte("s3cr3t"), body), r.Header.Get("X-Plakar-Signature"))
+		bodies <- body
+	}))
+	defer server.Close()
+
+	report := &Report{
+		Task: &ReportTask{
+			Type:         "backup",
+			Name:         "nightly",
+			Status:       StatusFailed,
+			ErrorMessage: `error: "quoted"`,
+		},
+	}
+
+	emitter, err := NewWebhookEmitter("test", &WebhookConfig{
+		URL:     server.URL,
+		Headers: map[string]string{"X-Token": "secret-token"},
+		Secret:  "s3cr3t",
+	})
+	require.NoError(t, err)
+	require.NoError(t, emitter.Emit(context.Background(), report))
+
+	var decoded Report
+	require.NoError(t, json.Unmarshal(<-bodies, &decoded))
+	require.Equal(t, report.Task.Name, decoded.Task.Name)
+	require.Equal(t, report.Task.Status, decoded.Task.Status)
+
+	emitter, err = NewWebhookEmitter("test", &WebhookConfig{
+		URL:      server.URL,
+		Headers:  map[string]string{"X-Token": "secret-token"},
+		Secret:   "s3cr3t",
+		Template: `{"text": {{ printf "%s %s: %s" .Task.Name .Task.Status .Task.ErrorMessage | json }}}`,
+	})
+	require.NoError(t, err)
+	require.NoError(t, emitter.Emit(context.Background(), report))
+	require.JSONEq(t, `{"text": "nightly FAILURE: error: \"quoted\""}`, string(<-bodies))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	emitter, err = NewWebhookEmitter("failing", &WebhookConfig{URL: failing.URL})
+	require.NoError(t, err)
+	require.Error(t, emitter.Emit(context.Background(), report))
+}
+
+func TestLoadConfig(t *testing.T) {
+	configDir := t.TempDir()
+
+	cfg, err := LoadConfig(configDir)
+	require.NoError(t, err)
+	require.True(t, cfg.HostedEnabled())
+	require.Empty(t, cfg.Webhooks)
+
+	require.NoError(t, os.WriteFile(ConfigPath(configDir), []byte(`
+version: v1.0.0
+hosted: false
+webhooks:
+  ops:
+    url: https://hooks.example.com/plakar
+    headers:
+      Authorization: Bearer abc
+    secret: s3cr3t
+`), 0600))
+	cfg, err = LoadConfig(configDir)
+	require.NoError(t, err)
+	require.False(t, cfg.HostedEnabled())
+	require.Equal(t, "https://hooks.example.com/plakar", cfg.Webhooks["ops"].URL)
+	require.Equal(t, "Bearer abc", cfg.Webhooks["ops"].Headers["Authorization"])
+
+	invalid := []string{
+		"version: v2.0.0\n",
+		"version: v1.0.0\nwebhooks:\n  ops:\n    secret: foo\n",
+		"version: v1.0.0\nwebhooks:\n  ops:\n    url: ftp://example.com\n",
+		"version: v1.0.0\nwebhooks:\n  ops:\n    url: https://example.com\n    template: '{{ .Task'\n",
+	}
+	for _, data := range invalid {
+		require.NoError(t, os.WriteFile(ConfigPath(configDir), []byte(data), 0600))
+		_, err := LoadConfig(configDir)
+		require.Error(t, err, data)
+	}
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Steps of a task set refer to each other with "backup", or with the kind
+// of the step and its index in the task set, such as "check:1".  The index
+// can be omitted for the first step of a kind.
+
+func parseStep(step string) (kind string, idx int, err error) {
+	kind, index, found := strings.Cut(step, ":")
+	if found {
+		idx, err = strconv.Atoi(index)
+		if err != nil || idx < 0 {
+			return "", 0, fmt.Errorf("invalid step %q", step)
+		}
+	}
+
+	switch kind {
+	case "backup":
+		if found {
+			return "", 0, fmt.Errorf("invalid step %q", step)
+		}
+	case "check", "restore", "sync":
+	default:
+		return "", 0, fmt.Errorf("invalid step %q", step)
+	}
+	return kind, idx, nil
+}
+
+// jobName resolves a step of the task set into the name of its job.
+func (t Task) jobName(step string) (string, error) {
+	kind, idx, err := parseStep(step)
+	if err != nil {
+		return "", err
+	}
+
+	var count int
+	switch kind {
+	case "backup":
+		if t.Backup == nil {
+			return "", fmt.Errorf("task %s has no backup", t.Name)
+		}
+		return "backup:" + t.Name, nil
+	case "check":
+		count = len(t.Check)
+	case "restore":
+		count = len(t.Restore)
+	case "sync":
+		count = len(t.Sync)
+	}
+	if idx >= count {
+		return "", fmt.Errorf("task %s has no step %s", t.Name, step)
+	}
+	return fmt.Sprintf("%s:%s:%d", kind, t.Name, idx), nil
+}
+
+// jobNames returns the names of the jobs of all the steps of a task set.
+func (t Task) jobNames() []string {
+	var names []string
+	if t.Backup != nil {
+		names = append(names, "backup:"+t.Name)
+	}
+	for i := range t.Check {
+		names = append(names, fmt.Sprintf("check:%s:%d", t.Name, i))
+	}
+	for i := range t.Restore {
+		names = append(names, fmt.Sprintf("restore:%s:%d", t.Name, i))
+	}
+	for i := range t.Sync {
+		names = append(names, fmt.Sprintf("sync:%s:%d", t.Name, i))
+	}
+	return names
+}
+
+// checkChain verifies that the steps of the task set only run after steps
+// that exist and that there is no cycle between them.
+func (t Task) checkChain() error {
+	after := make(map[string]string)
+	add := func(kind string, idx int, sc ScheduleConfig) error {
+		if sc.After == "" {
+			return nil
+		}
+		name := fmt.Sprintf("%s:%s:%d", kind, t.Name, idx)
+		upstream, err := t.jobName(sc.After)
+		if err != nil {
+			return err
+		}
+		after[name] = upstream
+		return nil
+	}
+
+	if t.Backup != nil && t.Backup.After != "" {
+		return fmt.Errorf("the backup of task %s cannot run after another step", t.Name)
+	}
+	for i, check := range t.Check {
+		if err := add("check", i, check.ScheduleConfig); err != nil {
+			return err
+		}
+	}
+	for i, restore := range t.Restore {
+		if err := add("restore", i, restore.ScheduleConfig); err != nil {
+			return err
+		}
+	}
+	for i, sync := range t.Sync {
+		if err := add("sync", i, sync.ScheduleConfig); err != nil {
+			return err
+		}
+	}
+
+	for name := range after {
+		step := name
+		for range len(after) {
+			upstream, ok := after[step]
+			if !ok {
+				break
+			}
+			if upstream == name {
+				return fmt.Errorf("task %s: %s runs after itself", t.Name, name)
+			}
+			step = upstream
+		}
+	}
+	return nil
+}
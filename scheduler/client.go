@@ -77,8 +77,17 @@ func (c *Client) handshake(ignoreVersion bool) error {
 }
 
 func (c *Client) Stop() (int, error) {
+	return c.request("stop")
+}
+
+// Reload asks the scheduler to reload its tasks configuration.
+func (c *Client) Reload() (int, error) {
+	return c.request("reload")
+}
+
+func (c *Client) request(requestType string) (int, error) {
 	var request Request
-	request.Type = "stop"
+	request.Type = requestType
 	if err := c.enc.Encode(request); err != nil {
 		return 1, fmt.Errorf("failed to send packet: %w", err)
 	}
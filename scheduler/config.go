@@ -7,6 +7,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/plakar/subcommands/backup"
+	"github.com/PlakarKorp/plakar/throttle"
 	"github.com/go-playground/validator/v10"
 	"github.com/go-viper/mapstructure/v2"
 
@@ -19,6 +22,8 @@ type Configuration struct {
 
 type AgentConfig struct {
 	Reporting   bool                `yaml:"reporting"`
+	Catchup     bool                `yaml:"catchup"`
+	MaxParallel int                 `yaml:"max_parallel" mapstructure:"max_parallel" validate:"gte=0"`
 	Maintenance []MaintenanceConfig `validate:"dive"`
 	Tasks       []Task              `mapstructure:"tasks" validate:"dive"`
 }
@@ -33,15 +38,42 @@ type Task struct {
 	Sync    []SyncConfig    `validate:"dive"`
 }
 
+// BackupConfig mirrors the options of the backup subcommand.  The source
+// to back up is either a Path, or the name of a Source configured with
+// "plakar source", which is the same as a path of "@name".  After each
+// backup, the snapshots of the task older than Retention are removed, or
+// pruned according to Policy and Periods as for MaintenanceConfig.
 type BackupConfig struct {
-	Name       string
-	Tags       []string
-	Path       string        `validate:"required"`
-	Interval   time.Duration `validate:"required"`
-	Check      BackupConfigCheck
-	Retention  time.Duration
-	Ignore     []string
-	IgnoreFile string `yaml:"ignoreFile"`
+	Name        string
+	Category    string
+	Environment string
+	Perimeter   string
+	Labels      map[string]string
+	Tags        []string
+	Path        string `validate:"required_without=Source,excluded_with=Source"`
+	Source      string
+	Check       BackupConfigCheck
+	Retention   time.Duration
+	Policy      string                `validate:"excluded_with=Retention"`
+	Periods     *locate.LocatePeriods `validate:"excluded_with=Retention"`
+	Ignore      []string
+	IgnoreFile  string `yaml:"ignoreFile"`
+	Concurrency uint64
+	Options     map[string]string
+	DiskBased   string        `yaml:"diskBased"`
+	PreHook     string        `mapstructure:"pre_hook"`
+	PostHook    string        `mapstructure:"post_hook"`
+	FailHook    string        `mapstructure:"fail_hook"`
+	HookTimeout time.Duration `mapstructure:"hook_timeout"`
+
+	PlakarIgnore bool
+	ExcludeIf    []string `mapstructure:"exclude_if" validate:"dive,excluderule"`
+
+	LimitUpload   string `mapstructure:"limit_upload" validate:"omitempty,rate"`
+	LimitDownload string `mapstructure:"limit_download" validate:"omitempty,rate"`
+	LimitRead     string `mapstructure:"limit_read" validate:"omitempty,rate"`
+
+	ScheduleConfig `mapstructure:",squash"`
 }
 
 // CheckDecodeHook is a mapstructure decode hook to allow users to specify
@@ -70,18 +102,44 @@ type BackupConfigCheck struct {
 	Enabled bool
 }
 
+// CheckConfig mirrors the options of the check subcommand.  Unless Job is
+// set, only the snapshots created by the task are considered.
 type CheckConfig struct {
-	Path     string `validate:"required"`
-	Since    string
-	Before   string
-	Interval time.Duration `validate:"required"`
-	Latest   bool
+	Path        string `validate:"required"`
+	Since       string `validate:"omitempty,timeflag"`
+	Before      string `validate:"omitempty,timeflag"`
+	Latest      bool
+	Name        string
+	Category    string
+	Environment string
+	Perimeter   string
+	Job         string
+	Tags        []string
+	Roots       []string
+	Concurrency uint64
+	Fast        bool
+	NoVerify    bool `yaml:"noVerify"`
+
+	ScheduleConfig `mapstructure:",squash"`
 }
 
+// RestoreConfig mirrors the options of the restore subcommand.  Unless Job
+// is set, only the snapshots created by the task are considered.
 type RestoreConfig struct {
-	Path     string        `validate:"required"`
-	Target   string        `validate:"required"`
-	Interval time.Duration `validate:"required"`
+	Path            string `validate:"required"`
+	Target          string `validate:"required"`
+	Name            string
+	Category        string
+	Environment     string
+	Perimeter       string
+	Job             string
+	Tag             string
+	Concurrency     uint64
+	SkipPermissions bool `yaml:"skipPermissions"`
+
+	LimitDownload string `mapstructure:"limit_download" validate:"omitempty,rate"`
+
+	ScheduleConfig `mapstructure:",squash"`
 }
 
 type SyncDirection string
@@ -145,13 +203,24 @@ func DurationDecodeHook() mapstructure.DecodeHookFunc {
 type SyncConfig struct {
 	Peer      string        `validate:"required"`
 	Direction SyncDirection `validate:"required"`
-	Interval  time.Duration `validate:"required"`
+
+	LimitUpload   string `mapstructure:"limit_upload" validate:"omitempty,rate"`
+	LimitDownload string `mapstructure:"limit_download" validate:"omitempty,rate"`
+
+	ScheduleConfig `mapstructure:",squash"`
 }
 
+// MaintenanceConfig describes the maintenance of a repository.  Obsolete
+// snapshots are either removed once older than Retention, or pruned
+// according to the named Policy from policies.yml, whose periods can be
+// overridden with Periods.
 type MaintenanceConfig struct {
-	Interval   time.Duration `validate:"required"`
-	Retention  time.Duration `validate:"required"`
-	Repository string        `validate:"required"`
+	Retention  time.Duration         `validate:"required_without_all=Policy Periods"`
+	Policy     string                `validate:"excluded_with=Retention"`
+	Periods    *locate.LocatePeriods `validate:"excluded_with=Retention"`
+	Repository string                `validate:"required"`
+
+	ScheduleConfig `mapstructure:",squash"`
 }
 
 func NewConfiguration() *Configuration {
@@ -159,7 +228,11 @@ func NewConfiguration() *Configuration {
 }
 
 func DefaultConfiguration() *Configuration {
-	return &Configuration{}
+	return &Configuration{
+		Agent: AgentConfig{
+			Catchup: true,
+		},
+	}
 }
 
 // ParseConfig parses the YAML file into the Config struct.
@@ -171,48 +244,7 @@ func ParseConfigFile(filename string) (*Configuration, error) {
 		return nil, fmt.Errorf("failed to read configuration file: %w", err)
 	}
 
-	var config Configuration
-
-	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result: &config,
-		DecodeHook: mapstructure.ComposeDecodeHookFunc(
-			BackupConfigCheckDecodeHook(),
-			SyncDirectionDecodeHook(),
-			DurationDecodeHook(),
-		),
-		ErrorUnused: true, // errors out if there are extra/unmapped keys
-	})
-	if err != nil {
-		return nil, fmt.Errorf("creating decoder: %w", err)
-	}
-
-	if err := decoder.Decode(file.AllSettings()); err != nil {
-		return nil, fmt.Errorf("decoding config: %w", err)
-	}
-
-	// Set default values for SyncConfig.Direction.
-	for i := range config.Agent.Tasks {
-		for j := range config.Agent.Tasks[i].Sync {
-			if config.Agent.Tasks[i].Sync[j].Direction == "" {
-				config.Agent.Tasks[i].Sync[j].Direction = SyncDirectionTo
-			}
-		}
-	}
-
-	validate := validator.New(validator.WithRequiredStructEnabled())
-
-	validate.RegisterStructValidation(func(sl validator.StructLevel) {
-		obj := sl.Current().Interface().(Task)
-		if obj.Backup == nil && len(obj.Check) == 0 && len(obj.Restore) == 0 && len(obj.Sync) == 0 {
-			sl.ReportError(obj, "Task", "Task", "atleastone", "at least one of Backup, Check, Restore, or Sync must be set")
-		}
-	}, Task{})
-
-	if err := validate.Struct(config); err != nil {
-		return nil, fmt.Errorf("validating config: %w", err)
-	}
-
-	return &config, nil
+	return parseConfig(file)
 }
 
 func ParseConfigBytes(configBytes []byte) (*Configuration, error) {
@@ -223,10 +255,14 @@ func ParseConfigBytes(configBytes []byte) (*Configuration, error) {
 		return nil, fmt.Errorf("failed to read configuration data: %w", err)
 	}
 
-	var config Configuration
+	return parseConfig(file)
+}
+
+func parseConfig(file *viper.Viper) (*Configuration, error) {
+	config := DefaultConfiguration()
 
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		Result: &config,
+		Result: config,
 		DecodeHook: mapstructure.ComposeDecodeHookFunc(
 			BackupConfigCheckDecodeHook(),
 			SyncDirectionDecodeHook(),
@@ -253,16 +289,53 @@ func ParseConfigBytes(configBytes []byte) (*Configuration, error) {
 
 	validate := validator.New(validator.WithRequiredStructEnabled())
 
+	validate.RegisterValidation("timeflag", func(fl validator.FieldLevel) bool {
+		_, err := locate.ParseTimeFlag(fl.Field().String())
+		return err == nil
+	})
+
+	validate.RegisterValidation("rate", func(fl validator.FieldLevel) bool {
+		_, err := throttle.ParseRate(fl.Field().String())
+		return err == nil
+	})
+
+	validate.RegisterValidation("excluderule", func(fl validator.FieldLevel) bool {
+		_, err := backup.ParseExcludeRule(fl.Field().String())
+		return err == nil
+	})
+
 	validate.RegisterStructValidation(func(sl validator.StructLevel) {
 		obj := sl.Current().Interface().(Task)
 		if obj.Backup == nil && len(obj.Check) == 0 && len(obj.Restore) == 0 && len(obj.Sync) == 0 {
 			sl.ReportError(obj, "Task", "Task", "atleastone", "at least one of Backup, Check, Restore, or Sync must be set")
 		}
+		if err := obj.checkChain(); err != nil {
+			sl.ReportError(obj, "Task", "Task", "chain", err.Error())
+		}
 	}, Task{})
 
+	validate.RegisterStructValidation(func(sl validator.StructLevel) {
+		obj := sl.Current().Interface().(MaintenanceConfig)
+		if obj.After != "" {
+			sl.ReportError(obj.After, "After", "After", "chain", "maintenance cannot run after another step")
+		}
+	}, MaintenanceConfig{})
+
+	validate.RegisterStructValidation(func(sl validator.StructLevel) {
+		obj := sl.Current().Interface().(ScheduleConfig)
+		if obj.Cron != "" {
+			if _, err := obj.NewSchedule(); err != nil {
+				sl.ReportError(obj.Cron, "Schedule", "Cron", "schedule", err.Error())
+			}
+		}
+		if _, err := obj.newTimeWindows(); err != nil {
+			sl.ReportError(obj.Window, "Window", "Window", "window", err.Error())
+		}
+	}, ScheduleConfig{})
+
 	if err := validate.Struct(config); err != nil {
 		return nil, fmt.Errorf("validating config: %w", err)
 	}
 
-	return &config, nil
+	return config, nil
 }
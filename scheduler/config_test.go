@@ -0,0 +1,341 @@
+package scheduler
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleConfig(t *testing.T) {
+	config, err := ParseConfigBytes([]byte(`
+agent:
+  max_parallel: 2
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      backup:
+        path: /etc
+        schedule: "30 2 * * 1-5"
+        timezone: Europe/Paris
+      check:
+        - path: /
+          interval: 1h
+`))
+	require.NoError(t, err)
+	require.Equal(t, 2, config.Agent.MaxParallel)
+	require.Equal(t, "30 2 * * 1-5", config.Agent.Tasks[0].Backup.Cron)
+	require.Equal(t, time.Hour, config.Agent.Tasks[0].Check[0].Interval)
+
+	invalid := []string{
+		// neither interval nor schedule
+		`{path: /etc}`,
+		// both interval and schedule
+		`{path: /etc, interval: 1h, schedule: "@daily"}`,
+		// bad cron expression
+		`{path: /etc, schedule: "61 * * * *"}`,
+		// timezone without schedule
+		`{path: /etc, interval: 1h, timezone: UTC}`,
+		// unknown timezone
+		`{path: /etc, schedule: "@daily", timezone: Mars/Olympus}`,
+	}
+	for _, backup := range invalid {
+		_, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      backup: ` + backup + "\n"))
+		require.Error(t, err, backup)
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	config, err := ParseConfigBytes([]byte(`
+agent:
+  maintenance:
+    - repository: /var/backups
+      policy: gfs
+      periods:
+        day: {keep: 7}
+        week: {keep: 4, cap: 1}
+      interval: 24h
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      backup:
+        path: /etc
+        policy: gfs
+        interval: 24h
+`))
+	require.NoError(t, err)
+	require.Equal(t, "gfs", config.Agent.Tasks[0].Backup.Policy)
+	maintenance := config.Agent.Maintenance[0]
+	require.Equal(t, "gfs", maintenance.Policy)
+	require.Equal(t, 7, maintenance.Periods.Day.Keep)
+	require.Equal(t, 4, maintenance.Periods.Week.Keep)
+	require.Equal(t, 1, maintenance.Periods.Week.Cap)
+
+	invalid := []string{
+		// no retention at all
+		`{repository: /var/backups, interval: 24h}`,
+		// both a cutoff and a policy
+		`{repository: /var/backups, retention: 720h, policy: gfs, interval: 24h}`,
+		// unknown period
+		`{repository: /var/backups, periods: {fortnight: {keep: 1}}, interval: 24h}`,
+	}
+	for _, maintenance := range invalid {
+		_, err := ParseConfigBytes([]byte(`
+agent:
+  maintenance:
+    - ` + maintenance + "\n"))
+		require.Error(t, err, maintenance)
+	}
+}
+
+func TestPruneSubcommand(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	ctx.ConfigDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ctx.ConfigDir, "policies.yml"), []byte(`
+version: v1.0.0
+policies:
+  gfs:
+    periods:
+      day: {keep: 7}
+      month: {keep: 12, cap: 1}
+`), 0600))
+	s := NewScheduler(ctx, NewConfiguration())
+
+	cmd, err := s.pruneSubcommand("gfs", &locate.LocatePeriods{Day: locate.LocatePeriod{Keep: 14}})
+	require.NoError(t, err)
+	require.True(t, cmd.Apply)
+	require.Equal(t, 14, cmd.LocateOptions.Periods.Day.Keep)
+	require.Equal(t, 12, cmd.LocateOptions.Periods.Month.Keep)
+	require.Equal(t, 1, cmd.LocateOptions.Periods.Month.Cap)
+
+	_, err = s.pruneSubcommand("unknown", nil)
+	require.Error(t, err)
+
+	_, err = s.pruneSubcommand("", &locate.LocatePeriods{})
+	require.Error(t, err)
+}
+
+func TestTaskChain(t *testing.T) {
+	config, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      backup:
+        path: /etc
+        schedule: "@daily"
+      check:
+        - path: /
+          after: backup
+      sync:
+        - peer: offsite
+          after: check
+`))
+	require.NoError(t, err)
+
+	task := config.Agent.Tasks[0]
+	require.Equal(t, "backup", task.Check[0].After)
+	upstream, err := task.jobName(task.Sync[0].After)
+	require.NoError(t, err)
+	require.Equal(t, "check:nightly:0", upstream)
+
+	invalid := []string{
+		// no such step
+		`{backup: {path: /etc, interval: 1h}, check: [{path: /, after: "check:1"}]}`,
+		// a chained step has no schedule of its own
+		`{backup: {path: /etc, interval: 1h}, check: [{path: /, after: backup, interval: 1h}]}`,
+		// the backup is the head of the chain
+		`{backup: {path: /etc, after: check}, check: [{path: /, interval: 1h}]}`,
+		// cycle
+		`{check: [{path: /, after: sync}], sync: [{peer: offsite, after: check}]}`,
+		// invalid step
+		`{check: [{path: /, interval: 1h}], sync: [{peer: offsite, after: "check:-1"}]}`,
+	}
+	for _, task := range invalid {
+		_, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      ` + task[1:len(task)-1] + "\n"))
+		require.Error(t, err, task)
+	}
+}
+
+func TestTaskOptions(t *testing.T) {
+	config, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      backup:
+        source: mysql
+        name: db
+        category: database
+        environment: prod
+        perimeter: eu
+        labels:
+          team: dba
+        tags: [prod, mysql]
+        concurrency: 4
+        diskBased: "on"
+        pre_hook: "echo pre"
+        fail_hook: "echo failed"
+        plakarignore: true
+        exclude_if: ["size>4GiB", "marker=CACHEDIR.TAG"]
+        options:
+          dump: full
+        interval: 24h
+        retry:
+          attempts: 3
+          backoff: 5m
+          max_backoff: 1h
+        jitter: 15m
+        window: ["mon-fri 20:00-06:00", "sat,sun"]
+        timezone: Europe/Paris
+        limit_upload: 10MiB
+        limit_read: 100MB/s
+      check:
+        - path: /
+          since: 7d
+          fast: true
+          noVerify: true
+          tags: [prod]
+          interval: 24h
+      restore:
+        - path: /etc
+          target: /tmp/restore
+          skipPermissions: true
+          tag: prod
+          limit_download: 1MiB
+          interval: 24h
+`))
+	require.NoError(t, err)
+
+	task := config.Agent.Tasks[0]
+	require.Equal(t, "mysql", task.Backup.Source)
+	require.Equal(t, "db", task.Backup.Name)
+	require.Equal(t, "database", task.Backup.Category)
+	require.Equal(t, "prod", task.Backup.Environment)
+	require.Equal(t, "eu", task.Backup.Perimeter)
+	require.Equal(t, map[string]string{"team": "dba"}, task.Backup.Labels)
+	require.Equal(t, []string{"prod", "mysql"}, task.Backup.Tags)
+	require.Equal(t, uint64(4), task.Backup.Concurrency)
+	require.Equal(t, "on", task.Backup.DiskBased)
+	require.Equal(t, "echo pre", task.Backup.PreHook)
+	require.Equal(t, "echo failed", task.Backup.FailHook)
+	require.True(t, task.Backup.PlakarIgnore)
+	require.Equal(t, []string{"size>4GiB", "marker=CACHEDIR.TAG"}, task.Backup.ExcludeIf)
+	require.Equal(t, map[string]string{"dump": "full"}, task.Backup.Options)
+	require.Equal(t, RetryConfig{Attempts: 3, Backoff: 5 * time.Minute, MaxBackoff: time.Hour}, task.Backup.Retry)
+	require.Equal(t, 15*time.Minute, task.Backup.Jitter)
+	require.Equal(t, []string{"mon-fri 20:00-06:00", "sat,sun"}, task.Backup.Window)
+	require.Equal(t, "7d", task.Check[0].Since)
+	require.True(t, task.Check[0].Fast)
+	require.True(t, task.Check[0].NoVerify)
+	require.True(t, task.Restore[0].SkipPermissions)
+	require.Equal(t, "prod", task.Restore[0].Tag)
+	require.Equal(t, "10MiB", task.Backup.LimitUpload)
+	require.Equal(t, "100MB/s", task.Backup.LimitRead)
+	require.Equal(t, "1MiB", task.Restore[0].LimitDownload)
+	require.Equal(t, int64(100_000_000), limit(task.Backup.LimitRead))
+
+	invalid := []string{
+		// both path and source
+		`{backup: {path: /etc, source: mysql, interval: 1h}}`,
+		// unparsable date
+		`{check: [{path: /, since: yesterday, interval: 1h}]}`,
+		// invalid window
+		`{backup: {path: /etc, interval: 1h, window: ["mon-fri 9h-17h"]}}`,
+		// chained steps run right after their upstream step
+		`{backup: {path: /etc, interval: 1h}, check: [{path: /, after: backup, jitter: 1m}]}`,
+		// unparsable rate
+		`{backup: {path: /etc, interval: 1h, limit_upload: fast}}`,
+		// invalid exclusion rule
+		`{backup: {path: /etc, interval: 1h, exclude_if: ["size>huge"]}}`,
+	}
+	for _, task := range invalid {
+		_, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: nightly
+      repository: /var/backups
+      ` + task[1:len(task)-1] + "\n"))
+		require.Error(t, err, task)
+	}
+}
+
+func TestSchedulerReload(t *testing.T) {
+	config, err := ParseConfigBytes([]byte(`
+agent:
+  tasks:
+    - name: unchanged
+      repository: /var/backups
+      backup: {path: /etc, interval: 24h}
+    - name: changed
+      repository: /var/backups
+      backup: {path: /home, interval: 24h}
+      check:
+        - path: /
+          after: backup
+    - name: removed
+      repository: /var/backups
+      backup: {path: /var, interval: 24h}
+`))
+	require.NoError(t, err)
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	defer ctx.Cancel()
+
+	s := NewScheduler(ctx, config)
+	s.engine = newEngine(ctx, NewState(t.TempDir()), 0)
+	for _, taskset := range config.Agent.Tasks {
+		s.taskset(taskset)
+	}
+	require.NoError(t, s.engine.link())
+
+	unchanged := s.engine.jobs["backup:unchanged"]
+	changed := s.engine.jobs["backup:changed"]
+
+	config, err = ParseConfigBytes([]byte(`
+agent:
+  max_parallel: 2
+  tasks:
+    - name: unchanged
+      repository: /var/backups
+      backup: {path: /etc, interval: 24h}
+    - name: changed
+      repository: /var/backups
+      backup: {path: /home, interval: 12h}
+      check:
+        - path: /
+          after: backup
+    - name: added
+      repository: /var/backups
+      backup: {path: /srv, interval: 24h}
+`))
+	require.NoError(t, err)
+	require.NoError(t, s.Reload(config))
+
+	jobs := s.engine.jobs
+	require.Same(t, unchanged, jobs["backup:unchanged"])
+	require.NotSame(t, changed, jobs["backup:changed"])
+	require.True(t, changed.removed)
+	require.Equal(t, []*job{jobs["check:changed:0"]}, jobs["backup:changed"].then)
+	require.NotContains(t, jobs, "backup:removed")
+	require.Contains(t, jobs, "backup:added")
+	require.Len(t, s.engine.queue, 3)
+	require.Equal(t, 2, s.engine.limiter.max)
+}
@@ -0,0 +1,259 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule implements the classic five-field cron(8) syntax:
+// minute, hour, day of month, month and day of week.
+type cronSchedule struct {
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	location *time.Location
+
+	// as in cron(8), when both the day of month and the day of
+	// week are restricted, a day matching either one is selected.
+	domRestricted bool
+	dowRestricted bool
+
+	// neither the minute nor the hour is a wildcard: as in cron(8),
+	// such an activation runs once in the hour repeated when moving
+	// back from daylight saving time.
+	fixed bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is accepted as an alias for sunday.
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(spec string, location *time.Location) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	sched := &cronSchedule{
+		location:      location,
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+		fixed:         !strings.HasPrefix(fields[0], "*") && !strings.HasPrefix(fields[1], "*"),
+	}
+
+	var err error
+	if sched.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("invalid minute field: %w", err)
+	}
+	if sched.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid hour field: %w", err)
+	}
+	if sched.dom, err = cronDom.parse(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid day of month field: %w", err)
+	}
+	if sched.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, fmt.Errorf("invalid month field: %w", err)
+	}
+	if sched.dow, err = cronDow.parse(fields[4]); err != nil {
+		return nil, fmt.Errorf("invalid day of week field: %w", err)
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1 << 0
+	}
+
+	return sched, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rng, "-"):
+			first, last, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(first); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(last); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			var err error
+			if lo, err = f.value(rng); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if hasStep {
+				hi = f.max
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domRestricted && c.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.month&(1<<uint(t.Month())) != 0 && c.dayMatches(t) &&
+		c.hour&(1<<uint(t.Hour())) != 0 && c.minute&(1<<uint(t.Minute())) != 0
+}
+
+// Next returns the first activation strictly after t, or the zero time if
+// the expression can't be satisfied in the next few years (i.e. Feb 30th).
+//
+// As in cron(8), an activation falling in the hour skipped when moving to
+// daylight saving time runs at the first instant after it, and a fixed
+// one falling in the hour repeated when moving back runs only once.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	next := c.next(t)
+	for c.fixed && !next.IsZero() && repeated(next) {
+		next = c.next(next)
+	}
+	limit := t.AddDate(5, 0, 0)
+
+	// look for the activations skipped by the changes of offset moving
+	// the clock forward before the one found
+	_, end := t.In(c.location).ZoneBounds()
+	for !end.IsZero() && end.Before(limit) && (next.IsZero() || !end.After(next)) {
+		_, before := end.Add(-time.Second).Zone()
+		_, after := end.Zone()
+		skipped := end.In(time.FixedZone("", before))
+		for i := 0; i < (after-before)/60; i++ {
+			if c.matches(skipped.Add(time.Duration(i) * time.Minute)) {
+				return end
+			}
+		}
+		_, end = end.ZoneBounds()
+	}
+	return next
+}
+
+// repeated tells whether the wall clock of t already occurred earlier,
+// before a change of offset moving the clock back.
+func repeated(t time.Time) bool {
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return false
+	}
+	_, before := start.Add(-time.Second).Zone()
+	_, after := t.Zone()
+	return before > after && t.Sub(start) < time.Duration(before-after)*time.Second
+}
+
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+
+	for c.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !c.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for c.hour&(1<<uint(t.Hour())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for c.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"30 2 * * 1-5",
+		"*/15 * * * *",
+		"0 0,12 1 jan-jun *",
+		"0 4 * * sun",
+		"5/10 * * * 7",
+		"@daily",
+		"@Hourly",
+	}
+	for _, spec := range valid {
+		_, err := parseCron(spec, time.UTC)
+		require.NoError(t, err, spec)
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"foo * * * *",
+		"@fortnightly",
+	}
+	for _, spec := range invalid {
+		_, err := parseCron(spec, time.UTC)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return ts
+	}
+
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"30 2 * * 1-5", "2025-01-03T10:00:00Z", "2025-01-06T02:30:00Z"}, // friday -> monday
+		{"30 2 * * 1-5", "2025-01-06T02:29:59Z", "2025-01-06T02:30:00Z"},
+		{"30 2 * * 1-5", "2025-01-06T02:30:00Z", "2025-01-07T02:30:00Z"},
+		{"*/15 * * * *", "2025-01-01T10:07:00Z", "2025-01-01T10:15:00Z"},
+		{"0 0 1 1 *", "2025-06-01T00:00:00Z", "2026-01-01T00:00:00Z"},
+		{"0 0 29 2 *", "2025-01-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 12 13 * 5", "2025-06-01T00:00:00Z", "2025-06-06T12:00:00Z"}, // dom or dow
+		{"0 0 * * 7", "2025-01-01T00:00:00Z", "2025-01-05T00:00:00Z"},
+		{"@hourly", "2025-01-01T23:59:00Z", "2025-01-02T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		sched, err := parseCron(tt.spec, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, at(tt.want), sched.Next(at(tt.from)).UTC(), tt.spec)
+	}
+
+	// Feb 30th never happens
+	sched, err := parseCron("0 0 30 2 *", time.UTC)
+	require.NoError(t, err)
+	require.True(t, sched.Next(at("2025-01-01T00:00:00Z")).IsZero())
+}
+
+func TestCronNextTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	sched, err := parseCron("30 2 * * *", paris)
+	require.NoError(t, err)
+
+	from := time.Date(2025, time.January, 10, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, time.Date(2025, time.January, 10, 1, 30, 0, 0, time.UTC), sched.Next(from).UTC())
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	// 2:00 jumps to 3:00 on 2025-03-30, the activations in between
+	// run once, at 3:00
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"30 2 * * *", time.Date(2025, time.March, 30, 0, 0, 0, 0, paris), time.Date(2025, time.March, 30, 3, 0, 0, 0, paris)},
+		{"30 2 * * *", time.Date(2025, time.March, 30, 3, 0, 0, 0, paris), time.Date(2025, time.March, 31, 2, 30, 0, 0, paris)},
+		{"*/15 2 * * *", time.Date(2025, time.March, 30, 1, 50, 0, 0, paris), time.Date(2025, time.March, 30, 3, 0, 0, 0, paris)},
+		{"30 2 30 3 *", time.Date(2025, time.March, 1, 0, 0, 0, 0, paris), time.Date(2025, time.March, 30, 3, 0, 0, 0, paris)},
+		{"30 2 30 3 *", time.Date(2024, time.October, 1, 0, 0, 0, 0, paris), time.Date(2025, time.March, 30, 3, 0, 0, 0, paris)},
+		{"30 3 * * *", time.Date(2025, time.March, 30, 0, 0, 0, 0, paris), time.Date(2025, time.March, 30, 3, 30, 0, 0, paris)},
+		{"0 1 * * *", time.Date(2025, time.March, 29, 12, 0, 0, 0, paris), time.Date(2025, time.March, 30, 1, 0, 0, 0, paris)},
+	}
+	for _, tt := range tests {
+		sched, err := parseCron(tt.spec, paris)
+		require.NoError(t, err)
+		require.Equal(t, tt.want.UTC(), sched.Next(tt.from).UTC(), tt.spec)
+	}
+}
+
+func TestCronNextDaylightSavingEnd(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	// 2:00 EDT goes back to 1:00 EST on 2025-11-02, the fixed
+	// activations in between run once, the others at both offsets
+	edt := time.FixedZone("EDT", -4*3600)
+	est := time.FixedZone("EST", -5*3600)
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"30 1 * * *", time.Date(2025, time.November, 2, 0, 0, 0, 0, edt), time.Date(2025, time.November, 2, 1, 30, 0, 0, edt)},
+		{"30 1 * * *", time.Date(2025, time.November, 2, 1, 30, 0, 0, edt), time.Date(2025, time.November, 3, 1, 30, 0, 0, est)},
+		{"30 1 * * *", time.Date(2025, time.November, 2, 1, 10, 0, 0, est), time.Date(2025, time.November, 3, 1, 30, 0, 0, est)},
+		{"0,30 1 * * *", time.Date(2025, time.November, 2, 1, 0, 0, 0, edt), time.Date(2025, time.November, 2, 1, 30, 0, 0, edt)},
+		{"0,30 1 * * *", time.Date(2025, time.November, 2, 1, 30, 0, 0, edt), time.Date(2025, time.November, 3, 1, 0, 0, 0, est)},
+		{"*/30 1 * * *", time.Date(2025, time.November, 2, 1, 30, 0, 0, edt), time.Date(2025, time.November, 2, 1, 0, 0, 0, est)},
+		{"30 * * * *", time.Date(2025, time.November, 2, 1, 30, 0, 0, edt), time.Date(2025, time.November, 2, 1, 30, 0, 0, est)},
+		{"30 2 * * *", time.Date(2025, time.November, 2, 0, 0, 0, 0, edt), time.Date(2025, time.November, 2, 2, 30, 0, 0, est)},
+	}
+	for _, tt := range tests {
+		sched, err := parseCron(tt.spec, newYork)
+		require.NoError(t, err)
+		require.Equal(t, tt.want.UTC(), sched.Next(tt.from).UTC(), tt.spec)
+	}
+}
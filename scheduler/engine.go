@@ -0,0 +1,446 @@
+package scheduler
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/plakar/appcontext"
+)
+
+// jobOptions tune how the engine drives a job.  Repositories lists the
+// repositories the job operates on, which it holds exclusively if
+// exclusive is set.
+type jobOptions struct {
+	catchup      bool
+	retry        RetryConfig
+	repositories []string
+	exclusive    bool
+	jitter       time.Duration
+	windows      *timeWindows
+}
+
+func (opts jobOptions) delay() time.Duration {
+	if opts.jitter <= 0 {
+		return 0
+	}
+	return rand.N(opts.jitter)
+}
+
+// activation returns when a job due at t starts: after its jitter and
+// within its windows.
+func (opts jobOptions) activation(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+
+	t = t.Add(opts.delay())
+	if opening := opts.windows.next(t); !opening.Equal(t) {
+		// jobs deferred to the same opening are spread as well
+		t = opening
+		if spread := t.Add(opts.delay()); opts.windows.next(spread).Equal(spread) {
+			t = spread
+		}
+	}
+	return t
+}
+
+// runContext is passed to the run function of a job.  Attempt starts at 1
+// and is greater than 1 only when retrying a failed run.  SnapshotID is
+// the snapshot created by the upstream job, if any, and is set by the run
+// function when it creates one to pass it down the chain.
+type runContext struct {
+	attempt    int
+	snapshotID objects.MAC
+}
+
+// job is a unit of work driven by the engine.  A job never overlaps with
+// itself: its next activation is computed once the current run is over,
+// and a job registered again under the same name, when its task changed,
+// waits for the run of the previous one to complete.
+// A job without a schedule runs after the job named in after succeeded,
+// together with the other jobs in its then list.
+type job struct {
+	name     string
+	schedule Schedule
+	after    string
+	then     []*job
+	opts     jobOptions
+	next     time.Time
+	attempt  int
+	run      func(rc *runContext) error
+	index    int
+	removed  bool
+}
+
+type jobQueue []*job
+
+func (q jobQueue) Len() int           { return len(q) }
+func (q jobQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *jobQueue) Push(x any) {
+	j := x.(*job)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	j.index = -1
+	*q = old[:n-1]
+	return j
+}
+
+// engine is the single timer shared by all the scheduler tasks: it sleeps
+// until the earliest job is due and dispatches it in its own goroutine.
+type engine struct {
+	ctx     *appcontext.AppContext
+	state   *State
+	limiter *limiter
+	mtx     sync.Mutex
+	queue   jobQueue
+	jobs    map[string]*job
+	chained []*job
+	running map[string]chan struct{}
+	wakeup  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newEngine returns an engine running at most maxParallel jobs at once,
+// or any number of them if maxParallel is 0.
+func newEngine(ctx *appcontext.AppContext, state *State, maxParallel int) *engine {
+	return &engine{
+		ctx:     ctx,
+		state:   state,
+		limiter: newLimiter(maxParallel),
+		jobs:    make(map[string]*job),
+		running: make(map[string]chan struct{}),
+		wakeup:  make(chan struct{}, 1),
+	}
+}
+
+func (e *engine) notify() {
+	select {
+	case e.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// schedule queues the next activation of a job, unless it was removed
+// while running.
+func (e *engine) schedule(j *job) {
+	if j.next.IsZero() {
+		return
+	}
+	e.mtx.Lock()
+	if j.removed {
+		e.mtx.Unlock()
+		return
+	}
+	heap.Push(&e.queue, j)
+	e.mtx.Unlock()
+
+	if e.state != nil {
+		if err := e.state.SetNextRun(j.name, j.next); err != nil {
+			e.ctx.GetLogger().Warn("failed to save scheduler state: %s", err)
+		}
+	}
+	e.notify()
+}
+
+// add registers a new job.  If the previous instance of the scheduler
+// recorded an activation that was missed while it was not running, the job
+// runs right away when catchup is set, otherwise the missed run is skipped.
+func (e *engine) add(name string, schedule Schedule, opts jobOptions, run func(rc *runContext) error) {
+	now := time.Now()
+	next := opts.activation(schedule.Next(now))
+
+	if e.state != nil {
+		recorded := e.state.NextRun(name)
+		switch {
+		case recorded.IsZero():
+		case !recorded.After(now):
+			if opts.catchup {
+				e.ctx.GetLogger().Info("%s: catching up run missed at %s", name, recorded.Format(time.RFC3339))
+				next = opts.activation(now)
+			}
+		case recorded.Before(next):
+			next = recorded
+		}
+	}
+
+	j := &job{
+		name:     name,
+		schedule: schedule,
+		opts:     opts,
+		next:     next,
+		run:      run,
+	}
+	e.mtx.Lock()
+	e.jobs[name] = j
+	e.mtx.Unlock()
+	e.schedule(j)
+}
+
+// chain registers a job that runs once the job named after succeeded.
+func (e *engine) chain(name string, after string, opts jobOptions, run func(rc *runContext) error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	j := &job{
+		name:  name,
+		after: after,
+		opts:  opts,
+		run:   run,
+	}
+	e.jobs[name] = j
+	e.chained = append(e.chained, j)
+}
+
+// link attaches the chained jobs to their upstream job.
+func (e *engine) link() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	var errs []error
+	for _, j := range e.chained {
+		upstream, ok := e.jobs[j.after]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: no such job %s", j.name, j.after))
+			continue
+		}
+		upstream.then = append(upstream.then, j)
+	}
+	e.chained = nil
+	return errors.Join(errs...)
+}
+
+// remove unregisters a job.  If the job is running, it completes but is
+// not scheduled again, and the jobs chained to it no longer run.
+func (e *engine) remove(name string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	j, ok := e.jobs[name]
+	if !ok {
+		return
+	}
+	delete(e.jobs, name)
+	j.removed = true
+
+	if j.index >= 0 && j.index < len(e.queue) && e.queue[j.index] == j {
+		heap.Remove(&e.queue, j.index)
+	}
+	if upstream, ok := e.jobs[j.after]; ok {
+		upstream.then = slices.DeleteFunc(upstream.then, func(then *job) bool {
+			return then == j
+		})
+	}
+	e.chained = slices.DeleteFunc(e.chained, func(chained *job) bool {
+		return chained == j
+	})
+
+	// the next run of a job registered again under the same name follows
+	// its new schedule.
+	if e.state != nil {
+		if err := e.state.SetNextRun(name, time.Time{}); err != nil {
+			e.ctx.GetLogger().Warn("failed to save scheduler state: %s", err)
+		}
+	}
+}
+
+// downstream returns the jobs to run once j succeeded.
+func (e *engine) downstream(j *job) []*job {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	var then []*job
+	for _, downstream := range j.then {
+		if !downstream.removed {
+			then = append(then, downstream)
+		}
+	}
+	return then
+}
+
+// begin waits until no job named name is running, then marks it as
+// running until end is called.
+func (e *engine) begin(name string) error {
+	for {
+		e.mtx.Lock()
+		done, ok := e.running[name]
+		if !ok {
+			e.running[name] = make(chan struct{})
+			e.mtx.Unlock()
+			return nil
+		}
+		e.mtx.Unlock()
+
+		select {
+		case <-done:
+		case <-e.ctx.Done():
+			return e.ctx.Err()
+		}
+	}
+}
+
+func (e *engine) end(name string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	close(e.running[name])
+	delete(e.running, name)
+}
+
+// execute runs a job once, as soon as the previous instance of a job
+// registered again under the same name is over and it doesn't conflict
+// with the other running jobs, and records its outcome.
+func (e *engine) execute(j *job, rc *runContext) error {
+	queued := time.Now()
+	if err := e.begin(j.name); err != nil {
+		return err
+	}
+	defer e.end(j.name)
+
+	waited, err := e.limiter.acquire(e.ctx, j.opts.repositories, j.opts.exclusive)
+	if err != nil {
+		return err
+	}
+	defer e.limiter.release(j.opts.repositories, j.opts.exclusive)
+	if waited {
+		e.ctx.GetLogger().Info("%s: started after waiting %s for conflicting jobs",
+			j.name, time.Since(queued).Round(time.Second))
+	}
+
+	start := time.Now()
+	if e.state != nil {
+		if err := e.state.RunStarted(j.name, start); err != nil {
+			e.ctx.GetLogger().Warn("failed to save scheduler state: %s", err)
+		}
+	}
+
+	err = j.run(rc)
+
+	// don't record runs interrupted by the scheduler shutdown, so
+	// that they are caught up on the next start.
+	if e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+	if e.state != nil {
+		if err := e.state.RunDone(j.name, start, err); err != nil {
+			e.ctx.GetLogger().Warn("failed to save scheduler state: %s", err)
+		}
+	}
+	return err
+}
+
+// runChain runs the jobs chained to a job that succeeded, one after the
+// other.  Since they have no schedule of their own, failed runs are
+// retried in place.
+func (e *engine) runChain(jobs []*job, upstream *runContext) {
+	for _, j := range jobs {
+		rc := &runContext{snapshotID: upstream.snapshotID}
+		for rc.attempt = 1; ; rc.attempt++ {
+			err := e.execute(j, rc)
+			if e.ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				e.runChain(e.downstream(j), rc)
+				break
+			}
+			if rc.attempt > int(j.opts.retry.Attempts) {
+				e.ctx.GetLogger().Warn("%s: run failed, skipping the jobs chained to it", j.name)
+				break
+			}
+
+			delay := j.opts.retry.delay(rc.attempt - 1)
+			e.ctx.GetLogger().Warn("%s: run failed, retry %d/%d in %s",
+				j.name, rc.attempt, j.opts.retry.Attempts, delay)
+			select {
+			case <-time.After(delay):
+			case <-e.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (e *engine) dispatch(j *job) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		rc := &runContext{attempt: j.attempt + 1}
+		err := e.execute(j, rc)
+		if e.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			e.runChain(e.downstream(j), rc)
+			if e.ctx.Err() != nil {
+				return
+			}
+		}
+
+		now := time.Now()
+		j.next = j.opts.activation(j.schedule.Next(now))
+
+		// failed runs are retried as long as they don't collide with the
+		// next scheduled activation.
+		if err != nil && j.attempt < int(j.opts.retry.Attempts) {
+			delay := j.opts.retry.delay(j.attempt)
+			if retry := j.opts.windows.next(now.Add(delay)); j.next.IsZero() || retry.Before(j.next) {
+				j.attempt++
+				e.ctx.GetLogger().Warn("%s: run failed, retry %d/%d in %s",
+					j.name, j.attempt, j.opts.retry.Attempts, delay)
+				j.next = retry
+				e.schedule(j)
+				return
+			}
+		}
+		j.attempt = 0
+		e.schedule(j)
+	}()
+}
+
+// run dispatches jobs until the context is cancelled, then waits for the
+// jobs that are still running.
+func (e *engine) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		var tick <-chan time.Time
+
+		e.mtx.Lock()
+		now := time.Now()
+		for len(e.queue) > 0 && !e.queue[0].next.After(now) {
+			e.dispatch(heap.Pop(&e.queue).(*job))
+		}
+		if len(e.queue) > 0 {
+			timer.Reset(e.queue[0].next.Sub(now))
+			tick = timer.C
+		}
+		e.mtx.Unlock()
+
+		select {
+		case <-e.ctx.Done():
+			e.wg.Wait()
+			return
+		case <-e.wakeup:
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds the number of jobs running in parallel and serialises the
+// jobs that conflict on a repository: a job holding a repository
+// exclusively, such as a maintenance, never runs alongside another job on
+// that repository.  Jobs that can't run yet are queued and started in order,
+// a job never overtakes a queued job it conflicts with so that exclusive
+// jobs are not starved.
+type limiter struct {
+	mtx     sync.Mutex
+	max     int
+	running int
+	// number of jobs running on each repository, -1 if held exclusively
+	repositories map[string]int
+	waiters      []*waiter
+}
+
+type waiter struct {
+	repositories []string
+	exclusive    bool
+	ready        chan struct{}
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{
+		max:          max,
+		repositories: make(map[string]int),
+	}
+}
+
+// setMax changes the number of jobs allowed to run at once, the jobs
+// already running are not interrupted.
+func (l *limiter) setMax(max int) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.max = max
+	l.grant()
+}
+
+func (l *limiter) fits(w *waiter) bool {
+	if l.max > 0 && l.running >= l.max {
+		return false
+	}
+	for _, repository := range w.repositories {
+		n := l.repositories[repository]
+		if n < 0 || (w.exclusive && n > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *limiter) take(w *waiter) {
+	l.running++
+	for _, repository := range w.repositories {
+		if w.exclusive {
+			l.repositories[repository] = -1
+		} else {
+			l.repositories[repository]++
+		}
+	}
+}
+
+// grant starts the queued jobs that can run, in order.  Must be called
+// with the mutex held.
+func (l *limiter) grant() {
+	blocked := make(map[string]bool)
+	var waiters []*waiter
+	for i, w := range l.waiters {
+		if l.max > 0 && l.running >= l.max {
+			waiters = append(waiters, l.waiters[i:]...)
+			break
+		}
+
+		conflict := false
+		for _, repository := range w.repositories {
+			conflict = conflict || blocked[repository]
+		}
+		if !conflict && l.fits(w) {
+			l.take(w)
+			close(w.ready)
+			continue
+		}
+
+		for _, repository := range w.repositories {
+			blocked[repository] = true
+		}
+		waiters = append(waiters, w)
+	}
+	l.waiters = waiters
+}
+
+// acquire blocks until the job can run on the given repositories.  It
+// returns whether the job had to wait, or an error if ctx was cancelled.
+func (l *limiter) acquire(ctx context.Context, repositories []string, exclusive bool) (bool, error) {
+	w := &waiter{
+		repositories: repositories,
+		exclusive:    exclusive,
+		ready:        make(chan struct{}),
+	}
+
+	l.mtx.Lock()
+	l.waiters = append(l.waiters, w)
+	l.grant()
+	l.mtx.Unlock()
+
+	select {
+	case <-w.ready:
+		return false, nil
+	default:
+	}
+
+	select {
+	case <-w.ready:
+		return true, nil
+	case <-ctx.Done():
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		select {
+		case <-w.ready:
+			// granted in the meantime
+			l.free(w)
+		default:
+			for i := range l.waiters {
+				if l.waiters[i] == w {
+					l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		l.grant()
+		return true, ctx.Err()
+	}
+}
+
+func (l *limiter) free(w *waiter) {
+	l.running--
+	for _, repository := range w.repositories {
+		if w.exclusive {
+			delete(l.repositories, repository)
+		} else if l.repositories[repository]--; l.repositories[repository] == 0 {
+			delete(l.repositories, repository)
+		}
+	}
+}
+
+func (l *limiter) release(repositories []string, exclusive bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.free(&waiter{repositories: repositories, exclusive: exclusive})
+	l.grant()
+}
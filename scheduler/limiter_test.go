@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterExclusive(t *testing.T) {
+	l := newLimiter(0)
+	ctx := context.Background()
+
+	waited, err := l.acquire(ctx, []string{"repo"}, false)
+	require.NoError(t, err)
+	require.False(t, waited)
+
+	// the maintenance waits for the running backup
+	maintenance := make(chan struct{})
+	go func() {
+		l.acquire(ctx, []string{"repo"}, true)
+		close(maintenance)
+	}()
+	require.Eventually(t, func() bool {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		return len(l.waiters) == 1
+	}, time.Second, time.Millisecond)
+
+	// jobs on other repositories are not held back
+	waited, err = l.acquire(ctx, []string{"other"}, false)
+	require.NoError(t, err)
+	require.False(t, waited)
+
+	// but a new job on the repository doesn't overtake the maintenance
+	backup := make(chan struct{})
+	go func() {
+		l.acquire(ctx, []string{"repo"}, false)
+		close(backup)
+	}()
+	require.Eventually(t, func() bool {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		return len(l.waiters) == 2
+	}, time.Second, time.Millisecond)
+
+	l.release([]string{"repo"}, false)
+	<-maintenance
+	select {
+	case <-backup:
+		t.Fatal("backup running alongside maintenance")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.release([]string{"repo"}, true)
+	<-backup
+}
+
+func TestLimiterMaxParallel(t *testing.T) {
+	l := newLimiter(1)
+
+	waited, err := l.acquire(context.Background(), []string{"a"}, false)
+	require.NoError(t, err)
+	require.False(t, waited)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, []string{"b"}, false)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Empty(t, l.waiters)
+
+	l.release([]string{"a"}, false)
+	waited, err = l.acquire(context.Background(), []string{"b"}, false)
+	require.NoError(t, err)
+	require.False(t, waited)
+	require.Equal(t, 1, l.running)
+}
@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schedule computes the activation times of a task.
+type Schedule interface {
+	// Next returns the next activation strictly after t, or the zero
+	// time if the task should not run again.
+	Next(t time.Time) time.Time
+}
+
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s *intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+const DefaultRetryBackoff = time.Minute
+
+// RetryConfig describes how many times a failed run is retried before the
+// next scheduled activation.  The delay before each retry starts at
+// Backoff and doubles every time, up to MaxBackoff if set.
+type RetryConfig struct {
+	Attempts   uint
+	Backoff    time.Duration
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+// delay returns how long to wait before the given retry, counted from 0.
+func (rc RetryConfig) delay(retry int) time.Duration {
+	delay := rc.Backoff
+	if delay <= 0 {
+		delay = DefaultRetryBackoff
+	}
+	for range retry {
+		if rc.MaxBackoff > 0 && delay >= rc.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if rc.MaxBackoff > 0 && delay > rc.MaxBackoff {
+		delay = rc.MaxBackoff
+	}
+	return delay
+}
+
+// ScheduleConfig is embedded in every task configuration and describes
+// when the task runs: either every Interval, whenever the cron expression
+// in Cron matches, evaluated in Timezone, or once the step of the task set
+// named in After succeeded.  Catchup overrides the agent-wide setting for
+// runs missed while the scheduler was down and Retry controls what happens
+// when a run fails.  Each activation is delayed by a random duration of up
+// to Jitter, and deferred to the opening of the next Window if it falls
+// outside of all of them.
+type ScheduleConfig struct {
+	Interval time.Duration `validate:"required_without_all=Cron After,excluded_with=Cron After"`
+	Cron     string        `mapstructure:"schedule" validate:"excluded_with=After"`
+	Timezone string        `validate:"omitempty,excluded_without_all=Cron Window,timezone"`
+	After    string
+	Catchup  *bool
+	Retry    RetryConfig
+	Jitter   time.Duration `validate:"gte=0,excluded_with=After"`
+	Window   []string      `validate:"excluded_with=After"`
+}
+
+func (sc ScheduleConfig) location() (*time.Location, error) {
+	if sc.Timezone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(sc.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", sc.Timezone, err)
+	}
+	return location, nil
+}
+
+func (sc ScheduleConfig) NewSchedule() (Schedule, error) {
+	if sc.Cron == "" {
+		if sc.Interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %s", sc.Interval)
+		}
+		return &intervalSchedule{interval: sc.Interval}, nil
+	}
+
+	location, err := sc.location()
+	if err != nil {
+		return nil, err
+	}
+	return parseCron(sc.Cron, location)
+}
+
+// newTimeWindows returns the windows the activations are restricted to,
+// or nil if they are not restricted.
+func (sc ScheduleConfig) newTimeWindows() (*timeWindows, error) {
+	location, err := sc.location()
+	if err != nil {
+		return nil, err
+	}
+	return newTimeWindows(sc.Window, location)
+}
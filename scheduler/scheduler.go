@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"reflect"
 	"sync"
 	"time"
 
@@ -13,6 +14,8 @@ type Scheduler struct {
 	ctx      *appcontext.AppContext
 	wg       sync.WaitGroup
 	reporter *reporting.Reporter
+	engine   *engine
+	mtx      sync.Mutex
 }
 
 func stringToDuration(s string) (time.Duration, error) {
@@ -33,29 +36,125 @@ func NewScheduler(ctx *appcontext.AppContext, config *Configuration) *Scheduler
 
 func (s *Scheduler) Run() {
 	s.reporter = reporting.NewReporter(s.ctx)
+	s.reporter.RetrySpooled()
+
+	state, err := LoadState(s.ctx.CacheDir)
+	if err != nil {
+		s.ctx.GetLogger().Warn("could not load scheduler state, starting afresh: %s", err)
+		state = NewState(s.ctx.CacheDir)
+	}
+
+	s.mtx.Lock()
+	s.engine = newEngine(s.ctx, state, s.config.Agent.MaxParallel)
 
 	for _, cleanupCfg := range s.config.Agent.Maintenance {
-		go s.maintenanceTask(cleanupCfg)
+		if err := s.maintenanceTask(cleanupCfg); err != nil {
+			s.ctx.GetLogger().Error("maintenance of %s: %s", cleanupCfg.Repository, err)
+		}
 	}
 
 	for _, tasksetCfg := range s.config.Agent.Tasks {
-		if tasksetCfg.Backup != nil {
-			go s.backupTask(tasksetCfg, *tasksetCfg.Backup)
+		s.taskset(tasksetCfg)
+	}
+
+	if err := s.engine.link(); err != nil {
+		s.ctx.GetLogger().Error("%s", err)
+	}
+	s.mtx.Unlock()
+
+	s.engine.run()
+	s.reporter.StopAndWait()
+}
+
+// taskset registers the jobs of all the steps of a task set.
+func (s *Scheduler) taskset(tasksetCfg Task) {
+	if tasksetCfg.Backup != nil {
+		if err := s.backupTask(tasksetCfg, *tasksetCfg.Backup); err != nil {
+			s.ctx.GetLogger().Error("backup task %s: %s", tasksetCfg.Name, err)
 		}
+	}
 
-		for _, checkCfg := range tasksetCfg.Check {
-			go s.checkTask(tasksetCfg, checkCfg)
+	for i, checkCfg := range tasksetCfg.Check {
+		if err := s.checkTask(tasksetCfg, checkCfg, i); err != nil {
+			s.ctx.GetLogger().Error("check task %s: %s", tasksetCfg.Name, err)
 		}
+	}
 
-		for _, restoreCfg := range tasksetCfg.Restore {
-			go s.restoreTask(tasksetCfg, restoreCfg)
+	for i, restoreCfg := range tasksetCfg.Restore {
+		if err := s.restoreTask(tasksetCfg, restoreCfg, i); err != nil {
+			s.ctx.GetLogger().Error("restore task %s: %s", tasksetCfg.Name, err)
 		}
+	}
 
-		for _, syncCfg := range tasksetCfg.Sync {
-			go s.syncTask(tasksetCfg, syncCfg)
+	for i, syncCfg := range tasksetCfg.Sync {
+		if err := s.syncTask(tasksetCfg, syncCfg, i); err != nil {
+			s.ctx.GetLogger().Error("sync task %s: %s", tasksetCfg.Name, err)
 		}
 	}
+}
 
-	<-s.ctx.Done()
-	s.reporter.StopAndWait()
+// Reload switches the scheduler to a new configuration.  Only the task
+// sets and maintenance tasks whose configuration changed are stopped and
+// started again, their running jobs are allowed to complete before the
+// new ones run.
+func (s *Scheduler) Reload(config *Configuration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	old := s.config
+	s.config = config
+	if s.engine == nil {
+		// not running yet, the new configuration is used on startup
+		return nil
+	}
+
+	if config.Agent.MaxParallel != old.Agent.MaxParallel {
+		s.engine.limiter.setMax(config.Agent.MaxParallel)
+	}
+
+	maintenances := make(map[string]MaintenanceConfig)
+	for _, cleanupCfg := range config.Agent.Maintenance {
+		maintenances[cleanupCfg.Repository] = cleanupCfg
+	}
+	for _, cleanupCfg := range old.Agent.Maintenance {
+		if newCfg, ok := maintenances[cleanupCfg.Repository]; ok && reflect.DeepEqual(cleanupCfg, newCfg) {
+			delete(maintenances, cleanupCfg.Repository)
+			continue
+		}
+		s.ctx.GetLogger().Info("stopping maintenance of %s", cleanupCfg.Repository)
+		s.engine.remove("maintenance:" + cleanupCfg.Repository)
+	}
+	for _, cleanupCfg := range config.Agent.Maintenance {
+		if _, ok := maintenances[cleanupCfg.Repository]; !ok {
+			continue
+		}
+		s.ctx.GetLogger().Info("starting maintenance of %s", cleanupCfg.Repository)
+		if err := s.maintenanceTask(cleanupCfg); err != nil {
+			s.ctx.GetLogger().Error("maintenance of %s: %s", cleanupCfg.Repository, err)
+		}
+	}
+
+	tasksets := make(map[string]Task)
+	for _, tasksetCfg := range config.Agent.Tasks {
+		tasksets[tasksetCfg.Name] = tasksetCfg
+	}
+	for _, tasksetCfg := range old.Agent.Tasks {
+		if newCfg, ok := tasksets[tasksetCfg.Name]; ok && reflect.DeepEqual(tasksetCfg, newCfg) {
+			delete(tasksets, tasksetCfg.Name)
+			continue
+		}
+		s.ctx.GetLogger().Info("stopping task %s", tasksetCfg.Name)
+		for _, name := range tasksetCfg.jobNames() {
+			s.engine.remove(name)
+		}
+	}
+	for _, tasksetCfg := range config.Agent.Tasks {
+		if _, ok := tasksets[tasksetCfg.Name]; !ok {
+			continue
+		}
+		s.ctx.GetLogger().Info("starting task %s", tasksetCfg.Name)
+		s.taskset(tasksetCfg)
+	}
+
+	return s.engine.link()
 }
@@ -0,0 +1,167 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_VERSION = "1.0.0"
+
+	// number of past runs kept for each task
+	stateHistorySize = 10
+)
+
+type RunStatus string
+
+const (
+	RunRunning RunStatus = "RUNNING"
+	RunOK      RunStatus = "OK"
+	RunFailed  RunStatus = "FAILED"
+)
+
+type Run struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Status   RunStatus     `json:"status"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type TaskState struct {
+	NextRun time.Time `json:"next_run"`
+	LastRun *Run      `json:"last_run,omitempty"`
+	History []Run     `json:"history,omitempty"`
+}
+
+// State is the scheduler run history, persisted in the cache directory so
+// that it survives restarts of the scheduler.
+type State struct {
+	Version string                `json:"version"`
+	Tasks   map[string]*TaskState `json:"tasks"`
+
+	path string
+	mtx  sync.Mutex
+}
+
+func StatePath(cacheDir string) string {
+	return filepath.Join(cacheDir, "scheduler-state.json")
+}
+
+func NewState(cacheDir string) *State {
+	return &State{
+		Version: STATE_VERSION,
+		Tasks:   make(map[string]*TaskState),
+		path:    StatePath(cacheDir),
+	}
+}
+
+func LoadState(cacheDir string) (*State, error) {
+	state := NewState(cacheDir)
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", state.path, err)
+	}
+	if state.Version != STATE_VERSION {
+		return nil, fmt.Errorf("unsupported scheduler state version %q", state.Version)
+	}
+	if state.Tasks == nil {
+		state.Tasks = make(map[string]*TaskState)
+	}
+
+	return state, nil
+}
+
+func (s *State) get(name string) *TaskState {
+	ts, ok := s.Tasks[name]
+	if !ok {
+		ts = &TaskState{}
+		s.Tasks[name] = ts
+	}
+	return ts
+}
+
+// NextRun returns the activation time recorded for the task, if any.
+func (s *State) NextRun(name string) time.Time {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if ts, ok := s.Tasks[name]; ok {
+		return ts.NextRun
+	}
+	return time.Time{}
+}
+
+func (s *State) SetNextRun(name string, next time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.get(name).NextRun = next
+	return s.save()
+}
+
+func (s *State) RunStarted(name string, start time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.get(name).LastRun = &Run{
+		Start:  start,
+		Status: RunRunning,
+	}
+	return s.save()
+}
+
+func (s *State) RunDone(name string, start time.Time, runErr error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	run := Run{
+		Start:    start,
+		Duration: time.Since(start),
+		Status:   RunOK,
+	}
+	if runErr != nil {
+		run.Status = RunFailed
+		run.Error = runErr.Error()
+	}
+
+	ts := s.get(name)
+	ts.LastRun = &run
+	ts.History = append(ts.History, run)
+	if len(ts.History) > stateHistorySize {
+		ts.History = ts.History[len(ts.History)-stateHistorySize:]
+	}
+	return s.save()
+}
+
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
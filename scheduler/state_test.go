@@ -0,0 +1,278 @@
+package scheduler
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	state, err := LoadState(cacheDir)
+	require.NoError(t, err)
+	require.Empty(t, state.Tasks)
+
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, state.SetNextRun("backup:foo", next))
+	for i := range stateHistorySize + 5 {
+		var runErr error
+		if i%2 == 0 {
+			runErr = errors.New("boom")
+		}
+		require.NoError(t, state.RunStarted("backup:foo", time.Now()))
+		require.NoError(t, state.RunDone("backup:foo", time.Now(), runErr))
+	}
+
+	state, err = LoadState(cacheDir)
+	require.NoError(t, err)
+	ts := state.Tasks["backup:foo"]
+	require.NotNil(t, ts)
+	require.True(t, next.Equal(ts.NextRun))
+	require.Len(t, ts.History, stateHistorySize)
+	require.Equal(t, RunFailed, ts.LastRun.Status)
+	require.Equal(t, "boom", ts.LastRun.Error)
+}
+
+func TestEngineCatchup(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	state := NewState(cacheDir)
+	require.NoError(t, state.SetNextRun("missed", time.Now().Add(-time.Hour)))
+	require.NoError(t, state.SetNextRun("skipped", time.Now().Add(-time.Hour)))
+
+	ctx := appcontext.NewAppContext()
+	ctx.CacheDir = cacheDir
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	e := newEngine(ctx, state, 0)
+
+	ran := make(chan string, 2)
+	e.add("missed", &intervalSchedule{time.Hour}, jobOptions{catchup: true}, func(*runContext) error {
+		ran <- "missed"
+		return nil
+	})
+	e.add("skipped", &intervalSchedule{time.Hour}, jobOptions{}, func(*runContext) error {
+		ran <- "skipped"
+		return nil
+	})
+
+	go e.run()
+	defer ctx.Cancel()
+
+	select {
+	case name := <-ran:
+		require.Equal(t, "missed", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("missed run was not caught up")
+	}
+
+	require.Eventually(t, func() bool {
+		return state.NextRun("missed").After(time.Now())
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, state.NextRun("skipped").After(time.Now()))
+}
+
+func TestEngineRetry(t *testing.T) {
+	state := NewState(t.TempDir())
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	e := newEngine(ctx, state, 0)
+
+	// make the job due right away
+	require.NoError(t, state.SetNextRun("failing", time.Now().Add(-time.Minute)))
+
+	attempts := make(chan int, 10)
+	opts := jobOptions{
+		catchup: true,
+		retry:   RetryConfig{Attempts: 2, Backoff: 10 * time.Millisecond},
+	}
+	e.add("failing", &intervalSchedule{time.Hour}, opts, func(rc *runContext) error {
+		attempts <- rc.attempt
+		return errors.New("boom")
+	})
+
+	go e.run()
+	defer ctx.Cancel()
+
+	for _, expected := range []int{1, 2, 3} {
+		select {
+		case attempt := <-attempts:
+			require.Equal(t, expected, attempt)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d did not run", expected)
+		}
+	}
+
+	// once the retries are exhausted, the job waits for its next slot
+	require.Eventually(t, func() bool {
+		return state.NextRun("failing").After(time.Now().Add(time.Minute))
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, state.Tasks["failing"].History, 3)
+}
+
+func TestRetryDelay(t *testing.T) {
+	rc := RetryConfig{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	require.Equal(t, time.Second, rc.delay(0))
+	require.Equal(t, 2*time.Second, rc.delay(1))
+	require.Equal(t, 4*time.Second, rc.delay(2))
+	require.Equal(t, 5*time.Second, rc.delay(3))
+	require.Equal(t, 5*time.Second, rc.delay(100))
+	require.Equal(t, DefaultRetryBackoff, RetryConfig{}.delay(0))
+}
+
+func TestEngineChain(t *testing.T) {
+	state := NewState(t.TempDir())
+	require.NoError(t, state.SetNextRun("backup", time.Now().Add(-time.Minute)))
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	e := newEngine(ctx, state, 0)
+
+	snapshotID := objects.MAC{1, 2, 3}
+	ran := make(chan string, 10)
+	e.add("backup", &intervalSchedule{time.Hour}, jobOptions{catchup: true}, func(rc *runContext) error {
+		ran <- "backup"
+		rc.snapshotID = snapshotID
+		return nil
+	})
+	e.chain("check", "backup", jobOptions{}, func(rc *runContext) error {
+		require.Equal(t, snapshotID, rc.snapshotID)
+		ran <- "check"
+		return errors.New("boom")
+	})
+	e.chain("restore", "check", jobOptions{}, func(rc *runContext) error {
+		ran <- "restore"
+		return nil
+	})
+	e.chain("sync", "backup", jobOptions{}, func(rc *runContext) error {
+		require.Equal(t, snapshotID, rc.snapshotID)
+		ran <- "sync"
+		return nil
+	})
+	e.chain("orphan", "unknown", jobOptions{}, func(rc *runContext) error {
+		return nil
+	})
+	require.Error(t, e.link())
+
+	go e.run()
+	defer ctx.Cancel()
+
+	// the restore is skipped since the check it depends on failed
+	for _, expected := range []string{"backup", "check", "sync"} {
+		select {
+		case name := <-ran:
+			require.Equal(t, expected, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not run", expected)
+		}
+	}
+	require.Eventually(t, func() bool {
+		return state.NextRun("backup").After(time.Now())
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, ran)
+	require.Equal(t, RunFailed, state.Tasks["check"].LastRun.Status)
+	require.Equal(t, RunOK, state.Tasks["sync"].LastRun.Status)
+}
+
+func TestEngineRemove(t *testing.T) {
+	state := NewState(t.TempDir())
+	require.NoError(t, state.SetNextRun("backup", time.Now().Add(-time.Minute)))
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	e := newEngine(ctx, state, 0)
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+	ran := make(chan string, 10)
+	e.add("backup", &intervalSchedule{time.Millisecond}, jobOptions{catchup: true}, func(rc *runContext) error {
+		ran <- "backup"
+		close(running)
+		<-done
+		return nil
+	})
+	e.chain("check", "backup", jobOptions{}, func(rc *runContext) error {
+		ran <- "check"
+		return nil
+	})
+	e.add("other", &intervalSchedule{time.Hour}, jobOptions{}, func(rc *runContext) error {
+		return nil
+	})
+	require.NoError(t, e.link())
+
+	go e.run()
+	defer ctx.Cancel()
+
+	// the running job completes but is neither rescheduled nor followed
+	// by the jobs chained to it
+	<-running
+	e.remove("backup")
+	e.remove("check")
+	close(done)
+
+	select {
+	case name := <-ran:
+		require.Equal(t, "backup", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backup did not run")
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, ran)
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	require.Len(t, e.queue, 1)
+	require.Equal(t, "other", e.queue[0].name)
+	require.NotContains(t, e.jobs, "backup")
+	require.True(t, state.NextRun("backup").IsZero())
+}
+
+func TestEngineReplace(t *testing.T) {
+	state := NewState(t.TempDir())
+	require.NoError(t, state.SetNextRun("backup", time.Now().Add(-time.Minute)))
+
+	ctx := appcontext.NewAppContext()
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	e := newEngine(ctx, state, 0)
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+	ran := make(chan string, 10)
+	e.add("backup", &intervalSchedule{time.Hour}, jobOptions{catchup: true}, func(rc *runContext) error {
+		close(running)
+		<-done
+		ran <- "old"
+		return nil
+	})
+
+	go e.run()
+	defer ctx.Cancel()
+
+	// the job registered again under the same name waits for the run of
+	// the previous one to complete
+	<-running
+	e.remove("backup")
+	e.add("backup", &intervalSchedule{time.Millisecond}, jobOptions{}, func(rc *runContext) error {
+		ran <- "new"
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, ran)
+	close(done)
+
+	for _, expected := range []string{"old", "new"} {
+		select {
+		case name := <-ran:
+			require.Equal(t, expected, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not run", expected)
+		}
+	}
+}
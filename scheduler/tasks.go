@@ -1,146 +1,349 @@
 package scheduler
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/plakar/agent"
 	"github.com/PlakarKorp/plakar/subcommands"
 	"github.com/PlakarKorp/plakar/subcommands/backup"
 	"github.com/PlakarKorp/plakar/subcommands/check"
 	"github.com/PlakarKorp/plakar/subcommands/maintenance"
+	"github.com/PlakarKorp/plakar/subcommands/prune"
 	"github.com/PlakarKorp/plakar/subcommands/restore"
 	"github.com/PlakarKorp/plakar/subcommands/rm"
 	"github.com/PlakarKorp/plakar/subcommands/sync"
+	"github.com/PlakarKorp/plakar/throttle"
+	"github.com/PlakarKorp/plakar/utils"
 )
 
-func (s *Scheduler) backupTask(taskset Task, task BackupConfig) {
+// rpcError folds the results of agent.ExecuteRPC into a single error.
+func rpcError(retval int, err error) error {
+	if err != nil {
+		return err
+	}
+	if retval != 0 {
+		return fmt.Errorf("command exited with status %d", retval)
+	}
+	return nil
+}
+
+// pruneSubcommand resolves a retention policy, named in policies.yml and
+// whose periods can be overridden inline, into a prune subcommand.
+func (s *Scheduler) pruneSubcommand(policy string, periods *locate.LocatePeriods) (*prune.Prune, error) {
+	opts := locate.NewDefaultLocateOptions()
+	if policy != "" {
+		cfg, err := utils.LoadPolicyConfigFile(filepath.Join(s.ctx.ConfigDir, "policies.yml"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policies config: %w", err)
+		}
+		if !cfg.Has(policy) {
+			return nil, fmt.Errorf("policy %q not found", policy)
+		}
+		cfg.ApplyConfig(policy, opts)
+	}
+	if periods != nil {
+		prune.MergePolicyOptions(opts, &locate.LocateOptions{Periods: *periods})
+	}
+	if opts.Empty() {
+		return nil, fmt.Errorf("empty retention policy")
+	}
+
+	pruneSubcommand := &prune.Prune{}
+	pruneSubcommand.Apply = true
+	pruneSubcommand.Flags = subcommands.AgentSupport
+	pruneSubcommand.LocateOptions = opts
+	return pruneSubcommand, nil
+}
+
+// repositoryKey identifies a repository by its location, so that the
+// jobs referring to it by different names are known to conflict.
+func (s *Scheduler) repositoryKey(name string) string {
+	if s.ctx.Config != nil {
+		if storeConfig, err := s.ctx.Config.GetRepository(name); err == nil {
+			return storeConfig["location"]
+		}
+	}
+	return name
+}
+
+// jobOptions returns the options of a job operating on the given
+// repositories.
+func (s *Scheduler) jobOptions(sc ScheduleConfig, repositories ...string) (jobOptions, error) {
+	windows, err := sc.newTimeWindows()
+	if err != nil {
+		return jobOptions{}, err
+	}
+
+	opts := jobOptions{
+		catchup: s.config.Agent.Catchup,
+		retry:   sc.Retry,
+		jitter:  sc.Jitter,
+		windows: windows,
+	}
+	if sc.Catchup != nil {
+		opts.catchup = *sc.Catchup
+	}
+	for _, repository := range repositories {
+		opts.repositories = append(opts.repositories, s.repositoryKey(repository))
+	}
+	return opts, nil
+}
+
+// register adds the job of a step to the engine, either on its own
+// schedule or chained to an upstream step of the task set.
+func (s *Scheduler) register(taskset Task, name string, sc ScheduleConfig, opts jobOptions, run func(rc *runContext) error) error {
+	if sc.After != "" {
+		upstream, err := taskset.jobName(sc.After)
+		if err != nil {
+			return err
+		}
+		s.engine.chain(name, upstream, opts, run)
+		return nil
+	}
+
+	schedule, err := sc.NewSchedule()
+	if err != nil {
+		return err
+	}
+	s.engine.add(name, schedule, opts, run)
+	return nil
+}
+
+// snapshotArgs returns the snapshot arguments of a step: the snapshot
+// created upstream if any, or the snapshots matching its filters.
+func snapshotArgs(rc *runContext, path string) []string {
+	if rc.snapshotID != (objects.MAC{}) {
+		return []string{fmt.Sprintf("%x:%s", rc.snapshotID, path)}
+	}
+	if path != "" {
+		return []string{":" + path}
+	}
+	return nil
+}
+
+// limit returns the rate of a limit of the configuration, which has been
+// validated already.
+func limit(rate string) int64 {
+	n, _ := throttle.ParseRate(rate)
+	return n
+}
+
+func (s *Scheduler) backupTask(taskset Task, task BackupConfig) error {
 	backupSubcommand := &backup.Backup{}
 	backupSubcommand.Flags = subcommands.AgentSupport
+	backupSubcommand.SetTaskName(taskset.Name)
 	backupSubcommand.Silent = true
 	backupSubcommand.Job = taskset.Name
+	backupSubcommand.Name = task.Name
+	backupSubcommand.Category = task.Category
+	backupSubcommand.Environment = task.Environment
+	backupSubcommand.Perimeter = task.Perimeter
+	backupSubcommand.Labels = task.Labels
+	backupSubcommand.Tags = task.Tags
+	backupSubcommand.Concurrency = task.Concurrency
 	backupSubcommand.Path = task.Path
+	if task.Source != "" {
+		backupSubcommand.Path = "@" + task.Source
+	}
 	backupSubcommand.Quiet = true
+	backupSubcommand.PlakarIgnore = task.PlakarIgnore
+	backupSubcommand.ExcludeIf = task.ExcludeIf
 	backupSubcommand.Opts = make(map[string]string)
+	for k, v := range task.Options {
+		backupSubcommand.Opts[k] = v
+	}
 	if task.Check.Enabled {
 		backupSubcommand.OptCheck = true
 	}
+	backupSubcommand.PreHook = task.PreHook
+	backupSubcommand.PostHook = task.PostHook
+	backupSubcommand.FailHook = task.FailHook
+	backupSubcommand.HookTimeout = task.HookTimeout
+	backupSubcommand.LimitUpload = limit(task.LimitUpload)
+	backupSubcommand.LimitDownload = limit(task.LimitDownload)
+	backupSubcommand.LimitRead = limit(task.LimitRead)
+	switch task.DiskBased {
+	case "", "off":
+	case "on":
+		backupSubcommand.OnDiskPackfilePath = os.TempDir()
+	default:
+		backupSubcommand.OnDiskPackfilePath = task.DiskBased
+	}
 
 	rmSubcommand := &rm.Rm{}
 	rmSubcommand.Apply = true
 	rmSubcommand.Flags = subcommands.AgentSupport
-	rmSubcommand.LocateOptions = locate.NewDefaultLocateOptions(locate.WithJob(task.Name))
-
-	for {
-		tick := time.After(task.Interval)
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-tick:
-
-			var excludes []string
-			if task.IgnoreFile != "" {
-				lines, err := backup.LoadIgnoreFile(task.IgnoreFile)
-				if err != nil {
-					s.ctx.GetLogger().Error("Failed to load ignore file: %s", err)
-					continue
-				}
-				for _, line := range lines {
-					excludes = append(excludes, line)
-				}
+	rmSubcommand.SetTaskName(taskset.Name)
+	rmSubcommand.LocateOptions = locate.NewDefaultLocateOptions(locate.WithJob(taskset.Name))
+
+	opts, err := s.jobOptions(task.ScheduleConfig, taskset.Repository)
+	if err != nil {
+		return err
+	}
+	return s.register(taskset, "backup:"+taskset.Name, task.ScheduleConfig, opts, func(rc *runContext) error {
+		var excludes []string
+		if task.IgnoreFile != "" {
+			lines, err := backup.LoadIgnoreFile(task.IgnoreFile)
+			if err != nil {
+				s.ctx.GetLogger().Error("Failed to load ignore file: %s", err)
+				return err
 			}
-			for _, line := range task.Ignore {
+			for _, line := range lines {
 				excludes = append(excludes, line)
 			}
-			backupSubcommand.Excludes = excludes
+		}
+		for _, line := range task.Ignore {
+			excludes = append(excludes, line)
+		}
+		backupSubcommand.Excludes = excludes
+		backupSubcommand.SetAttempt(rc.attempt)
 
-			storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
-			if err != nil {
-				s.ctx.GetLogger().Error("Error getting repository config: %s", err)
-				continue
-			}
+		storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
+		if err != nil {
+			s.ctx.GetLogger().Error("Error getting repository config: %s", err)
+			return err
+		}
 
-			if retval, err := agent.ExecuteRPC(s.ctx, []string{"backup"}, backupSubcommand, storeConfig); err != nil || retval != 0 {
-				s.ctx.GetLogger().Error("Error creating backup: %s", err)
-				continue
-			}
+		res, err := agent.ExecuteRPCWithResult(s.ctx, []string{"backup"}, backupSubcommand, storeConfig)
+		if err := rpcError(res.ExitCode, err); err != nil {
+			s.ctx.GetLogger().Error("Error creating backup: %s", err)
+			return err
+		}
+		rc.snapshotID = res.SnapshotID
 
-			if task.Retention != 0 {
-				rmSubcommand.LocateOptions.Filters.Before = time.Now().Add(-task.Retention)
-				if retval, err := agent.ExecuteRPC(s.ctx, []string{"rm"}, rmSubcommand, storeConfig); err != nil || retval != 0 {
-					s.ctx.GetLogger().Error("Error removing obsolete backups: %s", err)
-					continue
-				}
+		// the retention is a step of its own, reported separately: its
+		// failure must not retry the backup, which would take another
+		// snapshot, and is caught up on by the next run
+		if task.Retention != 0 {
+			rmSubcommand.LocateOptions.Filters.Before = time.Now().Add(-task.Retention)
+			if err := rpcError(agent.ExecuteRPC(s.ctx, []string{"rm"}, rmSubcommand, storeConfig)); err != nil {
+				s.ctx.GetLogger().Warn("Error removing obsolete backups: %s", err)
+			}
+		} else if task.Policy != "" || task.Periods != nil {
+			// the policy is reloaded on each run to pick up changes
+			pruneSubcommand, err := s.pruneSubcommand(task.Policy, task.Periods)
+			if err != nil {
+				s.ctx.GetLogger().Warn("Error loading retention policy: %s", err)
+				return nil
+			}
+			// only ever prune the snapshots created by this task
+			pruneSubcommand.LocateOptions.Filters.Job = taskset.Name
+			pruneSubcommand.SetTaskName(taskset.Name)
+			if err := rpcError(agent.ExecuteRPC(s.ctx, []string{"prune"}, pruneSubcommand, storeConfig)); err != nil {
+				s.ctx.GetLogger().Warn("Error pruning obsolete backups: %s", err)
 			}
 		}
-	}
+		return nil
+	})
 }
 
-func (s *Scheduler) checkTask(taskset Task, task CheckConfig) {
+func (s *Scheduler) checkTask(taskset Task, task CheckConfig, idx int) error {
+	job := taskset.Name
+	if task.Job != "" {
+		job = task.Job
+	}
+
 	checkSubcommand := &check.Check{}
 	checkSubcommand.Flags = subcommands.AgentSupport
+	checkSubcommand.SetTaskName(taskset.Name)
 	checkSubcommand.LocateOptions = locate.NewDefaultLocateOptions(
-		locate.WithJob(taskset.Name),
+		locate.WithJob(job),
 		locate.WithLatest(task.Latest),
+		locate.WithName(task.Name),
+		locate.WithCategory(task.Category),
+		locate.WithEnvironment(task.Environment),
+		locate.WithPerimeter(task.Perimeter),
 	)
+	checkSubcommand.LocateOptions.Filters.Tags = task.Tags
+	checkSubcommand.LocateOptions.Filters.Roots = task.Roots
+	checkSubcommand.Concurrency = task.Concurrency
+	checkSubcommand.FastCheck = task.Fast
+	checkSubcommand.NoVerify = task.NoVerify
 	checkSubcommand.Silent = true
-	if task.Path != "" {
-		checkSubcommand.Snapshots = []string{":" + task.Path}
+
+	opts, err := s.jobOptions(task.ScheduleConfig, taskset.Repository)
+	if err != nil {
+		return err
 	}
+	return s.register(taskset, fmt.Sprintf("check:%s:%d", taskset.Name, idx), task.ScheduleConfig, opts, func(rc *runContext) error {
+		checkSubcommand.Snapshots = snapshotArgs(rc, task.Path)
 
-	for {
-		tick := time.After(task.Interval)
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-tick:
-			storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
-			if err != nil {
-				s.ctx.GetLogger().Error("Error getting repository config: %s", err)
-				continue
-			}
+		// relative dates, such as "7d", are evaluated on each run
+		var err error
+		checkSubcommand.LocateOptions.Filters.Since, err = locate.ParseTimeFlag(task.Since)
+		if err != nil {
+			return err
+		}
+		checkSubcommand.LocateOptions.Filters.Before, err = locate.ParseTimeFlag(task.Before)
+		if err != nil {
+			return err
+		}
 
-			retval, err := agent.ExecuteRPC(s.ctx, []string{"check"}, checkSubcommand, storeConfig)
-			if err != nil || retval != 0 {
-				s.ctx.GetLogger().Error("Error executing check: %s", err)
-			}
+		storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
+		if err != nil {
+			s.ctx.GetLogger().Error("Error getting repository config: %s", err)
+			return err
 		}
-	}
+
+		checkSubcommand.SetAttempt(rc.attempt)
+		err = rpcError(agent.ExecuteRPC(s.ctx, []string{"check"}, checkSubcommand, storeConfig))
+		if err != nil {
+			s.ctx.GetLogger().Error("Error executing check: %s", err)
+		}
+		return err
+	})
 }
 
-func (s *Scheduler) restoreTask(taskset Task, task RestoreConfig) {
+func (s *Scheduler) restoreTask(taskset Task, task RestoreConfig, idx int) error {
 	restoreSubcommand := &restore.Restore{}
 	restoreSubcommand.Flags = subcommands.AgentSupport
+	restoreSubcommand.SetTaskName(taskset.Name)
 	restoreSubcommand.OptJob = taskset.Name
+	if task.Job != "" {
+		restoreSubcommand.OptJob = task.Job
+	}
+	restoreSubcommand.OptName = task.Name
+	restoreSubcommand.OptCategory = task.Category
+	restoreSubcommand.OptEnvironment = task.Environment
+	restoreSubcommand.OptPerimeter = task.Perimeter
+	restoreSubcommand.OptTag = task.Tag
+	restoreSubcommand.OptSkipPermissions = task.SkipPermissions
+	restoreSubcommand.Concurrency = task.Concurrency
 	restoreSubcommand.Target = task.Target
 	restoreSubcommand.Silent = true
-	if task.Path != "" {
-		restoreSubcommand.Snapshots = []string{":" + task.Path}
+	restoreSubcommand.LimitDownload = limit(task.LimitDownload)
+
+	opts, err := s.jobOptions(task.ScheduleConfig, taskset.Repository)
+	if err != nil {
+		return err
 	}
+	return s.register(taskset, fmt.Sprintf("restore:%s:%d", taskset.Name, idx), task.ScheduleConfig, opts, func(rc *runContext) error {
+		restoreSubcommand.Snapshots = snapshotArgs(rc, task.Path)
 
-	for {
-		tick := time.After(task.Interval)
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-tick:
-			storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
-			if err != nil {
-				s.ctx.GetLogger().Error("Error getting repository config: %s", err)
-				continue
-			}
+		storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
+		if err != nil {
+			s.ctx.GetLogger().Error("Error getting repository config: %s", err)
+			return err
+		}
 
-			retval, err := agent.ExecuteRPC(s.ctx, []string{"restore"}, restoreSubcommand, storeConfig)
-			if err != nil || retval != 0 {
-				s.ctx.GetLogger().Error("Error executing restore: %s", err)
-			}
+		restoreSubcommand.SetAttempt(rc.attempt)
+		err = rpcError(agent.ExecuteRPC(s.ctx, []string{"restore"}, restoreSubcommand, storeConfig))
+		if err != nil {
+			s.ctx.GetLogger().Error("Error executing restore: %s", err)
 		}
-	}
+		return err
+	})
 }
 
-func (s *Scheduler) syncTask(taskset Task, task SyncConfig) {
+func (s *Scheduler) syncTask(taskset Task, task SyncConfig, idx int) error {
 	syncSubcommand := &sync.Sync{}
 	syncSubcommand.Flags = subcommands.AgentSupport
+	syncSubcommand.SetTaskName(taskset.Name)
 	syncSubcommand.PeerRepositoryLocation = task.Peer
 	if task.Direction == SyncDirectionTo {
 		syncSubcommand.Direction = "to"
@@ -149,10 +352,10 @@ func (s *Scheduler) syncTask(taskset Task, task SyncConfig) {
 	} else if task.Direction == SyncDirectionWith {
 		syncSubcommand.Direction = "with"
 	} else {
-		//return fmt.Errorf("invalid sync direction: %s", task.Direction)
-		s.ctx.Cancel()
-		return
+		return fmt.Errorf("invalid sync direction: %s", task.Direction)
 	}
+	syncSubcommand.LimitUpload = limit(task.LimitUpload)
+	syncSubcommand.LimitDownload = limit(task.LimitDownload)
 	//	if taskset.Repository.Passphrase != "" {
 	//		syncSubcommand.DestinationRepositorySecret = []byte(taskset.Repository.Passphrase)
 	//		_ = syncSubcommand.DestinationRepositorySecret
@@ -161,66 +364,99 @@ func (s *Scheduler) syncTask(taskset Task, task SyncConfig) {
 	//	syncSubcommand.Target = task.Target
 	//	syncSubcommand.Silent = true
 
-	for {
-		tick := time.After(task.Interval)
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-tick:
-			storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
-			if err != nil {
-				s.ctx.GetLogger().Error("Error getting repository config: %s", err)
-				continue
-			}
+	opts, err := s.jobOptions(task.ScheduleConfig, taskset.Repository, task.Peer)
+	if err != nil {
+		return err
+	}
+	return s.register(taskset, fmt.Sprintf("sync:%s:%d", taskset.Name, idx), task.ScheduleConfig, opts, func(rc *runContext) error {
+		// when chained to a backup, only synchronize the new snapshot
+		syncSubcommand.SrcLocateOptions = locate.NewDefaultLocateOptions()
+		if rc.snapshotID != (objects.MAC{}) {
+			syncSubcommand.SrcLocateOptions.Filters.IDs = []string{fmt.Sprintf("%x", rc.snapshotID)}
+		}
 
-			retval, err := agent.ExecuteRPC(s.ctx, []string{"sync"}, syncSubcommand, storeConfig)
-			if err != nil || retval != 0 {
-				s.ctx.GetLogger().Error("sync: %s", err)
-			} else {
-				s.ctx.GetLogger().Info("sync: synchronization succeeded")
-			}
+		storeConfig, err := s.ctx.Config.GetRepository(taskset.Repository)
+		if err != nil {
+			s.ctx.GetLogger().Error("Error getting repository config: %s", err)
+			return err
 		}
-	}
+
+		syncSubcommand.SetAttempt(rc.attempt)
+		err = rpcError(agent.ExecuteRPC(s.ctx, []string{"sync"}, syncSubcommand, storeConfig))
+		if err != nil {
+			s.ctx.GetLogger().Error("sync: %s", err)
+		} else {
+			s.ctx.GetLogger().Info("sync: synchronization succeeded")
+		}
+		return err
+	})
 }
 
-func (s *Scheduler) maintenanceTask(task MaintenanceConfig) {
+func (s *Scheduler) maintenanceTask(task MaintenanceConfig) error {
+	schedule, err := task.NewSchedule()
+	if err != nil {
+		return err
+	}
+
 	maintenanceSubcommand := &maintenance.Maintenance{}
 	maintenanceSubcommand.Flags = subcommands.AgentSupport
+	// maintenance tasks are named after their repository
+	maintenanceSubcommand.SetTaskName(task.Repository)
 	rmSubcommand := &rm.Rm{}
 	rmSubcommand.Apply = true
 	rmSubcommand.Flags = subcommands.AgentSupport
+	rmSubcommand.SetTaskName(task.Repository)
 	rmSubcommand.LocateOptions = locate.NewDefaultLocateOptions(locate.WithJob("maintenance"))
 
-	for {
-		tick := time.After(task.Interval)
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-tick:
-			storeConfig, err := s.ctx.Config.GetRepository(task.Repository)
-			if err != nil {
-				s.ctx.GetLogger().Error("Error getting repository config: %s", err)
-				continue
-			}
+	// maintenance must not run alongside other jobs on the repository
+	opts, err := s.jobOptions(task.ScheduleConfig, task.Repository)
+	if err != nil {
+		return err
+	}
+	opts.exclusive = true
 
-			retval, err := agent.ExecuteRPC(s.ctx, []string{"maintenance"}, maintenanceSubcommand, storeConfig)
-			if err != nil || retval != 0 {
-				s.ctx.GetLogger().Error("Error executing maintenance: %s", err)
-				continue
+	s.engine.add("maintenance:"+task.Repository, schedule, opts, func(rc *runContext) error {
+		storeConfig, err := s.ctx.Config.GetRepository(task.Repository)
+		if err != nil {
+			s.ctx.GetLogger().Error("Error getting repository config: %s", err)
+			return err
+		}
+
+		maintenanceSubcommand.SetAttempt(rc.attempt)
+		err = rpcError(agent.ExecuteRPC(s.ctx, []string{"maintenance"}, maintenanceSubcommand, storeConfig))
+		if err != nil {
+			s.ctx.GetLogger().Error("Error executing maintenance: %s", err)
+			return err
+		} else {
+			s.ctx.GetLogger().Info("maintenance of repository %s succeeded", task.Repository)
+		}
+
+		if task.Retention != 0 {
+			rmSubcommand.LocateOptions.Filters.Before = time.Now().Add(-task.Retention)
+			err := rpcError(agent.ExecuteRPC(s.ctx, []string{"rm"}, rmSubcommand, storeConfig))
+			if err != nil {
+				s.ctx.GetLogger().Error("Error removing obsolete backups: %s", err)
+				return err
 			} else {
-				s.ctx.GetLogger().Info("maintenance of repository %s succeeded", task.Repository)
+				s.ctx.GetLogger().Info("Retention purge succeeded")
 			}
-
-			if task.Retention != 0 {
-				rmSubcommand.LocateOptions.Filters.Before = time.Now().Add(-task.Retention)
-				retval, err := agent.ExecuteRPC(s.ctx, []string{"rm"}, rmSubcommand, storeConfig)
-				if err != nil || retval != 0 {
-					s.ctx.GetLogger().Error("Error removing obsolete backups: %s", err)
-					continue
-				} else {
-					s.ctx.GetLogger().Info("Retention purge succeeded")
-				}
+		} else {
+			pruneSubcommand, err := s.pruneSubcommand(task.Policy, task.Periods)
+			if err != nil {
+				s.ctx.GetLogger().Error("Error loading retention policy: %s", err)
+				return err
+			}
+			pruneSubcommand.SetTaskName(task.Repository)
+			err = rpcError(agent.ExecuteRPC(s.ctx, []string{"prune"}, pruneSubcommand, storeConfig))
+			if err != nil {
+				s.ctx.GetLogger().Error("Error pruning obsolete backups: %s", err)
+				return err
+			} else {
+				s.ctx.GetLogger().Info("Retention prune succeeded")
 			}
 		}
-	}
+		return nil
+	})
+
+	return nil
 }
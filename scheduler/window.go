@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow is a time range during which a job is allowed to start, such
+// as "mon-fri 20:00-06:00", "sat,sun" or "01:00-05:00".  The days use the
+// syntax of the day of week field of cron expressions and default to every
+// day, the time range defaults to the whole day.  A range ending before it
+// starts extends over the next day.
+type timeWindow struct {
+	days   uint64
+	start  time.Duration
+	length time.Duration
+}
+
+// timeWindows restricts the activations of a job to its windows,
+// evaluated in location.
+type timeWindows struct {
+	windows  []timeWindow
+	location *time.Location
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hour, minute, found := strings.Cut(s, ":")
+	if !found {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(minute)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func parseWindow(spec string) (timeWindow, error) {
+	w := timeWindow{
+		days:   1<<7 - 1,
+		length: 24 * time.Hour,
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid window %q", spec)
+	}
+
+	var days, hours string
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			if hours != "" {
+				return w, fmt.Errorf("invalid window %q", spec)
+			}
+			hours = field
+		} else {
+			if days != "" {
+				return w, fmt.Errorf("invalid window %q", spec)
+			}
+			days = field
+		}
+	}
+
+	if days != "" {
+		var err error
+		if w.days, err = cronDow.parse(days); err != nil {
+			return w, fmt.Errorf("invalid window %q: %w", spec, err)
+		}
+		if w.days&(1<<7) != 0 {
+			w.days = w.days&^(1<<7) | 1<<0
+		}
+	}
+
+	if hours != "" {
+		first, last, found := strings.Cut(hours, "-")
+		if !found {
+			return w, fmt.Errorf("invalid window %q: expected a time range", spec)
+		}
+		start, err := parseClock(first)
+		if err != nil {
+			return w, fmt.Errorf("invalid window %q: %w", spec, err)
+		}
+		end, err := parseClock(last)
+		if err != nil {
+			return w, fmt.Errorf("invalid window %q: %w", spec, err)
+		}
+		if start == 24*time.Hour || start == end {
+			return w, fmt.Errorf("invalid window %q: empty time range", spec)
+		}
+		if end < start {
+			end += 24 * time.Hour
+		}
+		w.start = start
+		w.length = end - start
+	}
+
+	return w, nil
+}
+
+func newTimeWindows(specs []string, location *time.Location) (*timeWindows, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	tw := &timeWindows{location: location}
+	for _, spec := range specs {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		tw.windows = append(tw.windows, w)
+	}
+	return tw, nil
+}
+
+// next returns t if it falls within a window, or the time the next window
+// opens.
+func (tw *timeWindows) next(t time.Time) time.Time {
+	if tw == nil || t.IsZero() {
+		return t
+	}
+
+	var opening time.Time
+	local := t.In(tw.location)
+	// a window opened the day before may still be open
+	for day := -1; day <= 7; day++ {
+		midnight := time.Date(local.Year(), local.Month(), local.Day()+day, 0, 0, 0, 0, tw.location)
+		for _, w := range tw.windows {
+			if w.days&(1<<uint(midnight.Weekday())) == 0 {
+				continue
+			}
+			start := time.Date(midnight.Year(), midnight.Month(), midnight.Day(),
+				int(w.start/time.Hour), int(w.start%time.Hour/time.Minute), 0, 0, tw.location)
+			if !t.Before(start) && t.Before(start.Add(w.length)) {
+				return t
+			}
+			if start.After(t) && (opening.IsZero() || start.Before(opening)) {
+				opening = start
+			}
+		}
+	}
+	return opening
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWindow(t *testing.T) {
+	valid := []string{
+		"mon-fri 20:00-06:00",
+		"sat,sun",
+		"01:00-05:30",
+		"22:00-24:00 7",
+		"00:00-24:00",
+	}
+	for _, spec := range valid {
+		_, err := parseWindow(spec)
+		require.NoError(t, err, spec)
+	}
+
+	invalid := []string{
+		"",
+		"mon-fri 20:00",
+		"mon tue",
+		"01:00-02:00 03:00-04:00",
+		"25:00-01:00",
+		"01:60-02:00",
+		"24:00-01:00",
+		"02:00-02:00",
+		"someday",
+	}
+	for _, spec := range invalid {
+		_, err := parseWindow(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestTimeWindowsNext(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	tw, err := newTimeWindows([]string{"mon-fri 20:00-06:00", "sat,sun"}, location)
+	require.NoError(t, err)
+
+	date := func(day, hour, minute int) time.Time {
+		// March 2nd, 2026 is a monday
+		return time.Date(2026, time.March, day, hour, minute, 0, 0, location)
+	}
+
+	tests := []struct {
+		at, next time.Time
+	}{
+		// monday during business hours
+		{date(2, 12, 0), date(2, 20, 0)},
+		// tuesday before the window opened the day before closes
+		{date(3, 5, 59), date(3, 5, 59)},
+		{date(3, 6, 0), date(3, 20, 0)},
+		// the friday night window runs into saturday
+		{date(6, 23, 0), date(6, 23, 0)},
+		{date(7, 15, 0), date(7, 15, 0)},
+		// the weekend window ends at midnight
+		{date(8, 23, 59), date(8, 23, 59)},
+		{date(9, 0, 30), date(9, 20, 0)},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.next, tw.next(test.at), test.at.String())
+	}
+
+	var none *timeWindows
+	require.Equal(t, date(2, 12, 0), none.next(date(2, 12, 0)))
+}
+
+func TestJobActivation(t *testing.T) {
+	tw, err := newTimeWindows([]string{"01:00-02:00"}, time.UTC)
+	require.NoError(t, err)
+
+	opts := jobOptions{jitter: 10 * time.Minute, windows: tw}
+	due := time.Date(2026, time.March, 2, 12, 0, 0, 0, time.UTC)
+	opening := time.Date(2026, time.March, 3, 1, 0, 0, 0, time.UTC)
+	for range 100 {
+		next := opts.activation(due)
+		require.False(t, next.Before(opening), next.String())
+		require.True(t, next.Before(opening.Add(10*time.Minute)), next.String())
+	}
+	require.True(t, opts.activation(time.Time{}).IsZero())
+}
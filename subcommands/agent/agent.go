@@ -30,6 +30,16 @@ func init() {
 	if runtime.GOOS != "windows" {
 		subcommands.Register(func() subcommands.Subcommand { return &AgentStop{} },
 			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport|subcommands.IgnoreVersion, "agent", "stop")
+		subcommands.Register(func() subcommands.Subcommand { return &AgentJobs{} },
+			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport, "agent", "jobs")
+		subcommands.Register(func() subcommands.Subcommand { return &AgentCancel{} },
+			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport, "agent", "cancel")
+		subcommands.Register(func() subcommands.Subcommand { return &AgentAttach{} },
+			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport, "agent", "attach")
+		subcommands.Register(func() subcommands.Subcommand { return &AgentUnlock{} },
+			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport, "agent", "unlock")
+		subcommands.Register(func() subcommands.Subcommand { return &AgentLock{} },
+			subcommands.BeforeRepositoryOpen|subcommands.AgentSupport, "agent", "lock")
 		subcommands.Register(func() subcommands.Subcommand { return &AgentStart{} },
 			subcommands.BeforeRepositoryOpen, "agent", "start")
 		subcommands.Register(func() subcommands.Subcommand { return &Agent{} },
@@ -40,7 +50,7 @@ func init() {
 func (cmd *Agent) Parse(ctx *appcontext.AppContext, args []string) error {
 	flags := flag.NewFlagSet("agent", flag.ExitOnError)
 	flags.Usage = func() {
-		fmt.Fprintf(flags.Output(), "Usage: %s start | stop\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "Usage: %s start | stop | jobs | cancel | attach | unlock | lock\n", flags.Name())
 	}
 	flags.Parse(args)
 
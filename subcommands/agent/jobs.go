@@ -0,0 +1,420 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlakarKorp/kloset/events"
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/plakar/agent"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	JobQueued     = "queued"
+	JobRunning    = "running"
+	JobCancelling = "cancelling"
+	JobDone       = "done"
+
+	// amount of output of a detached job kept for the next attach
+	JOB_BACKLOG_SIZE = 1 << 20
+
+	// delay during which the outcome of a detached job is kept for an
+	// attach before being given up on
+	JOB_RETENTION = time.Hour
+)
+
+type JobProgress struct {
+	Files       uint64 `json:"files"`
+	Directories uint64 `json:"directories"`
+	Size        uint64 `json:"size"`
+	Errors      uint64 `json:"errors"`
+}
+
+func (p JobProgress) String() string {
+	s := fmt.Sprintf("%d files, %d directories, %s", p.Files, p.Directories,
+		humanize.IBytes(p.Size))
+	if p.Errors != 0 {
+		s += fmt.Sprintf(", %d errors", p.Errors)
+	}
+	return s
+}
+
+// Job is a command run by the agent on behalf of a client.
+type Job struct {
+	ID         int64       `json:"id"`
+	Command    string      `json:"command"`
+	Repository string      `json:"repository,omitempty"`
+	State      string      `json:"state"`
+	StartTime  time.Time   `json:"start_time"`
+	Username   string      `json:"username,omitempty"`
+	ProcessID  int         `json:"pid,omitempty"`
+	Progress   JobProgress `json:"progress"`
+	Detached   bool        `json:"detached,omitempty"`
+
+	cancel func()
+	done   chan struct{}
+
+	// output of a detached job, the first packet of the backlog being
+	// the offset-th one of the job
+	backlog     []agent.Packet
+	backlogSize int
+	offset      int
+	exit        *agent.Packet
+	notify      chan struct{}
+	collected   chan struct{}
+}
+
+// jobRegistry keeps track of the jobs of the agent so that they can be
+// listed and cancelled from another client.
+type jobRegistry struct {
+	mtx     sync.Mutex
+	jobs    map[int64]*Job
+	nextID  int64
+	serving atomic.Bool
+}
+
+var jobs = &jobRegistry{
+	jobs: make(map[int64]*Job),
+}
+
+// add registers a job for the command run in ctx and follows its progress
+// through the events of ctx.  The job is queued until it is started.
+func (r *jobRegistry) add(ctx *appcontext.AppContext, command string, repository string, username string, pid int) *Job {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.nextID++
+	job := &Job{
+		ID:         r.nextID,
+		Command:    command,
+		Repository: repository,
+		State:      JobQueued,
+		StartTime:  time.Now(),
+		Username:   username,
+		ProcessID:  pid,
+		cancel:     ctx.Cancel,
+		done:       make(chan struct{}),
+		notify:     make(chan struct{}),
+		collected:  make(chan struct{}),
+	}
+	r.jobs[job.ID] = job
+
+	evts := ctx.Events().Listen()
+	go func() {
+		for event := range evts {
+			r.mtx.Lock()
+			switch event := event.(type) {
+			case events.FileOK:
+				job.Progress.Files++
+				job.Progress.Size += uint64(event.Size)
+			case events.DirectoryOK:
+				job.Progress.Directories++
+			case events.PathError, events.FileError, events.DirectoryError:
+				job.Progress.Errors++
+			}
+			r.mtx.Unlock()
+		}
+	}()
+
+	return job
+}
+
+func (r *jobRegistry) start(job *Job) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if job.State == JobQueued {
+		job.State = JobRunning
+	}
+}
+
+// detach makes the output of the job go to its backlog rather than to
+// the client, until an attach.
+func (r *jobRegistry) detach(job *Job) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	job.Detached = true
+}
+
+// output records a packet of a detached job and wakes up the attached
+// clients.
+func (r *jobRegistry) output(job *Job, packet agent.Packet) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.jobs[job.ID] != job || job.exit != nil {
+		return
+	}
+
+	if packet.Type == "exit" {
+		job.exit = &packet
+		job.State = JobDone
+	} else {
+		job.backlog = append(job.backlog, packet)
+		job.backlogSize += len(packet.Data)
+		for job.backlogSize > JOB_BACKLOG_SIZE && len(job.backlog) > 1 {
+			job.backlogSize -= len(job.backlog[0].Data)
+			job.backlog = job.backlog[1:]
+			job.offset++
+		}
+	}
+
+	close(job.notify)
+	job.notify = make(chan struct{})
+}
+
+// follow returns the output of a detached job from the next-th packet,
+// the index of the packet following it, the exit packet if the job is
+// done and a channel closed on new output.
+func (r *jobRegistry) follow(id int64, next int) ([]agent.Packet, int, *agent.Packet, <-chan struct{}, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, 0, nil, nil, fmt.Errorf("no such job: %d", id)
+	}
+	if !job.Detached {
+		return nil, 0, nil, nil, fmt.Errorf("job %d is not detached", id)
+	}
+
+	next = max(next, job.offset)
+	packets := append([]agent.Packet(nil), job.backlog[next-job.offset:]...)
+	next = job.offset + len(job.backlog)
+
+	if job.exit != nil {
+		select {
+		case <-job.collected:
+		default:
+			close(job.collected)
+		}
+	}
+	return packets, next, job.exit, job.notify, nil
+}
+
+func (r *jobRegistry) remove(job *Job) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.jobs[job.ID]; ok {
+		delete(r.jobs, job.ID)
+		close(job.done)
+		close(job.notify)
+	}
+}
+
+func (r *jobRegistry) list() []Job {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	list := make([]Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		list = append(list, *job)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// cancel cancels the context of the job, which stops the command and
+// releases the locks it holds on the repository.  The returned channel is
+// closed once the command is done.
+func (r *jobRegistry) cancel(id int64) (<-chan struct{}, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no such job: %d", id)
+	}
+	if job.exit != nil {
+		// done and waiting for an attach, drop its outcome
+		select {
+		case <-job.collected:
+		default:
+			close(job.collected)
+		}
+		return job.done, nil
+	}
+	job.State = JobCancelling
+	job.cancel()
+	return job.done, nil
+}
+
+type AgentJobs struct {
+	subcommands.SubcommandBase
+
+	OptJSON bool
+}
+
+func (cmd *AgentJobs) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("agent jobs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [OPTIONS]\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "\nOPTIONS:\n")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&cmd.OptJSON, "json", false, "output the jobs as JSON lines")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	return nil
+}
+
+func (cmd *AgentJobs) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if !jobs.serving.Load() {
+		return 1, fmt.Errorf("the agent is not running")
+	}
+
+	enc := json.NewEncoder(ctx.Stdout)
+	for _, job := range jobs.list() {
+		if cmd.OptJSON {
+			if err := enc.Encode(job); err != nil {
+				return 1, err
+			}
+			continue
+		}
+
+		origin := job.Username
+		if job.ProcessID != 0 {
+			origin = fmt.Sprintf("%s[%d]", origin, job.ProcessID)
+		}
+		fmt.Fprintf(ctx.Stdout, "%d %s %s %s %s at %s: %s\n", job.ID,
+			job.StartTime.UTC().Format(time.RFC3339), job.State, origin,
+			job.Command, job.Repository, job.Progress)
+	}
+	return 0, nil
+}
+
+type AgentCancel struct {
+	subcommands.SubcommandBase
+
+	JobIDs []int64
+}
+
+func (cmd *AgentCancel) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("agent cancel", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s JOBID...\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no job specified")
+	}
+
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid job id: %s", arg)
+		}
+		cmd.JobIDs = append(cmd.JobIDs, id)
+	}
+	return nil
+}
+
+func (cmd *AgentCancel) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if !jobs.serving.Load() {
+		return 1, fmt.Errorf("the agent is not running")
+	}
+
+	var failed []string
+	var pending []<-chan struct{}
+	for _, id := range cmd.JobIDs {
+		done, err := jobs.cancel(id)
+		if err != nil {
+			ctx.GetLogger().Stderr("%s", err)
+			failed = append(failed, fmt.Sprint(id))
+			continue
+		}
+		pending = append(pending, done)
+	}
+
+	// wait for the jobs to wind down, so that their locks are released
+	// once the command returns
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return 1, ctx.Err()
+		}
+	}
+
+	if len(failed) != 0 {
+		return 1, fmt.Errorf("failed to cancel job(s): %s", strings.Join(failed, ", "))
+	}
+	return 0, nil
+}
+
+type AgentAttach struct {
+	subcommands.SubcommandBase
+
+	JobID int64
+}
+
+func (cmd *AgentAttach) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("agent attach", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s JOBID\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("a single job must be specified")
+	}
+
+	id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil || id <= 0 {
+		return fmt.Errorf("invalid job id: %s", flags.Arg(0))
+	}
+	cmd.JobID = id
+	return nil
+}
+
+func (cmd *AgentAttach) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if !jobs.serving.Load() {
+		return 1, fmt.Errorf("the agent is not running")
+	}
+
+	next := 0
+	for {
+		packets, n, exit, notify, err := jobs.follow(cmd.JobID, next)
+		if err != nil {
+			return 1, err
+		}
+		next = n
+
+		for _, packet := range packets {
+			switch packet.Type {
+			case "stdout":
+				ctx.Stdout.Write(packet.Data)
+			case "stderr":
+				ctx.Stderr.Write(packet.Data)
+			}
+		}
+
+		if exit != nil {
+			if exit.Err != "" {
+				return exit.ExitCode, fmt.Errorf("%s", exit.Err)
+			}
+			return exit.ExitCode, nil
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return 1, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/events"
+	"github.com/PlakarKorp/plakar/agent"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentJobs(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+	ctx, _ := initContext(t, bufOut, bufErr)
+
+	jobs.serving.Store(true)
+	defer jobs.serving.Store(false)
+
+	jobCtx := appcontext.NewAppContextFrom(ctx)
+	defer jobCtx.Close()
+
+	job := jobs.add(jobCtx, "backup", "/var/backups", "alice", 4242)
+	require.Equal(t, JobQueued, job.State)
+	jobs.start(job)
+
+	var snapshotID [32]byte
+	jobCtx.Events().Send(events.DirectoryOKEvent(snapshotID, "/etc"))
+	jobCtx.Events().Send(events.FileOKEvent(snapshotID, "/etc/passwd", 1024))
+	jobCtx.Events().Send(events.FileErrorEvent(snapshotID, "/etc/shadow", "permission denied"))
+
+	require.Eventually(t, func() bool {
+		list := jobs.list()
+		return len(list) == 1 && list[0].Progress.Errors == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	list := &AgentJobs{}
+	require.NoError(t, list.Parse(ctx, []string{"-json"}))
+	status, err := list.Execute(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	var listed Job
+	require.NoError(t, json.Unmarshal(bufOut.Bytes(), &listed))
+	require.Equal(t, job.ID, listed.ID)
+	require.Equal(t, "backup", listed.Command)
+	require.Equal(t, "/var/backups", listed.Repository)
+	require.Equal(t, JobRunning, listed.State)
+	require.Equal(t, "alice", listed.Username)
+	require.Equal(t, 4242, listed.ProcessID)
+	require.Equal(t, JobProgress{Files: 1, Directories: 1, Size: 1024, Errors: 1}, listed.Progress)
+
+	// cancelling the job cancels its context and waits for it to be done
+	go func() {
+		<-jobCtx.Done()
+		jobs.remove(job)
+	}()
+
+	cancel := &AgentCancel{}
+	require.Error(t, cancel.Parse(ctx, []string{"foo"}))
+	cancel = &AgentCancel{}
+	require.NoError(t, cancel.Parse(ctx, []string{"1"}))
+	cancel.JobIDs = []int64{job.ID}
+	status, err = cancel.Execute(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+	require.Empty(t, jobs.list())
+
+	status, err = cancel.Execute(ctx, nil)
+	require.Error(t, err)
+	require.Equal(t, 1, status)
+}
+
+func TestAgentAttach(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+	ctx, _ := initContext(t, bufOut, bufErr)
+
+	jobs.serving.Store(true)
+	defer jobs.serving.Store(false)
+
+	jobCtx := appcontext.NewAppContextFrom(ctx)
+	defer jobCtx.Close()
+
+	job := jobs.add(jobCtx, "sync", "/var/backups", "alice", 4242)
+	defer jobs.remove(job)
+
+	attach := &AgentAttach{}
+	require.NoError(t, attach.Parse(ctx, []string{fmt.Sprint(job.ID)}))
+
+	// only detached jobs have their output kept
+	_, err := attach.Execute(ctx, nil)
+	require.Error(t, err)
+
+	jobs.detach(job)
+	jobs.output(job, agent.Packet{Type: "stdout", Data: []byte("before\n")})
+
+	type result struct {
+		status int
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		status, err := attach.Execute(ctx, nil)
+		done <- result{status, err}
+	}()
+
+	jobs.output(job, agent.Packet{Type: "stderr", Data: []byte("warning\n")})
+	jobs.output(job, agent.Packet{Type: "stdout", Data: []byte("after\n")})
+	jobs.output(job, agent.Packet{Type: "exit", ExitCode: 2, Err: "boom"})
+
+	res := <-done
+	require.Equal(t, 2, res.status)
+	require.EqualError(t, res.err, "boom")
+	require.Equal(t, "before\nafter\n", bufOut.String())
+	require.Equal(t, "warning\n", bufErr.String())
+	require.Equal(t, JobDone, jobs.list()[0].State)
+
+	select {
+	case <-job.collected:
+	default:
+		t.Fatal("the outcome of the job was not collected")
+	}
+}
+
+func TestJobBacklog(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	defer ctx.Close()
+
+	job := jobs.add(ctx, "backup", "/var/backups", "", 0)
+	defer jobs.remove(job)
+	jobs.detach(job)
+
+	chunk := bytes.Repeat([]byte("x"), JOB_BACKLOG_SIZE/4)
+	for range 10 {
+		jobs.output(job, agent.Packet{Type: "stdout", Data: chunk})
+	}
+
+	packets, next, exit, _, err := jobs.follow(job.ID, 0)
+	require.NoError(t, err)
+	require.Nil(t, exit)
+	require.Len(t, packets, 4)
+	require.Equal(t, 10, next)
+}
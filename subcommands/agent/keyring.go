@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/kloset/storage"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/google/uuid"
+)
+
+type cachedKey struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// keyRing holds the keys of the repositories unlocked with agent unlock,
+// by repository ID, so that the clients don't have to provide them.
+type keyRing struct {
+	mtx  sync.Mutex
+	keys map[uuid.UUID]*cachedKey
+
+	// called when the last key is wiped
+	onEmpty func()
+}
+
+var keys = &keyRing{
+	keys: make(map[uuid.UUID]*cachedKey),
+}
+
+// add keeps key for the given lifetime, or until it is wiped if lifetime
+// is zero.
+func (k *keyRing) add(id uuid.UUID, key []byte, lifetime time.Duration) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	k.wipeLocked(id)
+	cached := &cachedKey{key: append([]byte(nil), key...)}
+	if lifetime > 0 {
+		cached.timer = time.AfterFunc(lifetime, func() {
+			k.wipe(id)
+		})
+	}
+	k.keys[id] = cached
+}
+
+func (k *keyRing) get(id uuid.UUID) ([]byte, bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	cached, ok := k.keys[id]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), cached.key...), true
+}
+
+func (k *keyRing) empty() bool {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return len(k.keys) == 0
+}
+
+func (k *keyRing) wipe(id uuid.UUID) bool {
+	k.mtx.Lock()
+	found := k.wipeLocked(id)
+	onEmpty := k.onEmpty
+	empty := len(k.keys) == 0
+	k.mtx.Unlock()
+
+	if found && empty && onEmpty != nil {
+		onEmpty()
+	}
+	return found
+}
+
+func (k *keyRing) wipeAll() int {
+	k.mtx.Lock()
+	n := len(k.keys)
+	for id := range k.keys {
+		k.wipeLocked(id)
+	}
+	onEmpty := k.onEmpty
+	k.mtx.Unlock()
+
+	if n != 0 && onEmpty != nil {
+		onEmpty()
+	}
+	return n
+}
+
+func (k *keyRing) wipeLocked(id uuid.UUID) bool {
+	cached, ok := k.keys[id]
+	if !ok {
+		return false
+	}
+	if cached.timer != nil {
+		cached.timer.Stop()
+	}
+	clear(cached.key)
+	delete(k.keys, id)
+	return true
+}
+
+// openConfiguration reads the configuration of the repository described
+// by storeConfig.
+func openConfiguration(ctx *appcontext.AppContext, storeConfig map[string]string) (*storage.Configuration, error) {
+	store, serializedConfig, err := storage.Open(ctx.GetInner(), storeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	store.Close(ctx)
+
+	return storage.NewConfigurationFromWrappedBytes(serializedConfig)
+}
+
+type AgentUnlock struct {
+	subcommands.SubcommandBase
+
+	Lifetime    time.Duration
+	StoreConfig map[string]string
+
+	// set by the agent
+	storeConfig   map[string]string
+	askPassphrase func() ([]byte, error)
+}
+
+func (cmd *AgentUnlock) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("agent unlock", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [OPTIONS] [REPOSITORY]\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "\nOPTIONS:\n")
+		flags.PrintDefaults()
+	}
+	flags.DurationVar(&cmd.Lifetime, "lifetime", 0, "delay after which the key is wiped, none by default")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+	if cmd.Lifetime < 0 {
+		return fmt.Errorf("invalid -lifetime: %s", cmd.Lifetime)
+	}
+
+	if flags.NArg() == 1 {
+		storeConfig, err := ctx.Config.GetRepository(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		cmd.StoreConfig = storeConfig
+	}
+	return nil
+}
+
+func (cmd *AgentUnlock) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if !jobs.serving.Load() {
+		return 1, fmt.Errorf("the agent is not running")
+	}
+
+	storeConfig := cmd.StoreConfig
+	if storeConfig == nil {
+		storeConfig = cmd.storeConfig
+	}
+
+	config, err := openConfiguration(ctx, storeConfig)
+	if err != nil {
+		return 1, err
+	}
+	if config.Encryption == nil {
+		return 1, fmt.Errorf("repository %s is not encrypted", storeConfig["location"])
+	}
+
+	// unlocking again refreshes the lifetime of the key, the passphrase
+	// is asked for anyway
+	key, err := getKey(config.Encryption, nil, storeConfig, cmd.askPassphrase)
+	if err != nil {
+		return 1, err
+	}
+	keys.add(config.RepositoryID, key, cmd.Lifetime)
+	clear(key)
+
+	if cmd.Lifetime > 0 {
+		ctx.GetLogger().Info("repository %s unlocked for %s", storeConfig["location"], cmd.Lifetime)
+	} else {
+		ctx.GetLogger().Info("repository %s unlocked", storeConfig["location"])
+	}
+	return 0, nil
+}
+
+type AgentLock struct {
+	subcommands.SubcommandBase
+
+	StoreConfig map[string]string
+}
+
+func (cmd *AgentLock) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("agent lock", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [REPOSITORY]\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	if flags.NArg() == 1 {
+		storeConfig, err := ctx.Config.GetRepository(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		cmd.StoreConfig = storeConfig
+	}
+	return nil
+}
+
+func (cmd *AgentLock) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if !jobs.serving.Load() {
+		return 1, fmt.Errorf("the agent is not running")
+	}
+
+	if cmd.StoreConfig == nil {
+		n := keys.wipeAll()
+		ctx.GetLogger().Info("%d key(s) wiped", n)
+		return 0, nil
+	}
+
+	config, err := openConfiguration(ctx, cmd.StoreConfig)
+	if err != nil {
+		return 1, err
+	}
+	if !keys.wipe(config.RepositoryID) {
+		return 1, fmt.Errorf("repository %s is not unlocked", cmd.StoreConfig["location"])
+	}
+	return 0, nil
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/encryption"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing(t *testing.T) {
+	ring := &keyRing{keys: make(map[uuid.UUID]*cachedKey)}
+	var emptied atomic.Int32
+	ring.onEmpty = func() { emptied.Add(1) }
+
+	id1, id2 := uuid.New(), uuid.New()
+	ring.add(id1, []byte("key1"), 0)
+	ring.add(id2, []byte("key2"), 50*time.Millisecond)
+
+	key, ok := ring.get(id1)
+	require.True(t, ok)
+	require.Equal(t, []byte("key1"), key)
+
+	// the second key expires on its own
+	require.Eventually(t, func() bool {
+		_, ok := ring.get(id2)
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(0), emptied.Load())
+	require.False(t, ring.empty())
+
+	require.True(t, ring.wipe(id1))
+	require.False(t, ring.wipe(id1))
+	require.True(t, ring.empty())
+	require.Equal(t, int32(1), emptied.Load())
+
+	ring.add(id1, []byte("key1"), 0)
+	ring.add(id2, []byte("key2"), 0)
+	require.Equal(t, 2, ring.wipeAll())
+	require.True(t, ring.empty())
+	require.Equal(t, int32(2), emptied.Load())
+}
+
+func TestGetKey(t *testing.T) {
+	config := encryption.NewDefaultConfiguration()
+	key, err := encryption.DeriveKey(config.KDFParams, []byte("s3cr3t"))
+	require.NoError(t, err)
+	config.Canary, err = encryption.DeriveCanary(config, key)
+	require.NoError(t, err)
+
+	// provided by the client
+	got, err := getKey(config, key, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	_, err = getKey(config, []byte("wrong"), nil, nil)
+	require.Error(t, err)
+
+	// from the configuration of the repository
+	got, err = getKey(config, nil, map[string]string{"passphrase": "s3cr3t"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+
+	// asked to the client, which may get it wrong
+	_, err = getKey(config, nil, map[string]string{}, nil)
+	require.Error(t, err)
+
+	attempts := 0
+	got, err = getKey(config, nil, map[string]string{}, func() ([]byte, error) {
+		attempts++
+		if attempts == 1 {
+			return []byte("typo"), nil
+		}
+		return []byte("s3cr3t"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	require.Equal(t, 2, attempts)
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/PlakarKorp/plakar/subcommands/backup"
+	psync "github.com/PlakarKorp/plakar/subcommands/sync"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	ACL_VERSION = "v1.0.0"
+
+	// delay for a remote client to complete the TLS handshake
+	REMOTE_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// ACL_HOOKS is the entry of the ACL allowing a client to set the
+	// hooks of a backup, which are shell commands run by the agent.
+	ACL_HOOKS = "hooks"
+)
+
+// ACL maps the common name of the certificate of the remote clients to
+// the commands they may run, such as "backup" or "agent jobs".  A command
+// allows its subcommands too: "agent" allows "agent jobs".  The "hooks"
+// entry allows the hooks of the backups.
+type ACL struct {
+	Version string              `yaml:"version"`
+	Clients map[string][]string `yaml:"clients"`
+}
+
+func LoadACL(path string) (*ACL, error) {
+	rd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	acl := &ACL{}
+	dec := yaml.NewDecoder(rd)
+	dec.KnownFields(true)
+	if err := dec.Decode(acl); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if acl.Version != ACL_VERSION {
+		return nil, fmt.Errorf("unsupported ACL version %q", acl.Version)
+	}
+	if len(acl.Clients) == 0 {
+		return nil, fmt.Errorf("no client allowed in %s", path)
+	}
+	return acl, nil
+}
+
+// remotePeer is a client connected over TLS, identified by the common
+// name of its certificate.
+type remotePeer struct {
+	name     string
+	commands []string
+}
+
+func (peer *remotePeer) allowed(name []string) bool {
+	for _, command := range peer.commands {
+		words := strings.Fields(command)
+		if len(words) != 0 && len(words) <= len(name) &&
+			strings.Join(name[:len(words)], " ") == strings.Join(words, " ") {
+			return true
+		}
+	}
+	return false
+}
+
+func (peer *remotePeer) granted(entry string) bool {
+	return slices.Contains(peer.commands, entry)
+}
+
+// check refuses what a remote client can't do: handle the keys held by
+// the agent, which are only for its local clients, set the hooks of a
+// backup unless granted, and use repositories the configuration of the
+// agent doesn't name.
+func (peer *remotePeer) check(cmd subcommands.Subcommand) error {
+	switch cmd := cmd.(type) {
+	case *AgentUnlock, *AgentLock:
+		return fmt.Errorf("only allowed to local clients")
+	case *backup.Backup:
+		if !peer.granted(ACL_HOOKS) &&
+			(cmd.PreHook != "" || cmd.PostHook != "" || cmd.FailHook != "") {
+			return fmt.Errorf("hooks not allowed")
+		}
+	case *psync.Sync:
+		if !strings.HasPrefix(cmd.PeerRepositoryLocation, "@") {
+			return fmt.Errorf("%s: remote clients must name a repository configured on the agent", cmd.PeerRepositoryLocation)
+		}
+	}
+	return nil
+}
+
+// remoteStoreConfig returns the configuration of the repository a remote
+// client acts on: the client names a repository of the configuration of
+// the agent and may only provide its passphrase along.
+func remoteStoreConfig(ctx *appcontext.AppContext, storeConfig map[string]string) (map[string]string, error) {
+	location := storeConfig["location"]
+	if !strings.HasPrefix(location, "@") {
+		return nil, fmt.Errorf("%s: remote clients must name a repository configured on the agent", location)
+	}
+	config, err := ctx.Config.GetRepository(location)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase, ok := storeConfig["passphrase"]; ok {
+		config["passphrase"] = passphrase
+		delete(config, "passphrase_cmd")
+	}
+	return config, nil
+}
+
+// acceptRemote completes the TLS handshake of a remote client and looks it
+// up in the ACL.
+func acceptRemote(conn net.Conn, acl *ACL) (*remotePeer, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("not a TLS connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), REMOTE_HANDSHAKE_TIMEOUT)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	name := certs[0].Subject.CommonName
+	commands, ok := acl.Clients[name]
+	if !ok {
+		return nil, fmt.Errorf("client %q not allowed", name)
+	}
+	return &remotePeer{name: name, commands: commands}, nil
+}
@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/config"
+	"github.com/PlakarKorp/kloset/encryption"
+	"github.com/PlakarKorp/kloset/hashing"
+	"github.com/PlakarKorp/kloset/resources"
+	"github.com/PlakarKorp/kloset/storage"
+	"github.com/PlakarKorp/kloset/versioning"
+	"github.com/PlakarKorp/plakar/agent"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/subcommands/backup"
+	psync "github.com/PlakarKorp/plakar/subcommands/sync"
+	ptesting "github.com/PlakarKorp/plakar/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadACL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`version: v1.0.0
+clients:
+  controller:
+    - backup
+    - agent jobs
+`), 0600))
+	acl, err := LoadACL(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"backup", "agent jobs"}, acl.Clients["controller"])
+
+	peer := &remotePeer{name: "controller", commands: acl.Clients["controller"]}
+	require.True(t, peer.allowed([]string{"backup"}))
+	require.True(t, peer.allowed([]string{"agent", "jobs"}))
+	require.False(t, peer.allowed([]string{"agent"}))
+	require.False(t, peer.allowed([]string{"agent", "cancel"}))
+	require.False(t, peer.allowed([]string{"restore"}))
+
+	require.NoError(t, os.WriteFile(path, []byte("version: v1.0.0\nclients: {}\n"), 0600))
+	_, err = LoadACL(path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("version: v1.0.0\nclient: {}\n"), 0600))
+	_, err = LoadACL(path)
+	require.Error(t, err)
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+}
+
+// issue writes a certificate for name signed by the CA, and its key, in
+// dir.
+func issue(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func TestAcceptRemote(t *testing.T) {
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "plakar test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDer)
+	require.NoError(t, err)
+	caFile := filepath.Join(dir, "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", caDer)
+
+	serverCert, serverKey := issue(t, dir, "localhost", ca, caKey)
+	config, err := agent.ServerTLSConfig(serverCert, serverKey, caFile)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "localhost:0", config)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	acl := &ACL{
+		Version: ACL_VERSION,
+		Clients: map[string][]string{"controller": {"backup"}},
+	}
+	type result struct {
+		peer *remotePeer
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			peer, err := acceptRemote(conn, acl)
+			conn.Close()
+			results <- result{peer, err}
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	dial := func(name string) {
+		certFile, keyFile := issue(t, dir, name, ca, caKey)
+		remote := &agent.Remote{
+			Addr:     net.JoinHostPort("localhost", port),
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   caFile,
+		}
+		clientConfig, err := remote.TLSConfig()
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", remote.Addr, clientConfig)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.Handshake()
+	}
+
+	dial("controller")
+	res := <-results
+	require.NoError(t, res.err)
+	require.Equal(t, "controller", res.peer.name)
+	require.Equal(t, []string{"backup"}, res.peer.commands)
+
+	dial("intruder")
+	res = <-results
+	require.Error(t, res.err)
+}
+
+func TestRemotePeerCheck(t *testing.T) {
+	peer := &remotePeer{name: "controller", commands: []string{"backup", "sync", "agent"}}
+
+	require.NoError(t, peer.check(&backup.Backup{}))
+	require.Error(t, peer.check(&backup.Backup{PreHook: "id"}))
+	require.Error(t, peer.check(&backup.Backup{PostHook: "id"}))
+	require.Error(t, peer.check(&backup.Backup{FailHook: "id"}))
+
+	peer.commands = append(peer.commands, ACL_HOOKS)
+	require.NoError(t, peer.check(&backup.Backup{PreHook: "id", PostHook: "id", FailHook: "id"}))
+
+	require.NoError(t, peer.check(&psync.Sync{PeerRepositoryLocation: "@offsite"}))
+	require.Error(t, peer.check(&psync.Sync{PeerRepositoryLocation: "/var/backups"}))
+
+	// the keys held by the agent are for its local clients
+	require.Error(t, peer.check(&AgentUnlock{}))
+	require.Error(t, peer.check(&AgentLock{}))
+}
+
+func TestRemoteStoreConfig(t *testing.T) {
+	ctx := appcontext.NewAppContext()
+	ctx.Config = config.NewConfig()
+	ctx.Config.Repositories["local"] = map[string]string{
+		"location":       "fs:///var/backups",
+		"passphrase_cmd": "cat /etc/plakar/passphrase",
+	}
+
+	_, err := remoteStoreConfig(ctx, map[string]string{"location": "fs:///tmp"})
+	require.Error(t, err)
+	_, err = remoteStoreConfig(ctx, map[string]string{"location": "@unknown"})
+	require.Error(t, err)
+
+	// only the name and the passphrase are taken from the client
+	storeConfig, err := remoteStoreConfig(ctx, map[string]string{
+		"location":       "@local",
+		"passphrase_cmd": "touch /tmp/pwned",
+		"key":            "value",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"location":       "fs:///var/backups",
+		"passphrase_cmd": "cat /etc/plakar/passphrase",
+	}, storeConfig)
+
+	storeConfig, err = remoteStoreConfig(ctx, map[string]string{
+		"location":   "@local",
+		"passphrase": "s3cr3t",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"location":   "fs:///var/backups",
+		"passphrase": "s3cr3t",
+	}, storeConfig)
+
+	// the configuration of the agent is left untouched
+	require.Equal(t, "cat /etc/plakar/passphrase", ctx.Config.Repositories["local"]["passphrase_cmd"])
+}
+
+func TestSetupSecretRemote(t *testing.T) {
+	conf := ptesting.NewConfiguration()
+	key, err := encryption.DeriveKey(conf.Encryption.KDFParams, []byte("s3cr3t"))
+	require.NoError(t, err)
+	conf.Encryption.Canary, err = encryption.DeriveCanary(conf.Encryption, key)
+	require.NoError(t, err)
+
+	serialized, err := conf.ToBytes()
+	require.NoError(t, err)
+	hasher := hashing.GetHasher(hashing.DEFAULT_HASHING_ALGORITHM)
+	rd, err := storage.Serialize(hasher, resources.RT_CONFIG, versioning.GetCurrentVersion(resources.RT_CONFIG), bytes.NewReader(serialized))
+	require.NoError(t, err)
+	wrapped, err := io.ReadAll(rd)
+	require.NoError(t, err)
+
+	keys.add(conf.RepositoryID, key, 0)
+	defer keys.wipe(conf.RepositoryID)
+
+	// a local client gets the key held by the agent
+	ctx := appcontext.NewAppContext()
+	require.NoError(t, setupSecret(ctx, &backup.Backup{}, map[string]string{}, wrapped, nil, false))
+	require.Equal(t, key, ctx.GetSecret())
+
+	// a remote one has to provide the passphrase
+	ctx = appcontext.NewAppContext()
+	require.Error(t, setupSecret(ctx, &backup.Backup{}, map[string]string{}, wrapped, nil, true))
+	require.Nil(t, ctx.GetSecret())
+
+	require.NoError(t, setupSecret(ctx, &backup.Backup{}, map[string]string{}, wrapped, func() ([]byte, error) {
+		return []byte("s3cr3t"), nil
+	}, true))
+	require.Equal(t, key, ctx.GetSecret())
+}
@@ -18,6 +18,7 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -36,9 +37,12 @@ import (
 	"github.com/PlakarKorp/kloset/storage"
 	"github.com/PlakarKorp/plakar/agent"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/metrics"
+	"github.com/PlakarKorp/plakar/reporting"
 	"github.com/PlakarKorp/plakar/subcommands"
 	psync "github.com/PlakarKorp/plakar/subcommands/sync"
 	"github.com/PlakarKorp/plakar/task"
+	"github.com/PlakarKorp/plakar/throttle"
 	"github.com/PlakarKorp/plakar/utils"
 
 	"github.com/vmihailenco/msgpack/v5"
@@ -50,7 +54,16 @@ type AgentStart struct {
 	socketPath string
 	listener   net.Listener
 
-	teardown time.Duration
+	teardown      time.Duration
+	metricsListen string
+
+	listen    string
+	tlsCert   string
+	tlsKey    string
+	tlsCA     string
+	aclFile   string
+	tlsConfig *tls.Config
+	acl       *ACL
 }
 
 func (cmd *AgentStart) Parse(ctx *appcontext.AppContext, args []string) error {
@@ -70,11 +83,32 @@ func (cmd *AgentStart) Parse(ctx *appcontext.AppContext, args []string) error {
 	}
 
 	flags.DurationVar(&cmd.teardown, "teardown", 5*time.Second, "delay before tearing down the agent")
+	flags.StringVar(&cmd.metricsListen, "metrics-listen", "", "serve Prometheus metrics on this address")
+	flags.StringVar(&cmd.listen, "listen", "", "also accept remote clients over TLS on this address")
+	flags.StringVar(&cmd.tlsCert, "tls-cert", "", "certificate of the agent for -listen")
+	flags.StringVar(&cmd.tlsKey, "tls-key", "", "key of the certificate of the agent for -listen")
+	flags.StringVar(&cmd.tlsCA, "tls-ca", "", "CA the certificates of the remote clients are signed by")
+	flags.StringVar(&cmd.aclFile, "acl", "", "file listing the commands allowed to each remote client")
 	flags.Parse(args)
 	if flags.NArg() != 0 {
 		return fmt.Errorf("too many arguments")
 	}
 
+	if cmd.listen != "" {
+		if cmd.tlsCert == "" || cmd.tlsKey == "" || cmd.tlsCA == "" || cmd.aclFile == "" {
+			return fmt.Errorf("-listen requires -tls-cert, -tls-key, -tls-ca and -acl")
+		}
+		var err error
+		cmd.tlsConfig, err = agent.ServerTLSConfig(cmd.tlsCert, cmd.tlsKey, cmd.tlsCA)
+		if err != nil {
+			return err
+		}
+		cmd.acl, err = LoadACL(cmd.aclFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	if !opt_foreground && os.Getenv("REEXEC") == "" {
 		err := daemonize(os.Args)
 		return err
@@ -142,6 +176,33 @@ func (cmd *AgentStart) ListenAndServe(ctx *appcontext.AppContext) error {
 		return fmt.Errorf("failed to bind the socket: %w", err)
 	}
 
+	var remoteListener net.Listener
+	if cmd.listen != "" {
+		remoteListener, err = tls.Listen("tcp", cmd.listen, cmd.tlsConfig)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %w", cmd.listen, err)
+		}
+		defer remoteListener.Close()
+		ctx.GetLogger().Info("accepting remote clients on %s", remoteListener.Addr())
+	}
+
+	if cmd.metricsListen != "" {
+		if err := metrics.Serve(ctx, cmd.metricsListen); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to serve metrics: %w", err)
+		}
+	}
+
+	// the reports of the commands run by the agent that couldn't be
+	// delivered are retried for as long as it runs
+	reporter := reporting.NewReporter(ctx)
+	reporter.RetrySpooled()
+	defer reporter.StopAndWait()
+
+	jobs.serving.Store(true)
+	defer jobs.serving.Store(false)
+
 	cancelled := false
 	go func() {
 		<-ctx.Done()
@@ -151,21 +212,33 @@ func (cmd *AgentStart) ListenAndServe(ctx *appcontext.AppContext) error {
 
 	var inflight atomic.Int64
 	var nextID atomic.Int64
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if cancelled {
-				return ctx.Err()
-			}
 
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				return nil
-			}
-			// TODO: we should retry / wait and retry on
-			// some errors, not everything is fatal.
-			return err
+	// the agent stays around as long as it holds keys or accepts remote
+	// clients
+	teardown := func(myid int64) {
+		if remoteListener != nil {
+			return
 		}
+		time.Sleep(cmd.teardown)
+		if nextID.Load() == myid && inflight.Load() == 0 && keys.empty() {
+			listener.Close()
+		}
+	}
+	keys.mtx.Lock()
+	keys.onEmpty = func() {
+		if inflight.Load() == 0 {
+			go teardown(nextID.Load())
+		}
+	}
+	keys.mtx.Unlock()
+	defer func() {
+		keys.mtx.Lock()
+		keys.onEmpty = nil
+		keys.mtx.Unlock()
+		keys.wipeAll()
+	}()
 
+	serve := func(conn net.Conn, remote bool) {
 		inflight.Add(1)
 
 		go func() {
@@ -173,28 +246,74 @@ func (cmd *AgentStart) ListenAndServe(ctx *appcontext.AppContext) error {
 			defer func() {
 				n := inflight.Add(-1)
 				if n == 0 {
-					time.Sleep(cmd.teardown)
-					if nextID.Load() == myid && inflight.Load() == 0 {
-						listener.Close()
-					}
+					teardown(myid)
 				}
 			}()
 
+			var peer *remotePeer
+			if remote {
+				var err error
+				peer, err = acceptRemote(conn, cmd.acl)
+				if err != nil {
+					ctx.GetLogger().Warn("remote client %s: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+			}
+
 			if err := ctx.ReloadConfig(); err != nil {
 				ctx.GetLogger().Warn("could not load configuration: %v", err)
 			}
 
-			handleClient(ctx, conn)
+			handleClient(ctx, conn, peer)
+		}()
+	}
+
+	if remoteListener != nil {
+		go func() {
+			for {
+				conn, err := remoteListener.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						ctx.GetLogger().Warn("no longer accepting remote clients: %v", err)
+					}
+					return
+				}
+				serve(conn, true)
+			}
 		}()
 	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if cancelled {
+				return ctx.Err()
+			}
+
+			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
+				return nil
+			}
+			// TODO: we should retry / wait and retry on
+			// some errors, not everything is fatal.
+			return err
+		}
+
+		serve(conn, false)
+	}
 }
 
-func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
+// handleClient runs the command sent by a client, local or remote if peer
+// is set.
+func handleClient(ctx *appcontext.AppContext, conn net.Conn, peer *remotePeer) {
 	defer conn.Close()
 
 	mu := sync.Mutex{}
 
 	var encodingErrorOccurred bool
+	// set once the client is gone: the context may also be cancelled
+	// by agent cancel, the client then still gets the outcome
+	var disconnected atomic.Bool
 	encoder := msgpack.NewEncoder(conn)
 	decoder := msgpack.NewDecoder(conn)
 
@@ -213,26 +332,51 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 		return
 	}
 
-	write := func(packet agent.Packet) {
-		if encodingErrorOccurred {
+	// once detached, the output of the job is kept for agent attach
+	var detachedJob atomic.Pointer[Job]
+
+	send := func(packet agent.Packet) {
+		if encodingErrorOccurred || disconnected.Load() {
 			return
 		}
-		select {
-		case <-clientContext.Done():
+		mu.Lock()
+		if err := encoder.Encode(&packet); err != nil {
+			encodingErrorOccurred = true
+			ctx.GetLogger().Warn("client write error: %v", err)
+		}
+		mu.Unlock()
+	}
+
+	write := func(packet agent.Packet) {
+		if job := detachedJob.Load(); job != nil {
+			jobs.output(job, packet)
 			return
-		default:
-			mu.Lock()
-			if err := encoder.Encode(&packet); err != nil {
-				encodingErrorOccurred = true
-				ctx.GetLogger().Warn("client write error: %v", err)
-			}
-			mu.Unlock()
 		}
+		send(packet)
 	}
 
 	stdinchan := make(chan agent.Packet, 1)
 	defer close(stdinchan)
 
+	// the client prompts for the passphrase of the repository on behalf
+	// of the agent, which lacks a terminal
+	passchan := make(chan agent.Packet, 1)
+	askPassphrase := func() ([]byte, error) {
+		if detachedJob.Load() != nil {
+			return nil, fmt.Errorf("no passphrase specified, unlock the repository with plakar agent unlock")
+		}
+		send(agent.Packet{Type: "passphrase", Data: []byte("repository")})
+		select {
+		case pkt := <-passchan:
+			if pkt.Err != "" {
+				return nil, fmt.Errorf("%s", pkt.Err)
+			}
+			return pkt.Data, nil
+		case <-clientContext.Done():
+			return nil, clientContext.Err()
+		}
+	}
+
 	processStdout := func(data string) {
 		write(agent.Packet{
 			Type: "stdout",
@@ -274,11 +418,20 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 				if !isDisconnectError(err) {
 					processStderr(fmt.Sprintf("failed to decode: %s", err))
 				}
-				clientContext.Close()
+				disconnected.Store(true)
+				if detachedJob.Load() == nil {
+					clientContext.Close()
+				}
 				return
 			}
-			if pkt.Type == "stdin" {
+			switch pkt.Type {
+			case "stdin":
 				stdinchan <- pkt
+			case "passphrase":
+				select {
+				case passchan <- pkt:
+				default:
+				}
 			}
 		}
 	}()
@@ -302,8 +455,77 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 	clientContext.CWD = subcommand.GetCWD()
 	clientContext.CommandLine = subcommand.GetCommandLine()
 
+	if peer != nil {
+		if !peer.allowed(name) {
+			ctx.GetLogger().Warn("%s is not allowed to run %s", peer.name, strings.Join(name, " "))
+			write(agent.Packet{
+				Type:     "exit",
+				ExitCode: 1,
+				Err:      fmt.Sprintf("%s: command not allowed", strings.Join(name, " ")),
+			})
+			return
+		}
+		if err := peer.check(subcommand); err != nil {
+			ctx.GetLogger().Warn("%s: %s: %v", peer.name, strings.Join(name, " "), err)
+			write(agent.Packet{
+				Type:     "exit",
+				ExitCode: 1,
+				Err:      fmt.Sprintf("%s: %s", strings.Join(name, " "), err),
+			})
+			return
+		}
+		if subcommand.GetFlags()&subcommands.BeforeRepositoryOpen == 0 {
+			storeConfig, err = remoteStoreConfig(ctx, storeConfig)
+			if err != nil {
+				ctx.GetLogger().Warn("%s: %v", peer.name, err)
+				write(agent.Packet{
+					Type:     "exit",
+					ExitCode: 1,
+					Err:      err.Error(),
+				})
+				return
+			}
+		}
+		// the certificate is what identifies a remote client
+		subcommand.SetUsername(peer.name)
+		subcommand.SetProcessID(0)
+	}
+
 	ctx.GetLogger().Info("%s at %s", strings.Join(name, " "), storeConfig["location"])
 
+	// the agent commands are about the jobs, they are not jobs themselves
+	var job *Job
+	if name[0] != "agent" {
+		job = jobs.add(clientContext, strings.Join(name, " "), storeConfig["location"],
+			subcommand.GetUsername(), subcommand.GetProcessID())
+		defer jobs.remove(job)
+
+		if subcommand.GetDetach() {
+			jobs.detach(job)
+			detachedJob.Store(job)
+			send(agent.Packet{
+				Type: "stdout",
+				Data: fmt.Appendf(nil, "%d\n", job.ID),
+			})
+			send(agent.Packet{Type: "exit"})
+
+			// keep the outcome around until it is collected
+			defer func() {
+				// not set if the command failed to start
+				write(agent.Packet{
+					Type:     "exit",
+					ExitCode: 1,
+					Err:      "job aborted",
+				})
+				select {
+				case <-job.collected:
+				case <-time.After(JOB_RETENTION):
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+
 	var store storage.Store
 	var repo *repository.Repository
 
@@ -319,14 +541,14 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 		defer repo.Close()
 	} else {
 		var serializedConfig []byte
-		store, serializedConfig, err = storage.Open(clientContext.GetInner(), storeConfig)
+		store, serializedConfig, err = throttle.Open(clientContext.GetInner(), storeConfig)
 		if err != nil {
 			clientContext.GetLogger().Warn("Failed to open storage: %v", err)
 			fmt.Fprintf(clientContext.Stderr, "Failed to open storage: %s\n", err)
 			return
 		}
 		defer store.Close(ctx)
-		err := setupSecret(clientContext, subcommand, storeConfig, serializedConfig)
+		err := setupSecret(clientContext, subcommand, storeConfig, serializedConfig, askPassphrase, peer != nil)
 		if err != nil {
 			clientContext.GetLogger().Warn("Failed to setup secret: %v", err)
 			fmt.Fprintf(clientContext.Stderr, "Failed to stup secret: %s\n", err)
@@ -342,6 +564,11 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 		defer repo.Close()
 	}
 
+	if unlockcmd, ok := subcommand.(*AgentUnlock); ok {
+		unlockcmd.storeConfig = storeConfig
+		unlockcmd.askPassphrase = askPassphrase
+	}
+
 	if synccmd, ok := subcommand.(*psync.Sync); ok {
 		if err := setupPeerSecret(clientContext, synccmd); err != nil {
 			clientContext.GetLogger().Warn("Failed to setup peer secret: %v", err)
@@ -350,22 +577,29 @@ func handleClient(ctx *appcontext.AppContext, conn net.Conn) {
 		}
 	}
 
-	status, err := task.RunCommand(clientContext, subcommand, repo, "@agent")
+	if job != nil {
+		jobs.start(job)
+	}
+	status, snapshotID, err := task.RunTask(clientContext, subcommand, repo, "@agent")
 
 	errStr := ""
 	if err != nil {
 		errStr = err.Error()
 	}
 	write(agent.Packet{
-		Type:     "exit",
-		ExitCode: status,
-		Err:      errStr,
+		Type:       "exit",
+		ExitCode:   status,
+		Err:        errStr,
+		SnapshotID: snapshotID,
 	})
 
 	clientContext.Close()
 }
 
-func setupSecret(ctx *appcontext.AppContext, cmd subcommands.Subcommand, storeConfig map[string]string, storageConfig []byte) error {
+// setupSecret sets the key of the repository, if encrypted.  The keys the
+// agent holds are only for its local clients, the remote ones have to
+// provide theirs.
+func setupSecret(ctx *appcontext.AppContext, cmd subcommands.Subcommand, storeConfig map[string]string, storageConfig []byte, askPassphrase func() ([]byte, error), remote bool) error {
 	config, err := storage.NewConfigurationFromWrappedBytes(storageConfig)
 	if err != nil {
 		return err
@@ -375,40 +609,75 @@ func setupSecret(ctx *appcontext.AppContext, cmd subcommands.Subcommand, storeCo
 		return nil
 	}
 
-	getKey := func() ([]byte, error) {
-		if key := cmd.GetRepositorySecret(); key != nil {
-			return key, nil
+	secret := cmd.GetRepositorySecret()
+	if secret == nil && !remote {
+		if key, ok := keys.get(config.RepositoryID); ok {
+			ctx.SetSecret(key)
+			return nil
 		}
+	}
 
-		passphrase, ok := storeConfig["passphrase"]
-		if !ok {
-			cmd, ok := storeConfig["passphrase_cmd"]
-			if !ok {
-				return nil, fmt.Errorf("no passphrase specified")
-			}
-			passphrase, err = utils.GetPassphraseFromCommand(cmd)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read passphrase from command: %w", err)
-			}
+	key, err := getKey(config.Encryption, secret, storeConfig, askPassphrase)
+	if err != nil {
+		return err
+	}
+
+	ctx.SetSecret(key)
+	return nil
+}
+
+// getKey returns the key of an encrypted repository: the one provided by
+// the client, or the one derived from the passphrase in the configuration
+// of the repository, or as a last resort from the passphrase the client is
+// asked for.
+func getKey(config *encryption.Configuration, secret []byte, storeConfig map[string]string, askPassphrase func() ([]byte, error)) ([]byte, error) {
+	if secret != nil {
+		if !encryption.VerifyCanary(config, secret) {
+			return nil, fmt.Errorf("failed to verify key")
+		}
+		return secret, nil
+	}
+
+	var passphrase []byte
+	if p, ok := storeConfig["passphrase"]; ok {
+		passphrase = []byte(p)
+	} else if cmd, ok := storeConfig["passphrase_cmd"]; ok {
+		p, err := utils.GetPassphraseFromCommand(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase from command: %w", err)
 		}
+		passphrase = []byte(p)
+	}
 
-		key, err := encryption.DeriveKey(config.Encryption.KDFParams, []byte(passphrase))
+	if passphrase != nil {
+		key, err := encryption.DeriveKey(config.KDFParams, passphrase)
 		if err != nil {
 			return nil, fmt.Errorf("failed to derive key: %w", err)
 		}
+		if !encryption.VerifyCanary(config, key) {
+			return nil, fmt.Errorf("failed to verify key")
+		}
 		return key, nil
 	}
 
-	key, err := getKey()
-	if err != nil {
-		return err
+	if askPassphrase == nil {
+		return nil, fmt.Errorf("no passphrase specified")
 	}
-	if !encryption.VerifyCanary(config.Encryption, key) {
-		return fmt.Errorf("failed to verify key")
+	for range 3 {
+		passphrase, err := askPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		key, err := encryption.DeriveKey(config.KDFParams, passphrase)
+		clear(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		if encryption.VerifyCanary(config, key) {
+			return key, nil
+		}
 	}
-
-	ctx.SetSecret(key)
-	return nil
+	return nil, fmt.Errorf("failed to verify key")
 }
 
 func setupPeerSecret(ctx *appcontext.AppContext, cmd *psync.Sync) error {
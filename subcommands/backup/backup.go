@@ -20,7 +20,9 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -31,7 +33,9 @@ import (
 	"github.com/PlakarKorp/kloset/snapshot"
 	"github.com/PlakarKorp/kloset/snapshot/importer"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/jsonevents"
 	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/PlakarKorp/plakar/throttle"
 	"github.com/PlakarKorp/plakar/utils"
 	"github.com/dustin/go-humanize"
 )
@@ -75,14 +79,36 @@ func (e *tagFlags) asList() []string {
 	return strings.Split(tags, ",")
 }
 
+type labelFlags map[string]string
+
+func (e labelFlags) String() string {
+	labels := make([]string, 0, len(e))
+	for k, v := range e {
+		labels = append(labels, k+"="+v)
+	}
+	slices.Sort(labels)
+	return strings.Join(labels, ",")
+}
+
+func (e labelFlags) Set(value string) error {
+	k, v, found := strings.Cut(value, "=")
+	if !found || k == "" {
+		return fmt.Errorf("invalid label %q, expected key=value", value)
+	}
+	e[k] = v
+	return nil
+}
+
 func (cmd *Backup) Parse(ctx *appcontext.AppContext, args []string) error {
 	var opt_ignore_file string
 	var opt_ignore ignoreFlags
 	var opt_tags tagFlags
+	var opt_exclude_if excludeIfFlags
 
 	excludes := []string{}
 
 	cmd.Opts = make(map[string]string)
+	cmd.Labels = make(map[string]string)
 
 	flags := flag.NewFlagSet("backup", flag.ExitOnError)
 	flags.Usage = func() {
@@ -94,15 +120,31 @@ func (cmd *Backup) Parse(ctx *appcontext.AppContext, args []string) error {
 
 	flags.Uint64Var(&cmd.Concurrency, "concurrency", uint64(ctx.MaxConcurrency), "maximum number of parallel tasks")
 	flags.Var(&opt_tags, "tag", "comma-separated list of tags to apply to the snapshot")
+	flags.StringVar(&cmd.Name, "name", "", "name of the snapshot")
+	flags.StringVar(&cmd.Category, "category", "", "category of the snapshot")
+	flags.StringVar(&cmd.Environment, "environment", "", "environment of the snapshot")
+	flags.StringVar(&cmd.Perimeter, "perimeter", "", "perimeter of the snapshot")
+	flags.StringVar(&cmd.Job, "job", "", "job of the snapshot")
+	flags.Var(labelFlags(cmd.Labels), "label", "key=value label to apply to the snapshot, can be specified multiple times")
 	flags.StringVar(&opt_ignore_file, "ignore-file", "", "path to a file containing newline-separated gitignore patterns, treated as -ignore")
+	flags.Var(&opt_exclude_if, "exclude-if", "rule on the attributes of the files to exclude, such as \"size>4GiB\", can be specified multiple times")
+	flags.BoolVar(&cmd.PlakarIgnore, "plakarignore", false, "apply the patterns of the .plakarignore files found in the source to their directory")
 	flags.Var(&opt_ignore, "ignore", "gitignore pattern to exclude files, can be specified multiple times to add several exclusion patterns")
 	flags.StringVar(&cmd.OnDiskPackfilePath, "disk-based", "off", "on or off or a path where to put temporary packfiles")
 	flags.BoolVar(&cmd.Quiet, "quiet", false, "suppress output")
 	flags.BoolVar(&cmd.Silent, "silent", false, "suppress ALL output")
+	flags.BoolVar(&cmd.JSON, "json", false, "output the progress and the outcome of the backup as JSON lines")
 	flags.BoolVar(&cmd.OptCheck, "check", false, "check the snapshot after creating it")
 	flags.Var(utils.NewOptsFlag(cmd.Opts), "o", "specify extra importer options")
+	flags.Var(throttle.NewRateFlag(&cmd.LimitUpload), "limit-upload", "maximum rate of the writes to the repository, in bytes per second")
+	flags.Var(throttle.NewRateFlag(&cmd.LimitDownload), "limit-download", "maximum rate of the reads from the repository, in bytes per second")
+	flags.Var(throttle.NewRateFlag(&cmd.LimitRead), "limit-read", "maximum rate of the reads from the source, in bytes per second")
 	flags.BoolVar(&cmd.DryRun, "scan", false, "do not actually perform a backup, just list the files")
 	flags.Var(locate.NewTimeFlag(&cmd.ForcedTimestamp), "force-timestamp", "force a timestamp")
+	flags.StringVar(&cmd.PreHook, "pre-hook", "", "command to run before the backup, a failure aborts the backup")
+	flags.StringVar(&cmd.PostHook, "post-hook", "", "command to run after the backup, whatever its outcome")
+	flags.StringVar(&cmd.FailHook, "fail-hook", "", "command to run if the backup fails")
+	flags.DurationVar(&cmd.HookTimeout, "hook-timeout", DefaultHookTimeout, "maximum duration of each hook")
 	//flags.BoolVar(&opt_stdio, "stdio", false, "output one line per file to stdout instead of the default interactive output")
 	flags.Parse(args)
 
@@ -110,6 +152,10 @@ func (cmd *Backup) Parse(ctx *appcontext.AppContext, args []string) error {
 		return fmt.Errorf("Too many arguments")
 	}
 
+	if cmd.JSON && cmd.DryRun {
+		return fmt.Errorf("-json can't be used with -scan")
+	}
+
 	if !cmd.ForcedTimestamp.IsZero() {
 		if cmd.ForcedTimestamp.After(time.Now()) {
 			return fmt.Errorf("forced timestamp cannot be in the future")
@@ -138,6 +184,7 @@ func (cmd *Backup) Parse(ctx *appcontext.AppContext, args []string) error {
 
 	cmd.RepositorySecret = ctx.GetSecret()
 	cmd.Excludes = excludes
+	cmd.ExcludeIf = opt_exclude_if
 	cmd.Path = flags.Arg(0)
 	cmd.Tags = opt_tags.asList()
 
@@ -152,17 +199,49 @@ type Backup struct {
 	subcommands.SubcommandBase
 
 	Job                string
+	Name               string
+	Category           string
+	Environment        string
+	Perimeter          string
+	Labels             map[string]string
 	Concurrency        uint64
 	Tags               []string
 	Excludes           []string
+	ExcludeIf          []string
 	Silent             bool
 	Quiet              bool
+	JSON               bool
 	Path               string
 	OptCheck           bool
 	Opts               map[string]string
 	DryRun             bool
+	PlakarIgnore       bool
 	OnDiskPackfilePath string
 	ForcedTimestamp    time.Time
+	PreHook            string
+	PostHook           string
+	FailHook           string
+	HookTimeout        time.Duration
+	LimitUpload        int64
+	LimitDownload      int64
+	LimitRead          int64
+
+	phases []Phase
+}
+
+// Phase is the time spent in a step of the backup.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Phases returns how long each step of the last backup took.
+func (cmd *Backup) Phases() []Phase {
+	return cmd.phases
+}
+
+func (cmd *Backup) endPhase(name string, start time.Time) {
+	cmd.phases = append(cmd.phases, Phase{Name: name, Duration: time.Since(start)})
 }
 
 func (cmd *Backup) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
@@ -171,6 +250,25 @@ func (cmd *Backup) Execute(ctx *appcontext.AppContext, repo *repository.Reposito
 }
 
 func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Repository) (int, error, objects.MAC, error) {
+	cmd.phases = nil
+	if cmd.DryRun {
+		return cmd.doBackup(ctx, repo)
+	}
+
+	if cmd.JSON {
+		ep := jsonevents.Start(ctx)
+		ret, err, snapshotID, warning := cmd.withHooks(ctx, repo, func() (int, error, objects.MAC, error) {
+			return cmd.doBackup(ctx, repo)
+		})
+		ep.CloseWithWarning(err, warning)
+		return ret, err, snapshotID, warning
+	}
+	return cmd.withHooks(ctx, repo, func() (int, error, objects.MAC, error) {
+		return cmd.doBackup(ctx, repo)
+	})
+}
+
+func (cmd *Backup) doBackup(ctx *appcontext.AppContext, repo *repository.Repository) (int, error, objects.MAC, error) {
 	opts := &snapshot.BackupOptions{
 		MaxConcurrency: cmd.Concurrency,
 		Name:           "default",
@@ -178,6 +276,10 @@ func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Reposit
 		Excludes:       cmd.Excludes,
 	}
 
+	if cmd.Name != "" {
+		opts.Name = cmd.Name
+	}
+
 	if !cmd.ForcedTimestamp.IsZero() {
 		opts.ForcedTimestamp = cmd.ForcedTimestamp
 	}
@@ -211,19 +313,53 @@ func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Reposit
 		cmd.Opts["location"] = scanDir
 	}
 
+	readLimiter, err := throttle.ImporterLimiter(cmd.Opts)
+	if err != nil {
+		return 1, err, objects.MAC{}, nil
+	}
+	if cmd.LimitRead != 0 {
+		readLimiter = throttle.NewLimiter(cmd.LimitRead)
+	}
+
 	imp, err := importer.NewImporter(ctx.GetInner(), ctx.ImporterOpts(), cmd.Opts)
 	if err != nil {
 		return 1, fmt.Errorf("failed to create an importer for %s: %s", scanDir, err), objects.MAC{}, nil
 	}
 	defer imp.Close(ctx)
+	imp = throttle.NewImporter(imp, readLimiter)
+
+	if len(cmd.ExcludeIf) != 0 {
+		rules := make([]*ExcludeRule, 0, len(cmd.ExcludeIf))
+		for _, rule := range cmd.ExcludeIf {
+			r, err := ParseExcludeRule(rule)
+			if err != nil {
+				return 1, err, objects.MAC{}, nil
+			}
+			rules = append(rules, r)
+		}
+		if imp, err = newExcludeRules(ctx, imp, rules); err != nil {
+			return 1, err, objects.MAC{}, nil
+		}
+	}
+
+	var ignores *ignoreTree
+	if cmd.PlakarIgnore {
+		ignores, err = newIgnoreTree(ctx, imp)
+		if err != nil {
+			return 1, err, objects.MAC{}, nil
+		}
+		imp = ignores
+	}
 
 	if cmd.DryRun {
-		if err := dryrun(ctx, imp, cmd.Excludes); err != nil {
+		if err := dryrun(ctx, imp, cmd.Excludes, ignores); err != nil {
 			return 1, err, objects.MAC{}, nil
 		}
 		return 0, nil, objects.MAC{}, nil
 	}
 
+	throttle.SetLimiters(repo.Store(), throttle.NewLimiter(cmd.LimitUpload), throttle.NewLimiter(cmd.LimitDownload))
+
 	snap, err := snapshot.Create(repo, repository.DefaultType, cmd.OnDiskPackfilePath)
 	if err != nil {
 		ctx.GetLogger().Error("%s", err)
@@ -231,11 +367,35 @@ func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Reposit
 	}
 	defer snap.Close()
 
+	if ignores != nil {
+		ignores.done = func(rules []string) {
+			if len(rules) != 0 {
+				snap.Header.SetContext(utils.PLAKARIGNORE_CONTEXT, strings.Join(rules, "\n"))
+			}
+		}
+	}
+
 	if cmd.Job != "" {
 		snap.Header.Job = cmd.Job
 	}
+	if cmd.Category != "" {
+		snap.Header.Category = cmd.Category
+	}
+	if cmd.Environment != "" {
+		snap.Header.Environment = cmd.Environment
+	}
+	if cmd.Perimeter != "" {
+		snap.Header.Perimeter = cmd.Perimeter
+	}
+	for _, k := range slices.Sorted(maps.Keys(cmd.Labels)) {
+		snap.Header.SetContext(utils.LABEL_PREFIX+k, cmd.Labels[k])
+	}
+
+	timer := newPhaseTimer(ctx, imp, snap.Header.Identifier)
+	imp = timer
 
-	if cmd.Silent {
+	backupStart := time.Now()
+	if cmd.Silent || cmd.JSON {
 		if err := snap.Backup(imp, opts); err != nil {
 			return 1, fmt.Errorf("failed to create snapshot: %w", err), objects.MAC{}, nil
 		}
@@ -252,8 +412,10 @@ func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Reposit
 		}
 		ep.Close()
 	}
+	cmd.phases = append(cmd.phases, timer.phases(backupStart)...)
 
 	if cmd.OptCheck {
+		defer cmd.endPhase("check", time.Now())
 		repo.RebuildState()
 
 		checkOptions := &snapshot.CheckOptions{
@@ -282,13 +444,15 @@ func (cmd *Backup) DoBackup(ctx *appcontext.AppContext, repo *repository.Reposit
 
 	totalSize := snap.Header.GetSource(0).Summary.Directory.Size + snap.Header.GetSource(0).Summary.Below.Size
 
-	ctx.GetLogger().Info("backup: created %s snapshot %x of size %s in %s (wrote %s)",
-		"unsigned",
-		snap.Header.GetIndexShortID(),
-		humanize.IBytes(totalSize),
-		snap.Header.Duration,
-		humanize.IBytes(uint64(snap.Repository().WBytes())),
-	)
+	if !cmd.JSON {
+		ctx.GetLogger().Info("backup: created %s snapshot %x of size %s in %s (wrote %s)",
+			"unsigned",
+			snap.Header.GetIndexShortID(),
+			humanize.IBytes(totalSize),
+			snap.Header.Duration,
+			humanize.IBytes(uint64(snap.Repository().WBytes())),
+		)
+	}
 
 	totalErrors := uint64(0)
 	for i := 0; i < len(snap.Header.Sources); i++ {
@@ -327,7 +491,7 @@ func LoadIgnoreFile(filename string) ([]string, error) {
 	return lines, nil
 }
 
-func dryrun(ctx *appcontext.AppContext, imp importer.Importer, excludePatterns []string) error {
+func dryrun(ctx *appcontext.AppContext, imp importer.Importer, excludePatterns []string, ignores *ignoreTree) error {
 	scanner, err := imp.Scan(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to scan: %w", err)
@@ -369,6 +533,12 @@ func dryrun(ctx *appcontext.AppContext, imp importer.Importer, excludePatterns [
 		}
 	}
 
+	if ignores != nil {
+		for _, rule := range ignores.Rules() {
+			fmt.Fprintf(ctx.Stderr, "%s: %s\n", PLAKARIGNORE, rule)
+		}
+	}
+
 	if errors {
 		return fmt.Errorf("failed to scan some files")
 	}
@@ -2,22 +2,29 @@ package backup
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/PlakarKorp/integration-fs/importer"
 	bfs "github.com/PlakarKorp/integration-fs/storage"
 	"github.com/PlakarKorp/kloset/caching"
 	"github.com/PlakarKorp/kloset/hashing"
 	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/kloset/repository"
 	"github.com/PlakarKorp/kloset/resources"
+	"github.com/PlakarKorp/kloset/snapshot"
 	"github.com/PlakarKorp/kloset/storage"
 	"github.com/PlakarKorp/kloset/versioning"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/jsonevents"
+	"github.com/PlakarKorp/plakar/utils"
 	"github.com/stretchr/testify/require"
 )
 
@@ -153,3 +160,301 @@ func TestExecuteCmdCreateDefaultWithIgnores(t *testing.T) {
 	output := bufOut.String()
 	require.NotContains(t, output, "/subdir")
 }
+
+func TestExecuteCmdCreateWithHooks(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+
+	repo, tmpBackupDir, ctx := generateFixtures(t, bufOut, bufErr)
+
+	ctx.MaxConcurrency = 1
+	trace := t.TempDir() + "/trace"
+
+	args := []string{
+		"-silent",
+		"-pre-hook", "echo pre $PLAKAR_HOOK >> " + trace,
+		"-post-hook", "echo post $PLAKAR_STATUS $PLAKAR_SNAPSHOT_ID >> " + trace,
+		"-fail-hook", "echo failed >> " + trace,
+		tmpBackupDir,
+	}
+
+	subcommand := &Backup{}
+	err := subcommand.Parse(ctx, args)
+	require.NoError(t, err)
+
+	status, err, snapshotID, _ := subcommand.DoBackup(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	data, err := os.ReadFile(trace)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("pre pre\npost ok %x\n", snapshotID), string(data))
+
+	var phases []string
+	for _, phase := range subcommand.Phases() {
+		phases = append(phases, phase.Name)
+	}
+	require.Equal(t, []string{"pre-hook", "scan", "upload", "commit", "post-hook"}, phases)
+
+	// a failing pre-hook aborts the backup
+	require.NoError(t, os.Remove(trace))
+	subcommand.PreHook = "exit 1"
+	status, err, _, _ = subcommand.DoBackup(ctx, repo)
+	require.Error(t, err)
+	require.Equal(t, 1, status)
+
+	data, err = os.ReadFile(trace)
+	require.NoError(t, err)
+	require.Equal(t, "failed\n", string(data))
+}
+
+func TestExecuteCmdCreateJSON(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+	bufJSON := bytes.NewBuffer(nil)
+
+	repo, tmpBackupDir, ctx := generateFixtures(t, bufOut, bufErr)
+	ctx.Stdout = bufJSON
+
+	ctx.MaxConcurrency = 1
+	args := []string{"-json", tmpBackupDir}
+
+	subcommand := &Backup{}
+	err := subcommand.Parse(ctx, args)
+	require.NoError(t, err)
+	require.NotNil(t, subcommand)
+
+	status, err := subcommand.Execute(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	// nothing is logged, every line is a JSON event
+	require.NotContains(t, bufOut.String(), "created unsigned snapshot")
+
+	lines := strings.Split(strings.Trim(bufJSON.String(), "\n"), "\n")
+	var summary jsonevents.Summary
+	for _, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &summary), line)
+	}
+	require.Equal(t, "summary", summary.Type)
+	require.Equal(t, "ok", summary.Status)
+	require.Len(t, summary.Snapshots, 1)
+	require.Equal(t, uint64(4), summary.Files)
+	require.Contains(t, bufJSON.String(), `"path":"`+tmpBackupDir+`/subdir/foo.txt","status":"ok"`)
+
+	// a failing post-hook is a warning
+	bufJSON.Reset()
+	subcommand.PostHook = "exit 1"
+	status, err = subcommand.Execute(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	lines = strings.Split(strings.Trim(bufJSON.String(), "\n"), "\n")
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &summary))
+	require.Equal(t, "warning", summary.Status)
+	require.NotEmpty(t, summary.Warning)
+
+	// the list of -scan isn't JSON
+	err = (&Backup{}).Parse(ctx, []string{"-json", "-scan", tmpBackupDir})
+	require.Error(t, err)
+}
+
+func TestExecuteCmdCreateClassification(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+
+	repo, tmpBackupDir, ctx := generateFixtures(t, bufOut, bufErr)
+
+	ctx.MaxConcurrency = 1
+	args := []string{"-name", "db", "-category", "database", "-environment", "prod",
+		"-perimeter", "eu", "-job", "nightly", "-label", "team=infra", "-label", "tier=1",
+		tmpBackupDir}
+
+	subcommand := &Backup{}
+	err := subcommand.Parse(ctx, args)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"team": "infra", "tier": "1"}, subcommand.Labels)
+
+	status, err, snapshotID, _ := subcommand.DoBackup(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	repo.RebuildState()
+	snap, err := snapshot.Load(repo, snapshotID)
+	require.NoError(t, err)
+	defer snap.Close()
+
+	require.Equal(t, "db", snap.Header.Name)
+	require.Equal(t, "database", snap.Header.Category)
+	require.Equal(t, "prod", snap.Header.Environment)
+	require.Equal(t, "eu", snap.Header.Perimeter)
+	require.Equal(t, "nightly", snap.Header.Job)
+	require.Equal(t, "infra", snap.Header.GetContext(utils.LABEL_PREFIX+"team"))
+	require.Equal(t, "1", snap.Header.GetContext(utils.LABEL_PREFIX+"tier"))
+}
+
+func TestLabelFlags(t *testing.T) {
+	labels := labelFlags{}
+	require.NoError(t, labels.Set("team=infra"))
+	require.NoError(t, labels.Set("empty="))
+	require.NoError(t, labels.Set("url=https://example.com/?a=b"))
+	require.Equal(t, "https://example.com/?a=b", labels["url"])
+	require.Equal(t, "empty=,team=infra,url=https://example.com/?a=b", labels.String())
+
+	require.Error(t, labels.Set("team"))
+	require.Error(t, labels.Set("=infra"))
+}
+
+func TestAnchorPattern(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"*.log":      "/src/app/**/*.log",
+		"build/":     "/src/app/**/build/",
+		"/vendor":    "/src/app/vendor",
+		"doc/*.html": "/src/app/doc/*.html",
+		"!keep.log":  "!/src/app/**/keep.log",
+		"tmp   ":     "/src/app/**/tmp",
+	} {
+		require.Equal(t, expected, anchorPattern("/src/app", pattern), pattern)
+	}
+	require.Equal(t, "/**/*.o", anchorPattern("/", "*.o"))
+	require.Equal(t, `/src/a\*b/**/x`, anchorPattern("/src/a*b", "x"))
+}
+
+func TestExecuteCmdCreatePlakarIgnore(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+
+	repo, tmpBackupDir, ctx := generateFixtures(t, bufOut, bufErr)
+	bufStdout := bytes.NewBuffer(nil)
+	bufStderr := bytes.NewBuffer(nil)
+	ctx.Stdout = bufStdout
+	ctx.Stderr = bufStderr
+
+	// foo.txt is ignored by the top-level file, bar by the one of its
+	// directory, and dummy.txt is re-included by the deeper file
+	require.NoError(t, os.WriteFile(tmpBackupDir+"/.plakarignore", []byte("# comment\n*.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(tmpBackupDir+"/subdir/.plakarignore", []byte("!dummy.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(tmpBackupDir+"/another_subdir/.plakarignore", []byte("/bar\n"), 0644))
+
+	ctx.MaxConcurrency = 1
+	subcommand := &Backup{}
+	err := subcommand.Parse(ctx, []string{"-scan", "-plakarignore", tmpBackupDir})
+	require.NoError(t, err)
+	status, err := subcommand.Execute(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	output := bufStdout.String()
+	require.Contains(t, output, tmpBackupDir+"/subdir/dummy.txt\n")
+	require.Contains(t, output, tmpBackupDir+"/subdir/to_exclude\n")
+	require.Contains(t, output, tmpBackupDir+"/subdir/.plakarignore\n")
+	require.NotContains(t, output, tmpBackupDir+"/subdir/foo.txt\n")
+	require.NotContains(t, output, tmpBackupDir+"/another_subdir/bar\n")
+	require.Contains(t, bufStderr.String(), ".plakarignore: "+tmpBackupDir+"/**/*.txt\n")
+	require.Contains(t, bufStderr.String(), ".plakarignore: "+tmpBackupDir+"/another_subdir/bar\n")
+
+	subcommand = &Backup{}
+	err = subcommand.Parse(ctx, []string{"-plakarignore", tmpBackupDir})
+	require.NoError(t, err)
+	status, err, snapshotID, _ := subcommand.DoBackup(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	repo.RebuildState()
+	snap, err := snapshot.Load(repo, snapshotID)
+	require.NoError(t, err)
+	defer snap.Close()
+
+	require.Equal(t, strings.Join([]string{
+		tmpBackupDir + "/**/*.txt",
+		tmpBackupDir + "/another_subdir/bar",
+		"!" + tmpBackupDir + "/subdir/**/dummy.txt",
+	}, "\n"), snap.Header.GetContext(utils.PLAKARIGNORE_CONTEXT))
+
+	fs, err := snap.Filesystem()
+	require.NoError(t, err)
+	_, err = fs.GetEntry(tmpBackupDir + "/subdir/dummy.txt")
+	require.NoError(t, err)
+	_, err = fs.GetEntry(tmpBackupDir + "/subdir/foo.txt")
+	require.Error(t, err)
+	_, err = fs.GetEntry(tmpBackupDir + "/another_subdir/bar")
+	require.Error(t, err)
+}
+
+func TestParseExcludeRule(t *testing.T) {
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := objects.FileInfo{Lname: "f", Lsize: 5 << 30, Lmode: 0644, LmodTime: old, Luid: 1000, Lgid: 100, Lusername: "alice"}
+	socket := objects.FileInfo{Lname: "s", Lmode: fs.ModeSocket | 0755, LmodTime: time.Now()}
+	dir := objects.FileInfo{Lname: "d", Lsize: 5 << 30, Lmode: fs.ModeDir | 0755, LmodTime: old}
+
+	for rule, expected := range map[string][3]bool{
+		"size>4GiB":                  {true, false, false},
+		"size<=4GiB":                 {false, true, false},
+		"mtime<5y":                   {true, false, false},
+		"mtime>2001-01-01":           {false, true, false},
+		"type=socket,device":         {false, true, false},
+		"type!=file":                 {false, true, false},
+		"owner=alice":                {true, false, false},
+		"owner=1000 size>1GiB":       {true, false, false},
+		"owner!=alice size>1k":       {false, false, false},
+		"group=0":                    {false, true, false},
+		"marker=CACHEDIR.TAG":        {false, false, false},
+		"size>1k   mtime<2001-01-01": {true, false, false},
+	} {
+		r, err := ParseExcludeRule(rule)
+		require.NoError(t, err, rule)
+		require.Equal(t, rule, r.String())
+		require.Equal(t, expected, [3]bool{r.Match(&file), r.Match(&socket), r.Match(&dir)}, rule)
+	}
+
+	for _, rule := range []string{
+		"",
+		"size",
+		"size>",
+		"size!=4GiB",
+		"size>lots",
+		"mtime=5y",
+		"mtime<whenever",
+		"type=dir",
+		"owner<alice",
+		"color=blue",
+		"marker=",
+		"marker=a/b",
+		"marker=CACHEDIR.TAG size>1k",
+	} {
+		_, err := ParseExcludeRule(rule)
+		require.Error(t, err, rule)
+	}
+}
+
+func TestExecuteCmdCreateExcludeIf(t *testing.T) {
+	bufOut := bytes.NewBuffer(nil)
+	bufErr := bytes.NewBuffer(nil)
+
+	repo, tmpBackupDir, ctx := generateFixtures(t, bufOut, bufErr)
+	bufStdout := bytes.NewBuffer(nil)
+	ctx.Stdout = bufStdout
+
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(tmpBackupDir+"/subdir/foo.txt", old, old))
+	require.NoError(t, os.WriteFile(tmpBackupDir+"/another_subdir/CACHEDIR.TAG", []byte("Signature: 8a477f597d28d172789f06886806bc55\n"), 0644))
+
+	ctx.MaxConcurrency = 1
+	subcommand := &Backup{}
+	err := subcommand.Parse(ctx, []string{"-scan",
+		"-exclude-if", "size>10",
+		"-exclude-if", "mtime<2001-01-01",
+		"-exclude-if", "marker=CACHEDIR.TAG",
+		tmpBackupDir})
+	require.NoError(t, err)
+	status, err := subcommand.Execute(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	output := bufStdout.String()
+	require.Contains(t, output, tmpBackupDir+"/subdir\n")
+	require.NotContains(t, output, tmpBackupDir+"/subdir/dummy.txt\n")
+	require.NotContains(t, output, tmpBackupDir+"/subdir/to_exclude\n")
+	require.NotContains(t, output, tmpBackupDir+"/subdir/foo.txt\n")
+	require.NotContains(t, output, tmpBackupDir+"/another_subdir")
+}
@@ -0,0 +1,352 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/snapshot/importer"
+	"github.com/dustin/go-humanize"
+)
+
+// condition is a test on the attributes of an entry.
+type condition func(fi *objects.FileInfo) bool
+
+// ExcludeRule is a rule of -exclude-if, made of space-separated conditions
+// which must all hold for an entry to be excluded:
+//
+//	size>4GiB           the size compared with <, <=, =, >= or >
+//	mtime<5y            the modification time, compared with a date or a
+//	                    duration before now as for -since
+//	type=socket,device  the type, one of file, symlink, device, pipe or
+//	                    socket; != negates
+//	owner=root          the user, by name or uid; != negates
+//	group=1000          the group, by name or gid; != negates
+//	marker=CACHEDIR.TAG the directories holding such a file
+//
+// The attribute conditions apply to all the entries but directories, a
+// marker excludes a directory with all its content and can't be combined
+// with other conditions.
+type ExcludeRule struct {
+	rule       string
+	conditions []condition
+	marker     string
+}
+
+func (r *ExcludeRule) String() string {
+	return r.rule
+}
+
+func compare(op string, a, b int64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case "=":
+		return a == b
+	case ">=":
+		return a >= b
+	default:
+		return a > b
+	}
+}
+
+// splitCondition splits a condition into its attribute, operator and
+// value.
+func splitCondition(cond string) (string, string, string, error) {
+	i := strings.IndexAny(cond, "<>=!")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("invalid condition %q", cond)
+	}
+	j := i
+	for j < len(cond) && strings.IndexByte("<>=!", cond[j]) >= 0 {
+		j++
+	}
+	if j == len(cond) {
+		return "", "", "", fmt.Errorf("missing value in condition %q", cond)
+	}
+	return cond[:i], cond[i:j], cond[j:], nil
+}
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case mode&fs.ModeNamedPipe != 0:
+		return "pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	default:
+		return ""
+	}
+}
+
+// equality returns a condition testing whether one of the values, when op
+// is "=", or none of them, when it is "!=", holds.
+func equality(op string, match func(fi *objects.FileInfo, value string) bool, values []string) (condition, error) {
+	if op != "=" && op != "!=" {
+		return nil, fmt.Errorf("unsupported operator %q", op)
+	}
+	return func(fi *objects.FileInfo) bool {
+		for _, value := range values {
+			if match(fi, value) {
+				return op == "="
+			}
+		}
+		return op == "!="
+	}, nil
+}
+
+func parseCondition(cond string) (condition, error) {
+	attr, op, value, err := splitCondition(cond)
+	if err != nil {
+		return nil, err
+	}
+
+	switch attr {
+	case "size":
+		if !slices.Contains([]string{"<", "<=", "=", ">=", ">"}, op) {
+			return nil, fmt.Errorf("unsupported operator %q for size", op)
+		}
+		size, err := humanize.ParseBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %w", value, err)
+		}
+		return func(fi *objects.FileInfo) bool {
+			return compare(op, fi.Size(), int64(size))
+		}, nil
+
+	case "mtime":
+		if op != "<" && op != ">" {
+			return nil, fmt.Errorf("unsupported operator %q for mtime", op)
+		}
+		t, err := locate.ParseTimeFlag(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(fi *objects.FileInfo) bool {
+			if op == "<" {
+				return fi.ModTime().Before(t)
+			}
+			return fi.ModTime().After(t)
+		}, nil
+
+	case "type":
+		types := strings.Split(value, ",")
+		for _, typ := range types {
+			switch typ {
+			case "file", "symlink", "device", "pipe", "socket":
+			default:
+				return nil, fmt.Errorf("unknown file type %q", typ)
+			}
+		}
+		return equality(op, func(fi *objects.FileInfo, value string) bool {
+			return fileType(fi.Mode()) == value
+		}, types)
+
+	case "owner", "group":
+		return equality(op, func(fi *objects.FileInfo, value string) bool {
+			name, id := fi.Username(), fi.Uid()
+			if attr == "group" {
+				name, id = fi.Groupname(), fi.Gid()
+			}
+			if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+				return id == n
+			}
+			return name == value
+		}, strings.Split(value, ","))
+
+	default:
+		return nil, fmt.Errorf("unknown attribute %q", attr)
+	}
+}
+
+// ParseExcludeRule parses a rule of -exclude-if.
+func ParseExcludeRule(rule string) (*ExcludeRule, error) {
+	r := &ExcludeRule{rule: rule}
+	conds := strings.Fields(rule)
+	if len(conds) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+
+	for _, cond := range conds {
+		if marker, found := strings.CutPrefix(cond, "marker="); found {
+			if len(conds) != 1 {
+				return nil, fmt.Errorf("invalid rule %q: marker can't be combined with other conditions", rule)
+			}
+			if marker == "" || strings.Contains(marker, "/") {
+				return nil, fmt.Errorf("invalid marker %q", marker)
+			}
+			r.marker = marker
+			return r, nil
+		}
+
+		c, err := parseCondition(cond)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+		r.conditions = append(r.conditions, c)
+	}
+	return r, nil
+}
+
+// Match tells whether the rule excludes an entry with the given
+// attributes, marker rules never match.
+func (r *ExcludeRule) Match(fi *objects.FileInfo) bool {
+	if len(r.conditions) == 0 || fi.IsDir() {
+		return false
+	}
+	for _, c := range r.conditions {
+		if !c(fi) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludeRules is an importer skipping the entries matched by rules of
+// -exclude-if.  The marker files are looked up on the local filesystem,
+// so marker rules are only supported by the fs importer.
+type excludeRules struct {
+	importer.Importer
+
+	rules   []*ExcludeRule
+	markers []string
+	root    string
+	marked  map[string]bool
+
+	// entries excluded, to exclude their extended attributes too
+	skipped map[string]struct{}
+}
+
+func newExcludeRules(ctx context.Context, imp importer.Importer, rules []*ExcludeRule) (*excludeRules, error) {
+	e := &excludeRules{
+		Importer: imp,
+		rules:    rules,
+		marked:   make(map[string]bool),
+		skipped:  make(map[string]struct{}),
+	}
+	for _, rule := range rules {
+		if rule.marker != "" {
+			e.markers = append(e.markers, rule.marker)
+		}
+	}
+
+	if len(e.markers) != 0 {
+		typ, err := imp.Type(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "fs" {
+			return nil, fmt.Errorf("marker rules are only supported on filesystem sources")
+		}
+		if e.root, err = imp.Root(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// hasMarker tells whether dir, or one of its parents under the root,
+// holds a marker file.
+func (e *excludeRules) hasMarker(dir string) bool {
+	if dir != e.root && e.root != "/" && !strings.HasPrefix(dir, e.root+"/") {
+		return false
+	}
+	if marked, ok := e.marked[dir]; ok {
+		return marked
+	}
+
+	marked := false
+	if dir != e.root {
+		marked = e.hasMarker(path.Dir(dir))
+	}
+	for _, marker := range e.markers {
+		if marked {
+			break
+		}
+		_, err := os.Stat(localPath(path.Join(dir, marker)))
+		marked = err == nil
+	}
+	e.marked[dir] = marked
+	return marked
+}
+
+func (e *excludeRules) IsExcluded(pathname string, fi *objects.FileInfo) bool {
+	if len(e.markers) != 0 && pathname != e.root {
+		if e.hasMarker(path.Dir(pathname)) || (fi != nil && fi.IsDir() && e.hasMarker(pathname)) {
+			return true
+		}
+	}
+	if fi == nil {
+		return false
+	}
+	for _, rule := range e.rules {
+		if rule.Match(fi) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *excludeRules) Scan(ctx context.Context) (<-chan *importer.ScanResult, error) {
+	results, err := e.Importer.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(chan *importer.ScanResult, cap(results))
+	go func() {
+		defer close(filtered)
+		for result := range results {
+			var excluded bool
+			switch {
+			case result.Record != nil && result.Record.IsXattr:
+				_, excluded = e.skipped[result.Record.Pathname]
+				excluded = excluded || e.IsExcluded(result.Record.Pathname, nil)
+			case result.Record != nil:
+				excluded = e.IsExcluded(result.Record.Pathname, &result.Record.FileInfo)
+				if excluded && len(result.Record.ExtendedAttributes) != 0 {
+					e.skipped[result.Record.Pathname] = struct{}{}
+				}
+			case result.Error != nil:
+				excluded = e.IsExcluded(result.Error.Pathname, nil)
+			}
+
+			if excluded {
+				if result.Record != nil {
+					result.Record.Close()
+				}
+				continue
+			}
+			filtered <- result
+		}
+	}()
+	return filtered, nil
+}
+
+type excludeIfFlags []string
+
+func (e *excludeIfFlags) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *excludeIfFlags) Set(value string) error {
+	if _, err := ParseExcludeRule(value); err != nil {
+		return err
+	}
+	*e = append(*e, value)
+	return nil
+}
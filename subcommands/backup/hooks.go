@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/plakar/appcontext"
+)
+
+const DefaultHookTimeout = time.Hour
+
+// runHook executes a user-provided command through the shell.  The
+// environment of the hook is extended with variables describing the job.
+func (cmd *Backup) runHook(ctx *appcontext.AppContext, kind string, command string, env []string) error {
+	timeout := cmd.HookTimeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		c = exec.CommandContext(hookCtx, "cmd", "/C", command)
+	default: // assume unix-esque
+		c = exec.CommandContext(hookCtx, "/bin/sh", "-c", command)
+	}
+	c.Dir = ctx.CWD
+	c.Env = append(os.Environ(), env...)
+	c.Env = append(c.Env, "PLAKAR_HOOK="+kind)
+	c.Stdout = ctx.Stdout
+	c.Stderr = ctx.Stderr
+	if cmd.JSON {
+		// keep the standard output for the JSON lines
+		c.Stdout = ctx.Stderr
+	}
+	if cmd.Silent {
+		c.Stdout = io.Discard
+		c.Stderr = io.Discard
+	}
+	// don't wait forever on children that inherited our pipes
+	c.WaitDelay = 5 * time.Second
+
+	if err := c.Run(); err != nil {
+		if errors.Is(hookCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s hook timed out after %s", kind, timeout)
+		}
+		return fmt.Errorf("%s hook failed: %w", kind, err)
+	}
+	return nil
+}
+
+func (cmd *Backup) hookEnv(repo *repository.Repository) []string {
+	env := []string{
+		"PLAKAR_JOB=" + cmd.Job,
+		"PLAKAR_SOURCE=" + cmd.Path,
+	}
+	if repo != nil {
+		if location, err := repo.Location(); err == nil {
+			env = append(env, "PLAKAR_REPOSITORY="+location)
+		}
+	}
+	return env
+}
+
+func hookStatusEnv(err error, snapshotID objects.MAC, warning error) []string {
+	var env []string
+	switch {
+	case err != nil:
+		env = append(env, "PLAKAR_STATUS=failure", "PLAKAR_ERROR="+err.Error())
+	case warning != nil:
+		env = append(env, "PLAKAR_STATUS=warning", "PLAKAR_ERROR="+warning.Error())
+	default:
+		env = append(env, "PLAKAR_STATUS=ok")
+	}
+	if snapshotID != (objects.MAC{}) {
+		env = append(env, fmt.Sprintf("PLAKAR_SNAPSHOT_ID=%x", snapshotID))
+	}
+	return env
+}
+
+// withHooks wraps a backup with the user-provided hooks.  A failing
+// pre-hook aborts the backup.  Once the pre-hook succeeded, the post-hook
+// always runs, so that whatever the pre-hook did can be undone, and it may
+// inspect PLAKAR_STATUS to learn about the outcome of the backup.  The
+// failure hook runs when either the pre-hook or the backup failed.
+func (cmd *Backup) withHooks(ctx *appcontext.AppContext, repo *repository.Repository,
+	backup func() (int, error, objects.MAC, error)) (int, error, objects.MAC, error) {
+	env := cmd.hookEnv(repo)
+
+	onFailure := func(err error) {
+		if cmd.FailHook == "" {
+			return
+		}
+		failEnv := slices.Concat(env, hookStatusEnv(err, objects.MAC{}, nil))
+		if herr := cmd.runHook(ctx, "failure", cmd.FailHook, failEnv); herr != nil {
+			ctx.GetLogger().Warn("%s", herr)
+		}
+	}
+
+	if cmd.PreHook != "" {
+		start := time.Now()
+		err := cmd.runHook(ctx, "pre", cmd.PreHook, env)
+		cmd.endPhase("pre-hook", start)
+		if err != nil {
+			onFailure(err)
+			return 1, fmt.Errorf("backup aborted: %w", err), objects.MAC{}, nil
+		}
+	}
+
+	status, err, snapshotID, warning := backup()
+
+	if cmd.PostHook != "" {
+		postEnv := slices.Concat(env, hookStatusEnv(err, snapshotID, warning))
+		start := time.Now()
+		herr := cmd.runHook(ctx, "post", cmd.PostHook, postEnv)
+		cmd.endPhase("post-hook", start)
+		if herr != nil {
+			if err == nil {
+				warning = errors.Join(warning, herr)
+			} else {
+				ctx.GetLogger().Warn("%s", herr)
+			}
+		}
+	}
+
+	if err != nil {
+		onFailure(err)
+	}
+
+	return status, err, snapshotID, warning
+}
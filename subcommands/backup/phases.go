@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/events"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/snapshot/importer"
+	"github.com/PlakarKorp/plakar/appcontext"
+)
+
+// phaseTimer is an importer recording when the steps of a backup end: the
+// scan of the source ends when the importer has no more records, the
+// upload of its content when the snapshot reports the importer done, and
+// the commit when the backup returns.
+type phaseTimer struct {
+	importer.Importer
+
+	mu       sync.Mutex
+	scanned  time.Time
+	imported time.Time
+	done     chan struct{}
+}
+
+func newPhaseTimer(ctx *appcontext.AppContext, imp importer.Importer, snapshotID objects.MAC) *phaseTimer {
+	t := &phaseTimer{
+		Importer: imp,
+		done:     make(chan struct{}),
+	}
+
+	listener := ctx.Events().Listen()
+	go func() {
+		// the listener must be drained until the events are closed
+		closed := false
+		for event := range listener {
+			if closed {
+				continue
+			}
+			switch event := event.(type) {
+			case events.DoneImporter:
+				if event.SnapshotID == snapshotID {
+					t.mu.Lock()
+					t.imported = event.Timestamp
+					t.mu.Unlock()
+				}
+			case events.Done:
+				closed = true
+				close(t.done)
+			}
+		}
+	}()
+	return t
+}
+
+func (t *phaseTimer) Scan(ctx context.Context) (<-chan *importer.ScanResult, error) {
+	results, err := t.Importer.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	timed := make(chan *importer.ScanResult, cap(results))
+	go func() {
+		defer close(timed)
+		for result := range results {
+			timed <- result
+		}
+		t.mu.Lock()
+		t.scanned = time.Now()
+		t.mu.Unlock()
+	}()
+	return timed, nil
+}
+
+// phases returns the scan, upload and commit phases of a backup started
+// at start, once it has returned.
+func (t *phaseTimer) phases(start time.Time) []Phase {
+	end := time.Now()
+	<-t.done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scanned, imported := t.scanned, t.imported
+	if imported.IsZero() {
+		imported = end
+	}
+	if scanned.IsZero() || scanned.After(imported) {
+		scanned = imported
+	}
+	return []Phase{
+		{Name: "scan", Duration: scanned.Sub(start)},
+		{Name: "upload", Duration: imported.Sub(scanned)},
+		{Name: "commit", Duration: end.Sub(imported)},
+	}
+}
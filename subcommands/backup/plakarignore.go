@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/exclude"
+	"github.com/PlakarKorp/kloset/snapshot/importer"
+)
+
+// PLAKARIGNORE is the name of the files holding, like a .gitignore, the
+// patterns of the paths to ignore in their directory and below.
+const PLAKARIGNORE = ".plakarignore"
+
+// ignoreDir holds the rules of the .plakarignore file of a directory,
+// anchored to it.
+type ignoreDir struct {
+	patterns []string
+	rules    *exclude.RuleSet
+	err      error
+}
+
+// ignoreTree is an importer skipping the paths ignored by the
+// .plakarignore files of the source.  The files are read from the local
+// filesystem as the directories holding them are scanned, so it only
+// supports the fs importer.
+type ignoreTree struct {
+	importer.Importer
+
+	root     string
+	dirs     map[string]*ignoreDir
+	excluded map[string]bool
+
+	// called with the rules found once the scan is over
+	done func(rules []string)
+}
+
+func newIgnoreTree(ctx context.Context, imp importer.Importer) (*ignoreTree, error) {
+	typ, err := imp.Type(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "fs" {
+		return nil, fmt.Errorf("%s files are only supported on filesystem sources", PLAKARIGNORE)
+	}
+
+	root, err := imp.Root(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ignoreTree{
+		Importer: imp,
+		root:     root,
+		dirs:     make(map[string]*ignoreDir),
+		excluded: make(map[string]bool),
+	}, nil
+}
+
+// localPath turns a pathname of the fs importer back into a path of the
+// local filesystem.
+func localPath(pathname string) string {
+	if runtime.GOOS == "windows" {
+		pathname = strings.TrimPrefix(pathname, "/")
+	}
+	return filepath.FromSlash(pathname)
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`\*?[`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// anchorPattern turns a pattern read from the .plakarignore file of dir
+// into a pattern matching the same paths from the root of the snapshot.
+func anchorPattern(dir, pattern string) string {
+	pattern = strings.TrimRight(pattern, " \t\r")
+
+	negate := strings.HasPrefix(pattern, "!")
+	pattern = strings.TrimPrefix(pattern, "!")
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	prefix := escapeGlob(strings.TrimSuffix(dir, "/"))
+	if strings.Contains(pattern, "/") {
+		// relative to the directory, as in gitignore
+		pattern = prefix + "/" + strings.TrimPrefix(pattern, "/")
+	} else {
+		pattern = prefix + "/**/" + pattern
+	}
+
+	if dirOnly {
+		pattern += "/"
+	}
+	if negate {
+		pattern = "!" + pattern
+	}
+	return pattern
+}
+
+func (t *ignoreTree) load(dir string) *ignoreDir {
+	if d, ok := t.dirs[dir]; ok {
+		return d
+	}
+
+	d := &ignoreDir{}
+	t.dirs[dir] = d
+
+	lines, err := LoadIgnoreFile(localPath(path.Join(dir, PLAKARIGNORE)))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			d.err = err
+		}
+		return d
+	}
+
+	for _, line := range lines {
+		d.patterns = append(d.patterns, anchorPattern(dir, line))
+	}
+	d.rules = exclude.NewRuleSet()
+	if err := d.rules.AddRulesFromArray(d.patterns); err != nil {
+		d.err = err
+		d.rules = nil
+		d.patterns = nil
+	}
+	return d
+}
+
+func (t *ignoreTree) inside(pathname string) bool {
+	return t.root == "/" || strings.HasPrefix(pathname, t.root+"/")
+}
+
+// match tells whether pathname is ignored by the rules of the directories
+// above it, the deepest ones taking precedence.
+func (t *ignoreTree) match(pathname string, isDir bool) bool {
+	var dirs []string
+	for dir := path.Dir(pathname); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == t.root || dir == "/" {
+			break
+		}
+	}
+
+	excluded := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := t.load(dirs[i])
+		if d.rules == nil {
+			continue
+		}
+		if ignore, rule, _ := d.rules.Match(pathname, isDir); rule != nil {
+			excluded = ignore
+		}
+	}
+	return excluded
+}
+
+func (t *ignoreTree) dirExcluded(dir string) bool {
+	if dir == t.root || !t.inside(dir) {
+		return false
+	}
+	if excluded, ok := t.excluded[dir]; ok {
+		return excluded
+	}
+	excluded := t.dirExcluded(path.Dir(dir)) || t.match(dir, true)
+	t.excluded[dir] = excluded
+	return excluded
+}
+
+// IsExcluded tells whether pathname is ignored, either by a rule or
+// because it lies in an ignored directory.
+func (t *ignoreTree) IsExcluded(pathname string, isDir bool) bool {
+	if !t.inside(pathname) {
+		return false
+	}
+	if isDir {
+		return t.dirExcluded(pathname)
+	}
+	return t.dirExcluded(path.Dir(pathname)) || t.match(pathname, false)
+}
+
+// Rules returns the rules found so far, ordered by directory.
+func (t *ignoreTree) Rules() []string {
+	dirs := make([]string, 0, len(t.dirs))
+	for dir, d := range t.dirs {
+		if len(d.patterns) != 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	var rules []string
+	for _, dir := range dirs {
+		rules = append(rules, t.dirs[dir].patterns...)
+	}
+	return rules
+}
+
+func (t *ignoreTree) Scan(ctx context.Context) (<-chan *importer.ScanResult, error) {
+	results, err := t.Importer.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(chan *importer.ScanResult, cap(results))
+	go func() {
+		defer close(filtered)
+		for result := range results {
+			var pathname string
+			var isDir bool
+			switch {
+			case result.Record != nil:
+				pathname = result.Record.Pathname
+				isDir = result.Record.FileInfo.IsDir()
+			case result.Error != nil:
+				pathname = result.Error.Pathname
+			}
+
+			if t.IsExcluded(pathname, isDir) {
+				if result.Record != nil {
+					result.Record.Close()
+				}
+				continue
+			}
+			filtered <- result
+
+			if isDir && !result.Record.IsXattr && (pathname == t.root || t.inside(pathname)) {
+				// report the failure to read the .plakarignore of
+				// the directory along with it
+				if d := t.load(pathname); d.err != nil {
+					filtered <- importer.NewScanError(path.Join(pathname, PLAKARIGNORE), d.err)
+				}
+			}
+		}
+		if t.done != nil {
+			t.done(t.Rules())
+		}
+	}()
+	return filtered, nil
+}
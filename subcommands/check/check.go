@@ -21,10 +21,12 @@ import (
 	"flag"
 	"fmt"
 
+	"github.com/PlakarKorp/kloset/events"
 	"github.com/PlakarKorp/kloset/locate"
 	"github.com/PlakarKorp/kloset/repository"
 	"github.com/PlakarKorp/kloset/snapshot"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/jsonevents"
 	"github.com/PlakarKorp/plakar/subcommands"
 	"github.com/google/uuid"
 )
@@ -48,6 +50,7 @@ func (cmd *Check) Parse(ctx *appcontext.AppContext, args []string) error {
 	flags.BoolVar(&cmd.FastCheck, "fast", false, "enable fast checking (no digest verification)")
 	flags.BoolVar(&cmd.Quiet, "quiet", false, "suppress output")
 	flags.BoolVar(&cmd.Silent, "silent", false, "suppress ALL output")
+	flags.BoolVar(&cmd.JSON, "json", false, "output the progress and the outcome of the check as JSON lines")
 	cmd.LocateOptions.InstallLocateFlags(flags)
 
 	flags.Parse(args)
@@ -72,13 +75,24 @@ type Check struct {
 	Quiet         bool
 	Snapshots     []string
 	Silent        bool
+	JSON          bool
 }
 
 func (cmd *Check) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if cmd.JSON {
+		ep := jsonevents.Start(ctx)
+		status, err := cmd.execute(ctx, repo)
+		ep.Close(err)
+		return status, err
+	}
+
 	if !cmd.Silent {
 		go eventsProcessorStdio(ctx, cmd.Quiet)
 	}
+	return cmd.execute(ctx, repo)
+}
 
+func (cmd *Check) execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
 	var snapshots []string
 	if len(cmd.Snapshots) == 0 {
 		snapshotIDs, err := locate.LocateSnapshotIDs(repo, cmd.LocateOptions)
@@ -134,9 +148,13 @@ func (cmd *Check) Execute(ctx *appcontext.AppContext, repo *repository.Repositor
 			if ok, err := snap.Verify(); err != nil {
 				ctx.GetLogger().Warn("%s", err)
 			} else if !ok {
-				ctx.GetLogger().Info("snapshot %x signature verification failed", snap.Header.Identifier)
+				if cmd.JSON {
+					ctx.Events().Send(events.ErrorEvent(snap.Header.Identifier, "signature verification failed"))
+				} else {
+					ctx.GetLogger().Info("snapshot %x signature verification failed", snap.Header.Identifier)
+				}
 				failures = true
-			} else {
+			} else if !cmd.JSON {
 				ctx.GetLogger().Info("snapshot %x signature verification succeeded", snap.Header.Identifier)
 			}
 		}
@@ -146,7 +164,7 @@ func (cmd *Check) Execute(ctx *appcontext.AppContext, repo *repository.Repositor
 			failures = true
 		}
 
-		if !failures {
+		if !failures && !cmd.JSON {
 			ctx.GetLogger().Info("check: verification of %x:%s completed successfully",
 				snap.Header.GetIndexShortID(),
 				pathname)
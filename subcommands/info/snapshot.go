@@ -10,6 +10,7 @@ import (
 	"github.com/PlakarKorp/kloset/locate"
 	"github.com/PlakarKorp/kloset/repository"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/utils"
 	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 )
@@ -33,10 +34,24 @@ func (cmd *Info) executeSnapshot(ctx *appcontext.AppContext, repo *repository.Re
 	fmt.Fprintf(ctx.Stdout, "Environment: %s\n", header.Environment)
 	fmt.Fprintf(ctx.Stdout, "Perimeter: %s\n", header.Perimeter)
 	fmt.Fprintf(ctx.Stdout, "Category: %s\n", header.Category)
+	fmt.Fprintf(ctx.Stdout, "Job: %s\n", header.Job)
 	if len(header.Tags) > 0 {
 		fmt.Fprintf(ctx.Stdout, "Tags: %s\n", strings.Join(header.Tags, ", "))
 	}
 
+	labels := false
+	for _, kv := range header.Context {
+		key, found := strings.CutPrefix(kv.Key, utils.LABEL_PREFIX)
+		if !found {
+			continue
+		}
+		if !labels {
+			fmt.Fprintln(ctx.Stdout, "Labels:")
+			labels = true
+		}
+		fmt.Fprintf(ctx.Stdout, " - %s: %s\n", key, kv.Value)
+	}
+
 	if header.Identity.Identifier != uuid.Nil {
 		fmt.Fprintln(ctx.Stdout, "Identity:")
 		fmt.Fprintf(ctx.Stdout, " - Identifier: %s\n", header.Identity.Identifier)
@@ -62,6 +77,13 @@ func (cmd *Info) executeSnapshot(ctx *appcontext.AppContext, repo *repository.Re
 	fmt.Fprintf(ctx.Stdout, " - Client: %s\n", header.GetContext("Client"))
 	fmt.Fprintf(ctx.Stdout, " - CommandLine: %s\n", header.GetContext("CommandLine"))
 
+	if rules := header.GetContext(utils.PLAKARIGNORE_CONTEXT); rules != "" {
+		fmt.Fprintln(ctx.Stdout, "PlakarIgnore:")
+		for _, rule := range strings.Split(rules, "\n") {
+			fmt.Fprintf(ctx.Stdout, " - %s\n", rule)
+		}
+	}
+
 	fmt.Fprintln(ctx.Stdout, "Summary:")
 	fmt.Fprintf(ctx.Stdout, " - Directories: %d\n", header.GetSource(0).Summary.Directory.Directories+header.GetSource(0).Summary.Below.Directories)
 	fmt.Fprintf(ctx.Stdout, " - Files: %d\n", header.GetSource(0).Summary.Directory.Files+header.GetSource(0).Summary.Below.Files)
@@ -75,7 +75,7 @@ func (cmd *Prune) Parse(ctx *appcontext.AppContext, args []string) error {
 		}
 		cfg.ApplyConfig(policyName, cmd.LocateOptions)
 	}
-	mergePolicyOptions(cmd.LocateOptions, policyOverride)
+	MergePolicyOptions(cmd.LocateOptions, policyOverride)
 
 	if flags.NArg() == 0 && cmd.LocateOptions.Empty() {
 		return fmt.Errorf("no filter specified, not going to prune everything")
@@ -86,8 +86,8 @@ func (cmd *Prune) Parse(ctx *appcontext.AppContext, args []string) error {
 	return nil
 }
 
-// override values in "from" if it is set in "to"
-func mergePolicyOptions(to *locate.LocateOptions, from *locate.LocateOptions) {
+// MergePolicyOptions overrides the periods of "to" with those set in "from"
+func MergePolicyOptions(to *locate.LocateOptions, from *locate.LocateOptions) {
 	merge := func(a, b *locate.LocatePeriod) {
 		if b.Keep != 0 {
 			a.Keep = b.Keep
@@ -0,0 +1,143 @@
+package reports
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/reporting"
+	"github.com/PlakarKorp/plakar/subcommands"
+)
+
+func init() {
+	subcommands.Register(func() subcommands.Subcommand { return &ReportsShow{} },
+		subcommands.BeforeRepositoryOpen, "reports", "show")
+	subcommands.Register(func() subcommands.Subcommand { return &Reports{} },
+		subcommands.BeforeRepositoryOpen, "reports")
+}
+
+// Filters select the recorded reports.
+type Filters struct {
+	Kind       string
+	Name       string
+	Status     string
+	Repository string
+	Since      time.Time
+	Before     time.Time
+}
+
+func (f *Filters) Match(report *reporting.Report) bool {
+	if report.Task == nil {
+		return false
+	}
+	if f.Kind != "" && report.Task.Type != f.Kind {
+		return false
+	}
+	if f.Name != "" && report.Task.Name != f.Name {
+		return false
+	}
+	if f.Status != "" && !strings.EqualFold(string(report.Task.Status), f.Status) {
+		return false
+	}
+	if f.Repository != "" && (report.Repository == nil || report.Repository.Name != f.Repository) {
+		return false
+	}
+	if !f.Since.IsZero() && report.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Before.IsZero() && !report.Timestamp.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+type record struct {
+	ID string `json:"id"`
+	*reporting.Report
+}
+
+type Reports struct {
+	subcommands.SubcommandBase
+
+	Filters Filters
+	OptJSON bool
+	Limit   int
+}
+
+func (cmd *Reports) Parse(ctx *appcontext.AppContext, args []string) error {
+	var opt_since, opt_before string
+
+	flags := flag.NewFlagSet("reports", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [OPTIONS]\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "       %s show [-json] ID...\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "\nOPTIONS:\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&cmd.Filters.Kind, "kind", "", "only list the reports of tasks of this kind, such as backup or check")
+	flags.StringVar(&cmd.Filters.Name, "name", "", "only list the reports of the task with this name")
+	flags.StringVar(&cmd.Filters.Status, "status", "", "only list the reports with this status: ok, warning or failure")
+	flags.StringVar(&cmd.Filters.Repository, "repository", "", "only list the reports of tasks on this repository")
+	flags.StringVar(&opt_since, "since", "", "only list the reports since this date or duration")
+	flags.StringVar(&opt_before, "before", "", "only list the reports before this date or duration")
+	flags.IntVar(&cmd.Limit, "limit", 0, "only list the most recent reports")
+	flags.BoolVar(&cmd.OptJSON, "json", false, "output the reports as JSON lines")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("invalid argument: %s", flags.Arg(0))
+	}
+
+	switch strings.ToUpper(cmd.Filters.Status) {
+	case "", string(reporting.StatusOK), string(reporting.StatusWarning), string(reporting.StatusFailed):
+	default:
+		return fmt.Errorf("invalid status: %s", cmd.Filters.Status)
+	}
+
+	var err error
+	if cmd.Filters.Since, err = locate.ParseTimeFlag(opt_since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if cmd.Filters.Before, err = locate.ParseTimeFlag(opt_before); err != nil {
+		return fmt.Errorf("invalid -before: %w", err)
+	}
+	if cmd.Limit < 0 {
+		return fmt.Errorf("invalid -limit: %d", cmd.Limit)
+	}
+	return nil
+}
+
+func (cmd *Reports) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	var records []record
+	err := reporting.ReadReports(reporting.ReportsDir(ctx.CacheDir), func(id string, report *reporting.Report) error {
+		if cmd.Filters.Match(report) {
+			records = append(records, record{ID: id, Report: report})
+		}
+		return nil
+	})
+	if err != nil {
+		return 1, fmt.Errorf("failed to read reports: %w", err)
+	}
+
+	if cmd.Limit > 0 && len(records) > cmd.Limit {
+		records = records[len(records)-cmd.Limit:]
+	}
+
+	enc := json.NewEncoder(ctx.Stdout)
+	for _, rec := range records {
+		if cmd.OptJSON {
+			if err := enc.Encode(rec); err != nil {
+				return 1, err
+			}
+			continue
+		}
+		fmt.Fprintf(ctx.Stdout, "%s %s %s\n", rec.ID,
+			rec.Timestamp.UTC().Format(time.RFC3339), rec.Summary())
+	}
+	return 0, nil
+}
@@ -0,0 +1,135 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/locate"
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/reporting"
+	"github.com/PlakarKorp/plakar/subcommands/rm"
+	"github.com/PlakarKorp/plakar/task"
+	ptesting "github.com/PlakarKorp/plakar/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func setup(t *testing.T) (*appcontext.AppContext, *bytes.Buffer) {
+	ctx := appcontext.NewAppContext()
+	ctx.CacheDir = t.TempDir()
+	bufOut := bytes.NewBuffer(nil)
+	ctx.Stdout = bufOut
+
+	emitter := reporting.NewFileEmitter(reporting.ReportsDir(ctx.CacheDir), reporting.FileConfig{})
+	reports := []struct {
+		kind, name, repository string
+		status                 reporting.TaskStatus
+		age                    time.Duration
+	}{
+		{"backup", "nightly", "/var/backups", reporting.StatusOK, 72 * time.Hour},
+		{"check", "nightly", "/var/backups", reporting.StatusFailed, 48 * time.Hour},
+		{"backup", "nightly", "/var/backups", reporting.StatusWarning, 24 * time.Hour},
+		{"sync", "offsite", "/mnt/offsite", reporting.StatusOK, time.Hour},
+	}
+	for _, r := range reports {
+		report := &reporting.Report{
+			Timestamp: time.Now().Add(-r.age),
+			Task: &reporting.ReportTask{
+				Type:   r.kind,
+				Name:   r.name,
+				Status: r.status,
+			},
+			Repository: &reporting.ReportRepository{Name: r.repository},
+		}
+		require.NoError(t, emitter.Emit(context.Background(), report))
+	}
+	return ctx, bufOut
+}
+
+func list(t *testing.T, ctx *appcontext.AppContext, bufOut *bytes.Buffer, args ...string) []string {
+	bufOut.Reset()
+	cmd := &Reports{}
+	require.NoError(t, cmd.Parse(ctx, args))
+	status, err := cmd.Execute(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(bufOut.String()), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestReports(t *testing.T) {
+	ctx, bufOut := setup(t)
+
+	require.Len(t, list(t, ctx, bufOut), 4)
+	require.Len(t, list(t, ctx, bufOut, "-kind", "backup"), 2)
+	require.Len(t, list(t, ctx, bufOut, "-name", "nightly"), 3)
+	require.Len(t, list(t, ctx, bufOut, "-status", "failure"), 1)
+	require.Len(t, list(t, ctx, bufOut, "-repository", "/mnt/offsite"), 1)
+	require.Len(t, list(t, ctx, bufOut, "-since", "36h"), 2)
+	require.Len(t, list(t, ctx, bufOut, "-before", "36h", "-kind", "backup"), 1)
+
+	lines := list(t, ctx, bufOut, "-limit", "1", "-json")
+	require.Len(t, lines, 1)
+	var rec struct {
+		ID   string                `json:"id"`
+		Task *reporting.ReportTask `json:"report_task"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+	require.Equal(t, "sync", rec.Task.Type)
+
+	cmd := &Reports{}
+	require.Error(t, cmd.Parse(ctx, []string{"-status", "bogus"}))
+}
+
+func TestReportsShow(t *testing.T) {
+	ctx, bufOut := setup(t)
+
+	lines := list(t, ctx, bufOut, "-kind", "check")
+	require.Len(t, lines, 1)
+	id := strings.Fields(lines[0])[0]
+
+	bufOut.Reset()
+	cmd := &ReportsShow{}
+	require.NoError(t, cmd.Parse(ctx, []string{id[:8]}))
+	status, err := cmd.Execute(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, status)
+	require.Contains(t, bufOut.String(), "Report: "+id)
+	require.Contains(t, bufOut.String(), "Status: FAILURE")
+
+	cmd = &ReportsShow{}
+	require.NoError(t, cmd.Parse(ctx, []string{"ffffffffffff0"}))
+	_, err = cmd.Execute(ctx, nil)
+	require.Error(t, err)
+
+	cmd = &ReportsShow{}
+	require.Error(t, cmd.Parse(ctx, nil))
+}
+
+func TestReportsTaskName(t *testing.T) {
+	repo, ctx := ptesting.GenerateRepository(t, nil, nil, nil)
+	ctx.SetLogger(logging.NewLogger(io.Discard, io.Discard))
+	ctx.CacheDir = t.TempDir()
+	ctx.ConfigDir = t.TempDir()
+	bufOut := bytes.NewBuffer(nil)
+	ctx.Stdout = bufOut
+
+	cmd := &rm.Rm{LocateOptions: locate.NewDefaultLocateOptions(locate.WithJob("nightly"))}
+	cmd.SetTaskName("nightly")
+	_, _, err := task.RunTask(ctx, cmd, repo, "@agent")
+	require.NoError(t, err)
+
+	require.Len(t, list(t, ctx, bufOut, "-name", "nightly"), 1)
+	require.Empty(t, list(t, ctx, bufOut, "-name", "@agent"))
+}
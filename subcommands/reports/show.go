@@ -0,0 +1,134 @@
+package reports
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/reporting"
+	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/dustin/go-humanize"
+)
+
+type ReportsShow struct {
+	subcommands.SubcommandBase
+
+	OptJSON bool
+	IDs     []string
+}
+
+func (cmd *ReportsShow) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("reports show", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-json] ID...\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "\nOPTIONS:\n")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&cmd.OptJSON, "json", false, "output the reports as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no report specified")
+	}
+	cmd.IDs = flags.Args()
+	return nil
+}
+
+func (cmd *ReportsShow) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	// identifiers can be abbreviated, as long as they are not ambiguous
+	matches := make([][]record, len(cmd.IDs))
+	err := reporting.ReadReports(reporting.ReportsDir(ctx.CacheDir), func(id string, report *reporting.Report) error {
+		for i, prefix := range cmd.IDs {
+			if strings.HasPrefix(id, prefix) {
+				matches[i] = append(matches[i], record{ID: id, Report: report})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 1, fmt.Errorf("failed to read reports: %w", err)
+	}
+
+	for i, id := range cmd.IDs {
+		switch len(matches[i]) {
+		case 0:
+			return 1, fmt.Errorf("no such report: %s", id)
+		case 1:
+		default:
+			return 1, fmt.Errorf("ambiguous report identifier: %s", id)
+		}
+	}
+
+	for i := range cmd.IDs {
+		rec := matches[i][0]
+		if cmd.OptJSON {
+			enc := json.NewEncoder(ctx.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(rec); err != nil {
+				return 1, err
+			}
+			continue
+		}
+		showReport(ctx, rec)
+	}
+	return 0, nil
+}
+
+func showReport(ctx *appcontext.AppContext, rec record) {
+	task := rec.Task
+	if task == nil {
+		task = &reporting.ReportTask{}
+	}
+
+	fmt.Fprintf(ctx.Stdout, "Report: %s\n", rec.ID)
+	fmt.Fprintf(ctx.Stdout, "Timestamp: %s\n", rec.Timestamp.UTC().Format(time.RFC3339))
+	fmt.Fprintf(ctx.Stdout, "Task: %s\n", task.Type)
+	if task.Name != "" {
+		fmt.Fprintf(ctx.Stdout, "Name: %s\n", task.Name)
+	}
+	fmt.Fprintf(ctx.Stdout, "Start: %s\n", task.StartTime.UTC().Format(time.RFC3339))
+	fmt.Fprintf(ctx.Stdout, "Duration: %s\n", task.Duration)
+	fmt.Fprintf(ctx.Stdout, "Status: %s\n", task.Status)
+	if task.Attempt > 1 {
+		fmt.Fprintf(ctx.Stdout, "Attempt: %d\n", task.Attempt)
+	}
+	if task.ErrorMessage != "" {
+		fmt.Fprintf(ctx.Stdout, "Error: %s\n", task.ErrorMessage)
+	}
+	if rec.Repository != nil {
+		fmt.Fprintf(ctx.Stdout, "Repository: %s\n", rec.Repository.Name)
+		fmt.Fprintf(ctx.Stdout, "Repository ID: %s\n", rec.Repository.Storage.RepositoryID)
+	}
+	if rec.Snapshot != nil {
+		fmt.Fprintf(ctx.Stdout, "Snapshot: %x\n", rec.Snapshot.Identifier)
+		if rec.Snapshot.Name != "" {
+			fmt.Fprintf(ctx.Stdout, "Snapshot name: %s\n", rec.Snapshot.Name)
+		}
+		if len(rec.Snapshot.Tags) != 0 {
+			fmt.Fprintf(ctx.Stdout, "Snapshot tags: %s\n", strings.Join(rec.Snapshot.Tags, ", "))
+		}
+		if stats := rec.Snapshot.Stats; stats != nil {
+			fmt.Fprintf(ctx.Stdout, "Files: %d\n", stats.Files)
+			fmt.Fprintf(ctx.Stdout, "Directories: %d\n", stats.Directories)
+			fmt.Fprintf(ctx.Stdout, "Read: %s\n", humanize.IBytes(stats.BytesRead))
+			fmt.Fprintf(ctx.Stdout, "Written: %s\n", humanize.IBytes(uint64(stats.BytesWritten)))
+			fmt.Fprintf(ctx.Stdout, "Errors: %d\n", stats.Errors)
+			for _, perr := range stats.ErrorPaths {
+				fmt.Fprintf(ctx.Stdout, "  %s: %s\n", perr.Path, perr.Error)
+			}
+			if delta := stats.Delta; delta != nil {
+				fmt.Fprintf(ctx.Stdout, "Previous snapshot: %x\n", delta.Previous)
+				fmt.Fprintf(ctx.Stdout, "Delta: %+d files, %+d directories, %+d bytes\n",
+					delta.Files, delta.Directories, delta.Bytes)
+			}
+		}
+	}
+	for _, phase := range task.Phases {
+		fmt.Fprintf(ctx.Stdout, "Phase %s: %s\n", phase.Name, phase.Duration)
+	}
+	fmt.Fprintln(ctx.Stdout)
+}
@@ -28,7 +28,9 @@ import (
 	"github.com/PlakarKorp/kloset/snapshot"
 	"github.com/PlakarKorp/kloset/snapshot/exporter"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/jsonevents"
 	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/PlakarKorp/plakar/throttle"
 )
 
 type Restore struct {
@@ -47,7 +49,10 @@ type Restore struct {
 	Concurrency uint64
 	Quiet       bool
 	Silent      bool
+	JSON        bool
 	Snapshots   []string
+
+	LimitDownload int64
 }
 
 func init() {
@@ -75,7 +80,9 @@ func (cmd *Restore) Parse(ctx *appcontext.AppContext, args []string) error {
 	flags.StringVar(&pullPath, "to", "", "base directory where pull will restore")
 	flags.BoolVar(&cmd.Quiet, "quiet", false, "do not print progress")
 	flags.BoolVar(&cmd.Silent, "silent", false, "do not print ANY progress")
+	flags.BoolVar(&cmd.JSON, "json", false, "output the progress and the outcome of the restore as JSON lines")
 	flags.BoolVar(&cmd.OptSkipPermissions, "skip-permissions", false, "do not restore file permissions")
+	flags.Var(throttle.NewRateFlag(&cmd.LimitDownload), "limit-download", "maximum rate of the reads from the repository, in bytes per second")
 	flags.Parse(args)
 
 	if flags.NArg() != 0 {
@@ -98,9 +105,22 @@ func (cmd *Restore) Parse(ctx *appcontext.AppContext, args []string) error {
 }
 
 func (cmd *Restore) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	if cmd.JSON {
+		ep := jsonevents.Start(ctx)
+		status, err := cmd.execute(ctx, repo)
+		ep.Close(err)
+		return status, err
+	}
+
 	if !cmd.Silent {
 		go eventsProcessorStdio(ctx, cmd.Quiet)
 	}
+	return cmd.execute(ctx, repo)
+}
+
+func (cmd *Restore) execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	throttle.SetLimiters(repo.Store(), nil, throttle.NewLimiter(cmd.LimitDownload))
+
 	var snapshots []string
 	if len(cmd.Snapshots) == 0 {
 		locateOptions := locate.NewDefaultLocateOptions()
@@ -204,10 +224,12 @@ func (cmd *Restore) Execute(ctx *appcontext.AppContext, repo *repository.Reposit
 			return 1, err
 		}
 
-		ctx.GetLogger().Info("restore: restoration of %x:%s at %s completed successfully",
-			snap.Header.GetIndexShortID(),
-			pathname,
-			cmd.Target)
+		if !cmd.JSON {
+			ctx.GetLogger().Info("restore: restoration of %x:%s at %s completed successfully",
+				snap.Header.GetIndexShortID(),
+				pathname,
+				cmd.Target)
+		}
 		snap.Close()
 	}
 	return 0, nil
@@ -5,6 +5,7 @@ package scheduler
 import (
 	"log/syslog"
 	"os"
+	"os/signal"
 	"syscall"
 
 	"github.com/PlakarKorp/plakar/appcontext"
@@ -51,3 +52,7 @@ func daemonize(argv []string) error {
 func stop() error {
 	return syscall.Kill(os.Getpid(), syscall.SIGINT)
 }
+
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
@@ -30,6 +30,10 @@ func init() {
 		subcommands.BeforeRepositoryOpen, "scheduler", "start")
 	subcommands.Register(func() subcommands.Subcommand { return &SchedulerStop{} },
 		subcommands.BeforeRepositoryOpen, "scheduler", "stop")
+	subcommands.Register(func() subcommands.Subcommand { return &SchedulerReload{} },
+		subcommands.BeforeRepositoryOpen, "scheduler", "reload")
+	subcommands.Register(func() subcommands.Subcommand { return &SchedulerStatus{} },
+		subcommands.BeforeRepositoryOpen, "scheduler", "status")
 	subcommands.Register(func() subcommands.Subcommand { return &Scheduler{} },
 		subcommands.BeforeRepositoryOpen, "scheduler")
 }
@@ -41,7 +45,7 @@ type Scheduler struct {
 func (cmd *Scheduler) Parse(ctx *appcontext.AppContext, args []string) error {
 	flags := flag.NewFlagSet("scheduler", flag.ExitOnError)
 	flags.Usage = func() {
-		fmt.Fprintf(flags.Output(), "Usage: %s start | stop\n",
+		fmt.Fprintf(flags.Output(), "Usage: %s start | stop | reload | status\n",
 			flags.Name())
 	}
 	flags.Parse(args)
@@ -30,6 +30,7 @@ import (
 
 	"github.com/PlakarKorp/kloset/repository"
 	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/metrics"
 	"github.com/PlakarKorp/plakar/scheduler"
 	"github.com/PlakarKorp/plakar/subcommands"
 	"github.com/PlakarKorp/plakar/utils"
@@ -53,6 +54,7 @@ func (cmd *SchedulerStart) Parse(ctx *appcontext.AppContext, args []string) erro
 	flags.BoolVar(&opt_foreground, "foreground", false, "run in foreground")
 	flags.StringVar(&opt_logfile, "log", "", "log file")
 	flags.StringVar(&opt_tasks, "tasks", "", "tasks configuration file")
+	flags.StringVar(&cmd.metricsListen, "metrics-listen", "", "serve Prometheus metrics on this address")
 	flags.Parse(args)
 	if flags.NArg() != 0 {
 		return fmt.Errorf("too many arguments")
@@ -86,6 +88,7 @@ func (cmd *SchedulerStart) Parse(ctx *appcontext.AppContext, args []string) erro
 		}
 		defer fp.Close()
 		rd = fp
+		cmd.tasksPath = absolutePath
 	}
 
 	configBytes, err := io.ReadAll(rd)
@@ -134,7 +137,9 @@ type SchedulerContext struct {
 	agentCtx        *appcontext.AppContext
 	schedulerCtx    *appcontext.AppContext
 	schedulerConfig *scheduler.Configuration
+	scheduler       *scheduler.Scheduler
 	schedulerState  schedulerState
+	tasksPath       string
 	mtx             sync.Mutex
 }
 
@@ -142,16 +147,40 @@ type SchedulerStart struct {
 	subcommands.SubcommandBase
 	socketPath       string
 	schedConfigBytes []byte
+	tasksPath        string
+	metricsListen    string
 }
 
 func (cmd *SchedulerStart) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
 	schedulerContextSingleton = &SchedulerContext{
-		agentCtx: ctx,
+		agentCtx:  ctx,
+		tasksPath: cmd.tasksPath,
+	}
+
+	if cmd.metricsListen != "" {
+		if err := metrics.Serve(ctx, cmd.metricsListen); err != nil {
+			return 1, fmt.Errorf("failed to serve metrics: %w", err)
+		}
 	}
 
 	configureTasks(cmd.schedConfigBytes)
 	startTasks()
 
+	reload := make(chan os.Signal, 1)
+	notifyReload(reload)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reload:
+				if _, err := reloadTasks(); err != nil {
+					ctx.GetLogger().Error("failed to reload the tasks configuration: %s", err)
+				}
+			}
+		}
+	}()
+
 	if err := cmd.ListenAndServe(ctx); err != nil {
 		return 1, err
 	}
@@ -245,6 +274,13 @@ func handleClient(_ *appcontext.AppContext, conn net.Conn) {
 		} else {
 			response.ExitCode = 0
 		}
+	case "reload":
+		if _, err := reloadTasks(); err != nil {
+			response.ExitCode = 1
+			response.Err = err.Error()
+		} else {
+			response.ExitCode = 0
+		}
 	default:
 		response.ExitCode = 1
 		response.Err = fmt.Sprintf("unknown command: %s", request.Type)
@@ -269,7 +305,8 @@ func startTasks() (int, error) {
 
 	// this needs to execute in the agent context, not the client context
 	schedulerContextSingleton.schedulerCtx = appcontext.NewAppContextFrom(schedulerContextSingleton.agentCtx)
-	go scheduler.NewScheduler(schedulerContextSingleton.schedulerCtx, schedulerContextSingleton.schedulerConfig).Run()
+	schedulerContextSingleton.scheduler = scheduler.NewScheduler(schedulerContextSingleton.schedulerCtx, schedulerContextSingleton.schedulerConfig)
+	go schedulerContextSingleton.scheduler.Run()
 
 	schedulerContextSingleton.schedulerState = AGENT_SCHEDULER_RUNNING
 
@@ -292,9 +329,36 @@ func configureTasks(schedConfigBytes []byte) (int, error) {
 	if schedulerContextSingleton.schedulerCtx != nil {
 		schedulerContextSingleton.schedulerCtx.Cancel()
 		schedulerContextSingleton.schedulerCtx = appcontext.NewAppContextFrom(schedulerContextSingleton.agentCtx)
-		go scheduler.NewScheduler(schedulerContextSingleton.schedulerCtx, schedConfig).Run()
+		schedulerContextSingleton.scheduler = scheduler.NewScheduler(schedulerContextSingleton.schedulerCtx, schedConfig)
+		go schedulerContextSingleton.scheduler.Run()
 	}
 
 	schedulerContextSingleton.schedulerConfig = schedConfig
 	return 0, nil
 }
+
+// reloadTasks parses the tasks configuration file again and applies the
+// changes to the running scheduler without interrupting the running jobs.
+func reloadTasks() (int, error) {
+	schedulerContextSingleton.mtx.Lock()
+	defer schedulerContextSingleton.mtx.Unlock()
+
+	if schedulerContextSingleton.tasksPath == "" {
+		return 1, fmt.Errorf("tasks configuration was not loaded from a file")
+	}
+
+	schedConfig, err := scheduler.ParseConfigFile(schedulerContextSingleton.tasksPath)
+	if err != nil {
+		return 1, err
+	}
+
+	schedulerContextSingleton.schedulerConfig = schedConfig
+	if schedulerContextSingleton.scheduler != nil {
+		if err := schedulerContextSingleton.scheduler.Reload(schedConfig); err != nil {
+			return 1, err
+		}
+	}
+
+	schedulerContextSingleton.agentCtx.GetLogger().Info("reloaded tasks configuration from %s", schedulerContextSingleton.tasksPath)
+	return 0, nil
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/kloset/repository"
+	"github.com/PlakarKorp/plakar/appcontext"
+	"github.com/PlakarKorp/plakar/scheduler"
+	"github.com/PlakarKorp/plakar/subcommands"
+)
+
+type SchedulerStatus struct {
+	subcommands.SubcommandBase
+
+	OptJSON    bool
+	OptHistory bool
+	Tasks      []string
+}
+
+func (cmd *SchedulerStatus) Parse(ctx *appcontext.AppContext, args []string) error {
+	flags := flag.NewFlagSet("scheduler status", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [OPTIONS] [TASK...]\n", flags.Name())
+		fmt.Fprintf(flags.Output(), "\nOPTIONS:\n")
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&cmd.OptJSON, "json", false, "output the scheduler state as JSON")
+	flags.BoolVar(&cmd.OptHistory, "history", false, "show the recent runs of each task")
+	flags.Parse(args)
+
+	cmd.Tasks = flags.Args()
+	return nil
+}
+
+func (cmd *SchedulerStatus) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
+	state, err := scheduler.LoadState(ctx.CacheDir)
+	if err != nil {
+		return 1, fmt.Errorf("failed to load scheduler state: %w", err)
+	}
+
+	names := make([]string, 0, len(state.Tasks))
+	for name := range state.Tasks {
+		if len(cmd.Tasks) != 0 && !slices.Contains(cmd.Tasks, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range cmd.Tasks {
+		if _, ok := state.Tasks[name]; !ok {
+			return 1, fmt.Errorf("no such task: %s", name)
+		}
+	}
+
+	if cmd.OptJSON {
+		tasks := make(map[string]*scheduler.TaskState, len(names))
+		for _, name := range names {
+			tasks[name] = state.Tasks[name]
+		}
+		enc := json.NewEncoder(ctx.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(tasks); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+
+	for _, name := range names {
+		ts := state.Tasks[name]
+
+		last := "never"
+		if ts.LastRun != nil {
+			last = fmt.Sprintf("%s %s", ts.LastRun.Start.UTC().Format(time.RFC3339), formatRun(ts.LastRun))
+		}
+		next := "-"
+		if !ts.NextRun.IsZero() {
+			next = ts.NextRun.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(ctx.Stdout, "%s: last=%s next=%s\n", name, last, next)
+
+		if cmd.OptHistory {
+			for i := len(ts.History) - 1; i >= 0; i-- {
+				run := ts.History[i]
+				fmt.Fprintf(ctx.Stdout, "  %s %s\n", run.Start.UTC().Format(time.RFC3339), formatRun(&run))
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+func formatRun(run *scheduler.Run) string {
+	var sb strings.Builder
+	sb.WriteString(string(run.Status))
+	if run.Status != scheduler.RunRunning {
+		fmt.Fprintf(&sb, " (%s)", run.Duration.Round(time.Second))
+	}
+	if run.Error != "" {
+		fmt.Fprintf(&sb, ": %s", run.Error)
+	}
+	return sb.String()
+}
@@ -35,6 +35,18 @@ type Subcommand interface {
 	SetLogInfo(bool)
 	GetLogTraces() string
 	SetLogTraces(string)
+
+	GetAttempt() int
+	SetAttempt(int)
+	GetTaskName() string
+	SetTaskName(string)
+
+	GetUsername() string
+	SetUsername(string)
+	GetProcessID() int
+	SetProcessID(int)
+	GetDetach() bool
+	SetDetach(bool)
 }
 
 type SubcommandBase struct {
@@ -46,6 +58,17 @@ type SubcommandBase struct {
 	// XXX - rework that post-release
 	LogInfo   bool
 	LogTraces string
+
+	// set by the scheduler when retrying a failed task
+	Attempt int
+
+	// set by the scheduler to the name of the task the command runs for
+	TaskName string
+
+	// set by the client sending the command to the agent
+	Username  string
+	ProcessID int
+	Detach    bool
 }
 
 func (cmd *SubcommandBase) setFlags(flags CommandFlags) {
@@ -88,6 +111,46 @@ func (cmd *SubcommandBase) SetLogTraces(traces string) {
 	cmd.LogTraces = traces
 }
 
+func (cmd *SubcommandBase) GetAttempt() int {
+	return cmd.Attempt
+}
+
+func (cmd *SubcommandBase) SetAttempt(attempt int) {
+	cmd.Attempt = attempt
+}
+
+func (cmd *SubcommandBase) GetTaskName() string {
+	return cmd.TaskName
+}
+
+func (cmd *SubcommandBase) SetTaskName(name string) {
+	cmd.TaskName = name
+}
+
+func (cmd *SubcommandBase) GetUsername() string {
+	return cmd.Username
+}
+
+func (cmd *SubcommandBase) SetUsername(username string) {
+	cmd.Username = username
+}
+
+func (cmd *SubcommandBase) GetProcessID() int {
+	return cmd.ProcessID
+}
+
+func (cmd *SubcommandBase) SetProcessID(pid int) {
+	cmd.ProcessID = pid
+}
+
+func (cmd *SubcommandBase) GetDetach() bool {
+	return cmd.Detach
+}
+
+func (cmd *SubcommandBase) SetDetach(detach bool) {
+	cmd.Detach = detach
+}
+
 func (cmd *SubcommandBase) GetRepositorySecret() []byte {
 	return cmd.RepositorySecret
 }
@@ -29,6 +29,7 @@ import (
 	"github.com/PlakarKorp/kloset/storage"
 	"github.com/PlakarKorp/plakar/appcontext"
 	"github.com/PlakarKorp/plakar/subcommands"
+	"github.com/PlakarKorp/plakar/throttle"
 	"github.com/PlakarKorp/plakar/utils"
 )
 
@@ -47,6 +48,8 @@ func (cmd *Sync) Parse(ctx *appcontext.AppContext, args []string) error {
 		flags.PrintDefaults()
 	}
 	cmd.SrcLocateOptions.InstallLocateFlags(flags)
+	flags.Var(throttle.NewRateFlag(&cmd.LimitUpload), "limit-upload", "maximum rate of the writes to the repositories, in bytes per second")
+	flags.Var(throttle.NewRateFlag(&cmd.LimitDownload), "limit-download", "maximum rate of the reads from the repositories, in bytes per second")
 
 	flags.Parse(args)
 
@@ -149,6 +152,9 @@ type Sync struct {
 	Direction string
 
 	SrcLocateOptions *locate.LocateOptions
+
+	LimitUpload   int64
+	LimitDownload int64
 }
 
 func (cmd *Sync) Execute(ctx *appcontext.AppContext, repo *repository.Repository) (int, error) {
@@ -157,11 +163,17 @@ func (cmd *Sync) Execute(ctx *appcontext.AppContext, repo *repository.Repository
 		return 1, fmt.Errorf("peer repository: %w", err)
 	}
 
-	peerStore, peerStoreSerializedConfig, err := storage.Open(ctx.GetInner(), storeConfig)
+	peerStore, peerStoreSerializedConfig, err := throttle.Open(ctx.GetInner(), storeConfig)
 	if err != nil {
 		return 1, fmt.Errorf("could not open peer store %s: %s", cmd.PeerRepositoryLocation, err)
 	}
 
+	// both repositories share the limits given on the command line
+	uploadLimiter := throttle.NewLimiter(cmd.LimitUpload)
+	downloadLimiter := throttle.NewLimiter(cmd.LimitDownload)
+	throttle.SetLimiters(repo.Store(), uploadLimiter, downloadLimiter)
+	throttle.SetLimiters(peerStore, uploadLimiter, downloadLimiter)
+
 	peerCtx := appcontext.NewAppContextFrom(ctx)
 	peerCtx.SetSecret(cmd.PeerRepositorySecret)
 	peerRepository, err := repository.New(peerCtx.GetInner(), peerCtx.GetSecret(), peerStore, peerStoreSerializedConfig)
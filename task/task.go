@@ -9,19 +9,28 @@ import (
 	"github.com/PlakarKorp/plakar/subcommands/backup"
 	"github.com/PlakarKorp/plakar/subcommands/check"
 	"github.com/PlakarKorp/plakar/subcommands/maintenance"
+	"github.com/PlakarKorp/plakar/subcommands/prune"
 	"github.com/PlakarKorp/plakar/subcommands/restore"
 	"github.com/PlakarKorp/plakar/subcommands/rm"
 	"github.com/PlakarKorp/plakar/subcommands/sync"
 )
 
 func RunCommand(ctx *appcontext.AppContext, cmd subcommands.Subcommand, repo *repository.Repository, taskName string) (int, error) {
+	status, _, err := RunTask(ctx, cmd, repo, taskName)
+	return status, err
+}
+
+// RunTask is like RunCommand but also returns the identifier of the
+// snapshot created by a backup.  The task is reported under the name set
+// by the scheduler, if any, and under taskName otherwise.
+func RunTask(ctx *appcontext.AppContext, cmd subcommands.Subcommand, repo *repository.Repository, taskName string) (int, objects.MAC, error) {
 	location := ""
 	var err error
 
 	if repo != nil {
 		location, err = repo.Location()
 		if err != nil {
-			return 1, err
+			return 1, objects.MAC{}, err
 		}
 	}
 
@@ -40,13 +49,19 @@ func RunCommand(ctx *appcontext.AppContext, cmd subcommands.Subcommand, repo *re
 		taskKind = "sync"
 	case *rm.Rm:
 		taskKind = "rm"
+	case *prune.Prune:
+		taskKind = "prune"
 	case *maintenance.Maintenance:
 		taskKind = "maintenance"
 	default:
 		report.SetIgnore()
 	}
 
+	if name := cmd.GetTaskName(); name != "" {
+		taskName = name
+	}
 	report.TaskStart(taskKind, taskName)
+	report.WithAttempt(cmd.GetAttempt())
 	if repo != nil {
 		report.WithRepositoryName(location)
 		report.WithRepository(repo)
@@ -61,6 +76,11 @@ func RunCommand(ctx *appcontext.AppContext, cmd subcommands.Subcommand, repo *re
 		if !cmd.DryRun && err == nil {
 			report.WithSnapshotID(snapshotID)
 		}
+		var phases []reporting.ReportPhase
+		for _, phase := range cmd.Phases() {
+			phases = append(phases, reporting.ReportPhase{Name: phase.Name, Duration: phase.Duration})
+		}
+		report.WithPhases(phases)
 	} else {
 		status, err = cmd.Execute(ctx, repo)
 	}
@@ -77,5 +97,5 @@ func RunCommand(ctx *appcontext.AppContext, cmd subcommands.Subcommand, repo *re
 
 	reporter.StopAndWait()
 
-	return status, err
+	return status, snapshotID, err
 }
@@ -0,0 +1,188 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/kcontext"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/snapshot/importer"
+	"github.com/PlakarKorp/kloset/storage"
+)
+
+// Keys of the configuration of a store or a source setting its limits.
+const (
+	CONFIG_LIMIT_UPLOAD   = "limit_upload"
+	CONFIG_LIMIT_DOWNLOAD = "limit_download"
+	CONFIG_LIMIT_READ     = "limit_read"
+)
+
+// Store limits the bytes written to and read from a store, whatever its
+// backend.
+type Store struct {
+	storage.Store
+
+	mtx      sync.Mutex
+	upload   *Limiter
+	download *Limiter
+}
+
+func NewStore(store storage.Store, upload, download *Limiter) *Store {
+	return &Store{
+		Store:    store,
+		upload:   upload,
+		download: download,
+	}
+}
+
+// Open opens the store like storage.Open, with the limits set in its
+// configuration.
+func Open(ctx *kcontext.KContext, storeConfig map[string]string) (storage.Store, []byte, error) {
+	upload, err := configLimiter(storeConfig, CONFIG_LIMIT_UPLOAD)
+	if err != nil {
+		return nil, nil, err
+	}
+	download, err := configLimiter(storeConfig, CONFIG_LIMIT_DOWNLOAD)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, serializedConfig, err := storage.Open(ctx, storeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewStore(store, upload, download), serializedConfig, nil
+}
+
+func configLimiter(config map[string]string, key string) (*Limiter, error) {
+	value, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	rate, err := ParseRate(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimiter(rate), nil
+}
+
+// SetLimiters replaces the limiters of the store, a nil limiter keeps the
+// current one.
+func (s *Store) SetLimiters(upload, download *Limiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if upload != nil {
+		s.upload = upload
+	}
+	if download != nil {
+		s.download = download
+	}
+}
+
+// SetLimiters sets the limiters of store if it was opened with Open, it
+// is a no-op otherwise.
+func SetLimiters(store storage.Store, upload, download *Limiter) {
+	if s, ok := store.(*Store); ok {
+		s.SetLimiters(upload, download)
+	}
+}
+
+func (s *Store) limiters() (*Limiter, *Limiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.upload, s.download
+}
+
+func (s *Store) put(ctx context.Context, rd io.Reader, put func(io.Reader) (int64, error)) (int64, error) {
+	upload, _ := s.limiters()
+	return put(Reader(ctx, rd, upload))
+}
+
+func (s *Store) get(ctx context.Context, rd io.ReadCloser, err error) (io.ReadCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	_, download := s.limiters()
+	return ReadCloser(ctx, rd, download), nil
+}
+
+func (s *Store) PutState(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
+	return s.put(ctx, rd, func(rd io.Reader) (int64, error) {
+		return s.Store.PutState(ctx, mac, rd)
+	})
+}
+
+func (s *Store) GetState(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
+	rd, err := s.Store.GetState(ctx, mac)
+	return s.get(ctx, rd, err)
+}
+
+func (s *Store) PutPackfile(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
+	return s.put(ctx, rd, func(rd io.Reader) (int64, error) {
+		return s.Store.PutPackfile(ctx, mac, rd)
+	})
+}
+
+func (s *Store) GetPackfile(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
+	rd, err := s.Store.GetPackfile(ctx, mac)
+	return s.get(ctx, rd, err)
+}
+
+func (s *Store) GetPackfileBlob(ctx context.Context, mac objects.MAC, offset uint64, length uint32) (io.ReadCloser, error) {
+	rd, err := s.Store.GetPackfileBlob(ctx, mac, offset, length)
+	return s.get(ctx, rd, err)
+}
+
+func (s *Store) PutLock(ctx context.Context, lockID objects.MAC, rd io.Reader) (int64, error) {
+	return s.put(ctx, rd, func(rd io.Reader) (int64, error) {
+		return s.Store.PutLock(ctx, lockID, rd)
+	})
+}
+
+func (s *Store) GetLock(ctx context.Context, lockID objects.MAC) (io.ReadCloser, error) {
+	rd, err := s.Store.GetLock(ctx, lockID)
+	return s.get(ctx, rd, err)
+}
+
+// Importer limits the bytes read from the files of a source.
+type Importer struct {
+	importer.Importer
+
+	read *Limiter
+}
+
+// NewImporter returns imp as is if read is nil.
+func NewImporter(imp importer.Importer, read *Limiter) importer.Importer {
+	if read == nil {
+		return imp
+	}
+	return &Importer{Importer: imp, read: read}
+}
+
+// ImporterLimiter returns the read limiter set in the configuration of a
+// source, which is removed from it.
+func ImporterLimiter(config map[string]string) (*Limiter, error) {
+	limiter, err := configLimiter(config, CONFIG_LIMIT_READ)
+	delete(config, CONFIG_LIMIT_READ)
+	return limiter, err
+}
+
+func (imp *Importer) Scan(ctx context.Context) (<-chan *importer.ScanResult, error) {
+	results, err := imp.Importer.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	throttled := make(chan *importer.ScanResult, cap(results))
+	go func() {
+		defer close(throttled)
+		for result := range results {
+			if result.Record != nil && result.Record.Reader != nil {
+				result.Record.Reader = ReadCloser(ctx, result.Record.Reader, imp.read)
+			}
+			throttled <- result
+		}
+	}()
+	return throttled, nil
+}
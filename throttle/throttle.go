@@ -0,0 +1,161 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Limiter is a token bucket letting through rate bytes per second on
+// average, with bursts of up to a second worth of bytes.  A nil Limiter
+// doesn't limit anything.
+type Limiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter for rate bytes per second, or nil if rate
+// is not positive.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait
+// for them to be available.
+func (l *Limiter) reserve(n float64) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may go through or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	for remaining := float64(n); remaining > 0; {
+		chunk := min(remaining, l.rate)
+		remaining -= chunk
+
+		delay := l.reserve(chunk)
+		if delay <= 0 {
+			continue
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	ctx     context.Context
+	rd      io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		if err := r.limiter.WaitN(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Reader returns a reader reading from rd no faster than the limiter
+// allows.
+func Reader(ctx context.Context, rd io.Reader, limiter *Limiter) io.Reader {
+	if limiter == nil {
+		return rd
+	}
+	return &reader{ctx: ctx, rd: rd, limiter: limiter}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadCloser is like Reader for an io.ReadCloser.
+func ReadCloser(ctx context.Context, rd io.ReadCloser, limiter *Limiter) io.ReadCloser {
+	if limiter == nil {
+		return rd
+	}
+	return &readCloser{Reader: Reader(ctx, rd, limiter), Closer: rd}
+}
+
+// ParseRate parses a rate in bytes per second, such as "10MiB", "512k" or
+// "1MB/s".  A rate of zero, or an empty one, means no limit.
+func ParseRate(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	return int64(rate), nil
+}
+
+type rateFlag struct {
+	rate *int64
+}
+
+// NewRateFlag returns a flag.Value setting rate with ParseRate.
+func NewRateFlag(rate *int64) *rateFlag {
+	return &rateFlag{rate: rate}
+}
+
+func (f *rateFlag) String() string {
+	if f.rate == nil || *f.rate == 0 {
+		return ""
+	}
+	return humanize.IBytes(uint64(*f.rate)) + "/s"
+}
+
+func (f *rateFlag) Set(value string) error {
+	rate, err := ParseRate(value)
+	if err != nil {
+		return err
+	}
+	*f.rate = rate
+	return nil
+}
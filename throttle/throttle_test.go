@@ -0,0 +1,53 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"":        0,
+		"0":       0,
+		"1024":    1024,
+		"10MiB":   10 << 20,
+		"1MB/s":   1_000_000,
+		" 512k ":  512_000,
+		"2 GiB/s": 2 << 30,
+	} {
+		rate, err := ParseRate(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, rate, value)
+	}
+
+	_, err := ParseRate("fast")
+	require.Error(t, err)
+}
+
+func TestLimiter(t *testing.T) {
+	require.Nil(t, NewLimiter(0))
+	var unlimited *Limiter
+	require.NoError(t, unlimited.WaitN(context.Background(), 1<<30))
+
+	// the first second worth of bytes goes through at once, the rest
+	// at the given rate
+	limiter := NewLimiter(100_000)
+	data := bytes.Repeat([]byte("x"), 120_000)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, Reader(context.Background(), bytes.NewReader(data), limiter))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, 150*time.Millisecond)
+	require.Less(t, elapsed, 2*time.Second)
+
+	// waiting stops with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, limiter.WaitN(ctx, 1_000_000), context.DeadlineExceeded)
+}
@@ -0,0 +1,12 @@
+package utils
+
+// Keys of the context of the snapshot headers set by plakar.
+const (
+	// LABEL_PREFIX prefixes the keys of the labels, not to clash with
+	// the other keys.
+	LABEL_PREFIX = "label."
+
+	// PLAKARIGNORE_CONTEXT is the key recording the rules found in the
+	// .plakarignore files, one per line.
+	PLAKARIGNORE_CONTEXT = "PlakarIgnore"
+)